@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// defaultInterval is how often we announce to a tracker that gives no interval
+const defaultInterval = 30 * time.Minute
+
+// stopTimeout bounds the stopped announce, which is sent as we shut down
+const stopTimeout = 5 * time.Second
+
+// intervalUnit is the unit of the intervals trackers give, seconds. tests shorten it
+var intervalUnit = time.Second
+
+// wait gives how long to wait before announcing again: the interval, but not less than the min interval
+func (a *AnnounceResp) wait() time.Duration {
+	interval := a.interval
+	if interval < a.minInterval {
+		interval = a.minInterval
+	}
+	if interval == 0 {
+		return defaultInterval
+	}
+	return time.Duration(interval) * intervalUnit
+}
+
+// left gives the bytes of the torrent we don't have verified. before the info dict is fetched the size is not known,
+// and anything but zero does, so the tracker does not take us for a seed
+func (t *Torrent) left() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.size == 0 {
+		return int64(formats.BLOCK_LEN)
+	}
+	return int64(t.size - t.verified)
+}
+
+func (t *Torrent) announceReq(event Event) AnnounceReq {
+	return AnnounceReq{
+		InfoHash:   t.InfoH,
+		PeerId:     peerId,
+		Port:       PORT,
+		Uploaded:   t.uploaded.Load(),
+		Downloaded: t.downloaded.Load(),
+		Left:       t.left(),
+		Event:      event,
+		NumWant:    -1,
+		Key:        trackerKey,
+	}
+}
+
+// announce announces the torrent to its trackers, and adds the peers they give.
+// it gives how long to wait before the next announce
+func (t *Torrent) announce(ctx context.Context, event Event) (time.Duration, error) {
+	resp, err := t.Trackers().Announce(ctx, t.announceReq(event))
+	if err != nil {
+		return 0, err
+	}
+	if resp.warning != "" {
+		log.Printf("Warning from tracker: %s\n", resp.warning)
+	}
+	t.addPeers(resp.socks)
+	if event == EventStarted {
+		t.started.Store(true)
+	}
+	return resp.wait(), nil
+}
+
+// pieceVerified counts a piece that was written and whose hash is right. once all are, the torrent is complete
+func (t *Torrent) pieceVerified(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.have == nil {
+		t.have = make(formats.Bitfield, (len(t.pieceHashes())+7)/8)
+	}
+	if t.have.Has(index) {
+		return
+	}
+	t.have.Set(index)
+	t.verified += t.mInfo.PieceLen(index)
+	t.notify()
+	if t.verified == t.size {
+		close(t.completeCh())
+	}
+}
+
+// completeCh is closed when all pieces are verified. t.mu must be held
+func (t *Torrent) completeCh() chan struct{} {
+	if t.complete == nil {
+		t.complete = make(chan struct{})
+	}
+	return t.complete
+}
+
+func (t *Torrent) completed() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.completeCh()
+}
+
+// runAnnouncer announces the torrent until ctx ends: started if it was not yet, then on the interval the tracker gives,
+// completed as soon as the last piece is verified, and stopped as it ends. failed announces are tried again later
+func (t *Torrent) runAnnouncer(ctx context.Context) {
+	if len(t.Trackers().Status()) == 0 {
+		return
+	}
+	event := EventStarted
+	var wait time.Duration
+	if t.started.Load() { // findPeers did it
+		event = EventNone
+		wait = t.Trackers().wait()
+	}
+	complete := t.completed()
+	// completed comes right after started, when the download is done before started is sent
+	pendingCompleted := false
+	failures := 0
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if pendingCompleted {
+				event = EventCompleted
+			}
+			t.stopAnnouncing(event, complete)
+			return
+		case <-complete:
+			timer.Stop()
+			complete = nil // completed is sent once
+			if event == EventNone {
+				event = EventCompleted
+			} else if event == EventStarted {
+				pendingCompleted = true
+			}
+		case <-timer.C:
+		}
+		w, err := t.announce(ctx, event)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			failures++
+			wait = retryDelay(failures)
+			continue
+		}
+		failures = 0
+		event, wait = EventNone, w
+		if pendingCompleted {
+			event, wait, pendingCompleted = EventCompleted, 0, false
+		}
+	}
+}
+
+// stopAnnouncing tells the trackers we stop, after the completed announce if it is not yet sent
+func (t *Torrent) stopAnnouncing(event Event, complete <-chan struct{}) {
+	if !t.started.Load() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	select {
+	case <-complete:
+		event = EventCompleted
+	default:
+	}
+	if event == EventCompleted {
+		t.announce(ctx, event)
+	}
+	t.announce(ctx, EventStopped)
+}
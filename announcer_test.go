@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+func TestAnnouncer(t *testing.T) {
+	intervalUnit = time.Millisecond
+	defer func() { intervalUnit = time.Second }()
+	reqs := make(chan url.Values, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs <- r.URL.Query()
+		w.Write([]byte("d8:intervali20e5:peers0:e"))
+	}))
+	defer srv.Close()
+
+	torr := &Torrent{size: 3 * formats.BLOCK_LEN}
+	torr.mInfo.Announce = srv.URL
+	torr.mInfo.Info = formats.InfoDict{PieceLen: 2 * formats.BLOCK_LEN, PiecesHash: make([]formats.Sha1, 2), Length: torr.size}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		torr.runAnnouncer(ctx)
+		close(done)
+	}()
+
+	next := func(event, left string) url.Values {
+		t.Helper()
+		select {
+		case q := <-reqs:
+			if q.Get("event") != event || left != "" && q.Get("left") != left {
+				t.Fatalf("Expected event %q and left %s, got %v", event, left, q)
+			}
+			return q
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No announce with event %q", event)
+		}
+		return nil
+	}
+	next("started", "49152")
+	torr.downloaded.Add(100)
+	if q := next("", "49152"); q.Get("downloaded") != "100" {
+		t.Errorf("Wrong downloaded: %v", q)
+	}
+
+	torr.pieceVerified(1)
+	torr.pieceVerified(1) // counted once
+	// an announce may have been on its way
+	if q := next("", ""); q.Get("left") != "32768" {
+		next("", "32768")
+	}
+	torr.pieceVerified(0)
+	// the interval announces may be in between
+	for q := range reqs {
+		if q.Get("event") == "completed" {
+			if q.Get("left") != "0" {
+				t.Errorf("Wrong left: %v", q)
+			}
+			break
+		}
+		if q.Get("event") != "" {
+			t.Fatalf("Expected the completed event, got %v", q)
+		}
+	}
+
+	cancel()
+	<-done
+	var last url.Values
+	for len(reqs) > 0 {
+		last = <-reqs
+	}
+	if last.Get("event") != "stopped" {
+		t.Errorf("Expected the stopped event last, got %v", last)
+	}
+}
+
+func TestAnnouncerCompleteFirst(t *testing.T) {
+	// the download may be done before the started announce is sent, or while it is tried again
+	for k := 0; k < 10; k++ {
+		reqs := make(chan string, 10)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqs <- r.URL.Query().Get("event")
+			w.Write([]byte("d8:intervali600e5:peers0:e"))
+		}))
+		torr := &Torrent{size: formats.BLOCK_LEN}
+		torr.mInfo.Announce = srv.URL
+		torr.mInfo.Info = formats.InfoDict{PieceLen: formats.BLOCK_LEN, PiecesHash: make([]formats.Sha1, 1), Length: torr.size}
+		torr.pieceVerified(0)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			torr.runAnnouncer(ctx)
+			close(done)
+		}()
+		for _, expected := range []string{"started", "completed"} {
+			select {
+			case e := <-reqs:
+				if e != expected {
+					t.Fatalf("Expected event %q, got %q", expected, e)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("No announce with event %q", expected)
+			}
+		}
+		cancel()
+		<-done
+		srv.Close()
+	}
+}
+
+func TestInit(t *testing.T) {
+	Init()
+	// trackers tell clients apart by them
+	if peerId == ([20]byte{}) || trackerKey == 0 {
+		t.Errorf("Expected a random peer id and key, got % x and %d", peerId, trackerKey)
+	}
+}
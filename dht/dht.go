@@ -0,0 +1,563 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// VERSION is how we name ourselves in KRPC messages: two letters for the client, two for the version
+const VERSION = "OD01"
+
+// alpha is the number of queries a lookup has in flight at once
+const alpha = 3
+
+// peers announced to us are kept this long, unless announced again
+const peerLife = 30 * time.Minute
+
+// the most peers we keep for an infohash, the most infohashes we keep peers of, and the most peers we give in a
+// get_peers response. announces are cheap to make, so what they take is bounded
+const (
+	maxStoredPeers  = 500
+	maxStoredHashes = 1000
+	maxValues       = 50
+)
+
+var TimeoutError = errors.New("DHT query timed out")
+
+// BOOTSTRAP_NODES are well known nodes to join the DHT through
+var BOOTSTRAP_NODES = []string{"router.bittorrent.com:6881", "dht.transmissionbt.com:6881", "router.utorrent.com:6881"}
+
+type Config struct {
+	Addr    string        // udp address to listen on, e.g. ":6881"
+	ID      ID            // the id of the node. random if zero
+	Timeout time.Duration // how long a query waits for its response. 2 seconds if zero
+}
+
+// DHT is a node of the DHT. It answers the queries of other nodes, and finds nodes and peers for us
+type DHT struct {
+	conn    *net.UDPConn
+	id      ID
+	table   *table
+	tokens  *tokens
+	timeout time.Duration
+
+	mu      sync.Mutex
+	txId    uint16
+	pending map[string]pendingQuery      // our queries waiting for a response, by transaction id
+	peers   map[ID]map[string]storedPeer // peers announced to us, by infohash then address
+	closed  chan struct{}
+}
+
+type pendingQuery struct {
+	addr *net.UDPAddr
+	resp chan *Msg
+}
+
+type storedPeer struct {
+	addr formats.CompactAddr
+	at   time.Time
+}
+
+// New starts a node listening on `cfg.Addr`. it knows no other node until `Bootstrap` or `AddNode`
+func New(cfg Config) (*DHT, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	d := &DHT{
+		conn:    conn,
+		id:      cfg.ID,
+		tokens:  newTokens(),
+		timeout: cfg.Timeout,
+		pending: map[string]pendingQuery{},
+		peers:   map[ID]map[string]storedPeer{},
+		closed:  make(chan struct{}),
+	}
+	if d.id == (ID{}) {
+		d.id = RandomID()
+	}
+	if d.timeout == 0 {
+		d.timeout = 2 * time.Second
+	}
+	d.table = newTable(d.id)
+	go d.serve()
+	go d.refresh()
+	return d, nil
+}
+
+func (d *DHT) ID() ID {
+	return d.id
+}
+
+// Addr gives the address the node listens on
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (d *DHT) Close() error {
+	select {
+	case <-d.closed:
+		return nil
+	default:
+	}
+	close(d.closed)
+	return d.conn.Close()
+}
+
+// Bootstrap joins the DHT through the nodes at `addrs`, then looks up our own id to fill the routing table
+func (d *DHT) Bootstrap(ctx context.Context, addrs []string) error {
+	var wg sync.WaitGroup
+	for _, a := range addrs {
+		a := a
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if addr, err := net.ResolveUDPAddr("udp", a); err == nil {
+				d.Ping(ctx, addr)
+			}
+		}()
+	}
+	wg.Wait()
+	if d.table.len() == 0 {
+		return fmt.Errorf("None of the %d bootstrap nodes answered", len(addrs))
+	}
+	_, err := d.FindNode(ctx, d.id)
+	return err
+}
+
+// Ping pings a node, and adds it to the routing table if it answers. it gives the id of the node
+func (d *DHT) Ping(ctx context.Context, addr *net.UDPAddr) (ID, error) {
+	r, err := d.query(ctx, addr, pingQuery, Args{})
+	if err != nil {
+		return ID{}, err
+	}
+	return r.ID, nil
+}
+
+// FindNode looks up the K nodes closest to the target
+func (d *DHT) FindNode(ctx context.Context, target ID) ([]Node, error) {
+	res := d.lookup(ctx, target, findNodeQuery)
+	if len(res.closest) == 0 {
+		return nil, fmt.Errorf("No node answered the lookup of %s", target)
+	}
+	nodes := make([]Node, len(res.closest))
+	for i, c := range res.closest {
+		nodes[i] = c.Node
+	}
+	return nodes, ctx.Err()
+}
+
+// GetPeers looks up the peers of a torrent, asking the nodes closest to its infohash
+func (d *DHT) GetPeers(ctx context.Context, infoHash ID) ([]formats.CompactAddr, error) {
+	res := d.lookup(ctx, infoHash, getPeersQuery)
+	if len(res.closest) == 0 {
+		return nil, fmt.Errorf("No node answered the lookup of %s", infoHash)
+	}
+	return res.peers, nil
+}
+
+// Announce tells the nodes closest to the infohash that we are a peer of the torrent, listening on tcp `port`.
+// a zero port has them take the port our udp packets come from. it gives the peers the lookup found
+func (d *DHT) Announce(ctx context.Context, infoHash ID, port int) ([]formats.CompactAddr, error) {
+	res := d.lookup(ctx, infoHash, getPeersQuery)
+	args := Args{InfoHash: &infoHash, Port: port}
+	if port == 0 {
+		args.ImpliedPort = 1
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	announced := 0
+	for _, c := range res.closest {
+		if c.token == "" {
+			continue
+		}
+		a := args
+		a.Token = c.token
+		addr := c.Addr
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := d.query(ctx, addr, announceQuery, a); err == nil {
+				mu.Lock()
+				announced++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if announced == 0 {
+		return res.peers, fmt.Errorf("No node took the announce of %s", infoHash)
+	}
+	return res.peers, nil
+}
+
+// AddNode adds a node we heard of some other way, e.g. from the port message of a peer, if it answers a ping
+func (d *DHT) AddNode(ctx context.Context, addr *net.UDPAddr) error {
+	_, err := d.Ping(ctx, addr)
+	return err
+}
+
+// candidate is a node of a lookup
+type candidate struct {
+	Node
+	queried, answered bool
+	token             string // the token it gave with get_peers
+}
+
+type lookupResult struct {
+	closest []*candidate // the K closest nodes that answered, closest first
+	peers   []formats.CompactAddr
+}
+
+// lookup is the iterative lookup of Kademlia: the closest nodes known are queried, `alpha` at a time, and the
+// nodes they return are queried in turn, until the K closest nodes that answer have all been queried.
+// `q` is find_node or get_peers, the peers get_peers gives are gathered along the way
+func (d *DHT) lookup(ctx context.Context, target ID, q string) *lookupResult {
+	var cands []*candidate
+	seen := map[string]bool{}
+	add := func(n Node) {
+		k := n.Addr.String()
+		if seen[k] || n.ID == d.id {
+			return
+		}
+		seen[k] = true
+		cands = append(cands, &candidate{Node: n})
+	}
+	for _, n := range d.table.closest(target, K) {
+		add(n)
+	}
+	res := &lookupResult{}
+	peerSeen := map[string]bool{}
+	type answer struct {
+		c *candidate
+		r *Return
+	}
+	for ctx.Err() == nil {
+		sort.Slice(cands, func(i, j int) bool {
+			return target.closer(cands[i].ID, cands[j].ID)
+		})
+		var batch []*candidate
+		live := 0
+		for _, c := range cands {
+			if live == K {
+				break
+			}
+			if c.queried && !c.answered { // failed
+				continue
+			}
+			live++
+			if !c.queried && len(batch) < alpha {
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		answers := make(chan answer, len(batch))
+		for _, c := range batch {
+			c.queried = true
+			go func(c *candidate) {
+				args := Args{}
+				if q == findNodeQuery {
+					args.Target = &target
+				} else {
+					args.InfoHash = &target
+				}
+				r, err := d.query(ctx, c.Addr, q, args)
+				if err != nil {
+					r = nil
+				}
+				answers <- answer{c, r}
+			}(c)
+		}
+		for range batch {
+			a := <-answers
+			if a.r == nil {
+				continue
+			}
+			a.c.answered = true
+			a.c.ID = a.r.ID
+			a.c.token = a.r.Token
+			for _, p := range a.r.peers() {
+				if k := string(p.Marshall()); !peerSeen[k] {
+					peerSeen[k] = true
+					res.peers = append(res.peers, p)
+				}
+			}
+			nodes, _ := a.r.nodes()
+			for _, n := range nodes {
+				add(n)
+			}
+		}
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		return target.closer(cands[i].ID, cands[j].ID)
+	})
+	for _, c := range cands {
+		if c.answered && len(res.closest) < K {
+			res.closest = append(res.closest, c)
+		}
+	}
+	return res
+}
+
+// query sends a query and waits for its response
+func (d *DHT) query(ctx context.Context, addr *net.UDPAddr, q string, args Args) (*Return, error) {
+	args.ID = d.id
+	ch := make(chan *Msg, 1)
+	d.mu.Lock()
+	d.txId++
+	t := string([]byte{byte(d.txId >> 8), byte(d.txId)})
+	d.pending[t] = pendingQuery{addr: addr, resp: ch}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, t)
+		d.mu.Unlock()
+	}()
+
+	if err := d.send(addr, &Msg{T: t, Y: query, Q: q, A: &args, V: VERSION}); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+	select {
+	case m := <-ch:
+		if m.Y == errorMsg {
+			if m.E == nil {
+				return nil, &Error{Code: GenericError, Msg: "error without a code"}
+			}
+			return nil, m.E
+		}
+		if m.R == nil {
+			return nil, &Error{Code: ProtocolError, Msg: "response without values"}
+		}
+		d.sawNode(Node{ID: m.R.ID, Addr: addr})
+		return m.R, nil
+	case <-timer.C:
+		d.table.failed(addr)
+		return nil, TimeoutError
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (d *DHT) send(addr *net.UDPAddr, m *Msg) error {
+	b, err := formats.Marshall(m)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDP(b, addr)
+	return err
+}
+
+func (d *DHT) sendError(t string, addr *net.UDPAddr, code int, msg string) {
+	d.send(addr, &Msg{T: t, Y: errorMsg, E: &Error{Code: code, Msg: msg}, V: VERSION})
+}
+
+// sawNode notes a node that is alive. if its bucket is full, the least recently seen node is pinged,
+// and replaced if it does not answer
+func (d *DHT) sawNode(n Node) {
+	old, addr := d.table.seen(n)
+	if old == nil {
+		return
+	}
+	go func() {
+		if _, err := d.Ping(context.Background(), addr); err != nil {
+			d.table.replace(old, n)
+		}
+	}()
+}
+
+// serve reads the packets that come in, answering queries and passing responses to the queries waiting for them.
+// packets that are not KRPC messages are dropped
+func (d *DHT) serve() {
+	buf := make([]byte, 65536)
+	backoff := time.Duration(0)
+	for {
+		n, from, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// the errors that are not fatal are waited out, a little longer each time
+			if backoff = 2 * backoff; backoff == 0 {
+				backoff = 10 * time.Millisecond
+			} else if backoff > time.Second {
+				backoff = time.Second
+			}
+			select {
+			case <-d.closed:
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+		m, err := ParseMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch m.Y {
+		case query:
+			d.handleQuery(m, from)
+		case response, errorMsg:
+			d.mu.Lock()
+			p, ok := d.pending[m.T]
+			d.mu.Unlock()
+			// the response must come from the node queried
+			if ok && p.addr.IP.Equal(from.IP) && p.addr.Port == from.Port {
+				select {
+				case p.resp <- m:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (d *DHT) handleQuery(m *Msg, from *net.UDPAddr) {
+	if m.A == nil {
+		d.sendError(m.T, from, ProtocolError, "query without arguments")
+		return
+	}
+	r := &Return{ID: d.id}
+	switch m.Q {
+	case pingQuery:
+	case findNodeQuery:
+		if m.A.Target == nil {
+			d.sendError(m.T, from, ProtocolError, "find_node without a target")
+			return
+		}
+		r.Nodes, r.Nodes6 = compactNodes(d.table.closest(*m.A.Target, K))
+	case getPeersQuery:
+		if m.A.InfoHash == nil {
+			d.sendError(m.T, from, ProtocolError, "get_peers without an infohash")
+			return
+		}
+		r.Token = d.tokens.token(from.IP)
+		if r.Values = d.storedPeers(*m.A.InfoHash); len(r.Values) == 0 {
+			r.Nodes, r.Nodes6 = compactNodes(d.table.closest(*m.A.InfoHash, K))
+		}
+	case announceQuery:
+		if m.A.InfoHash == nil {
+			d.sendError(m.T, from, ProtocolError, "announce_peer without an infohash")
+			return
+		}
+		if !d.tokens.valid(m.A.Token, from.IP) {
+			d.sendError(m.T, from, ProtocolError, "bad token")
+			return
+		}
+		port := m.A.Port
+		if m.A.ImpliedPort != 0 {
+			port = from.Port
+		}
+		if port <= 0 || port > 65535 {
+			d.sendError(m.T, from, ProtocolError, "bad port")
+			return
+		}
+		d.storePeer(*m.A.InfoHash, formats.CompactAddr{IP: from.IP, Port: uint16(port)})
+	default:
+		d.sendError(m.T, from, MethodUnknown, "Method Unknown")
+		return
+	}
+	d.sawNode(Node{ID: m.A.ID, Addr: from})
+	d.send(from, &Msg{T: m.T, Y: response, R: r, V: VERSION})
+}
+
+func (d *DHT) storePeer(infoHash ID, addr formats.CompactAddr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	peers, ok := d.peers[infoHash]
+	if !ok {
+		if len(d.peers) >= maxStoredHashes {
+			if d.sweep(); len(d.peers) >= maxStoredHashes {
+				return
+			}
+		}
+		peers = map[string]storedPeer{}
+		d.peers[infoHash] = peers
+	}
+	k := string(addr.Marshall())
+	if _, ok := peers[k]; !ok && len(peers) >= maxStoredPeers {
+		return
+	}
+	peers[k] = storedPeer{addr: addr, at: time.Now()}
+}
+
+// storedPeers gives up to `maxValues` peers announced for the infohash, as compact addresses. expired ones are dropped
+func (d *DHT) storedPeers(infoHash ID) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var values []string
+	for k, p := range d.peers[infoHash] {
+		if time.Since(p.at) > peerLife {
+			delete(d.peers[infoHash], k)
+			continue
+		}
+		if len(values) < maxValues {
+			values = append(values, k)
+		}
+	}
+	if len(values) == 0 {
+		delete(d.peers, infoHash)
+	}
+	return values
+}
+
+// sweep drops the peers that expired, and the infohashes left without peers. d.mu must be held
+func (d *DHT) sweep() {
+	for h, peers := range d.peers {
+		for k, p := range peers {
+			if time.Since(p.at) > peerLife {
+				delete(peers, k)
+			}
+		}
+		if len(peers) == 0 {
+			delete(d.peers, h)
+		}
+	}
+}
+
+// refresh pings the nodes of the routing table that were not seen in a while, so bad nodes make way for others.
+// the peers announced to us that expired are dropped too
+func (d *DHT) refresh() {
+	ticker := time.NewTicker(goodFor / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+		}
+		d.mu.Lock()
+		d.sweep()
+		d.mu.Unlock()
+		d.table.mu.Lock()
+		var stale []*net.UDPAddr
+		for _, b := range d.table.buckets {
+			for _, e := range b {
+				if !e.good() && !e.bad() {
+					stale = append(stale, e.Addr)
+				}
+			}
+		}
+		d.table.mu.Unlock()
+		for _, addr := range stale {
+			d.Ping(context.Background(), addr)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+func TestKRPC(t *testing.T) {
+	var id, target ID
+	id[0], target[0] = 1, 2
+	b, err := formats.Marshall(&Msg{T: "aa", Y: query, Q: findNodeQuery, A: &Args{ID: id, Target: &target}})
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	var m Msg
+	if err := formats.Unmarshall(b, &m); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if m.Q != findNodeQuery || m.A.ID != id || m.A.Target == nil || *m.A.Target != target || m.A.InfoHash != nil {
+		t.Errorf("Wrong query: %+v %+v", m, m.A)
+	}
+
+	// the example error of BEP 5
+	if err := formats.Unmarshall([]byte("d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee"), &m); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if m.Y != errorMsg || m.E == nil || m.E.Code != GenericError || m.E.Msg != "A Generic Error Ocurred" {
+		t.Errorf("Wrong error: %+v", m.E)
+	}
+	if b, _ := formats.Marshall(&Error{Code: 204, Msg: "Method Unknown"}); string(b) != "li204e14:Method Unknowne" {
+		t.Errorf("Wrong error encoding: %s", b)
+	}
+
+	nodes := []Node{{ID: id, Addr: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}}, {ID: target, Addr: &net.UDPAddr{IP: net.ParseIP("::1"), Port: 6}}}
+	r := &Return{}
+	r.Nodes, r.Nodes6 = compactNodes(nodes)
+	if len(r.Nodes) != 26 || len(r.Nodes6) != 38 {
+		t.Errorf("Wrong compact node info: %d %d", len(r.Nodes), len(r.Nodes6))
+	}
+	got, err := r.nodes()
+	if err != nil || len(got) != 2 || got[1].ID != target || got[0].Addr.Port != 5 {
+		t.Errorf("Wrong nodes: %v %s", got, err)
+	}
+}
+
+func TestTable(t *testing.T) {
+	var self ID
+	tb := newTable(self)
+	// all these share no leading bit with the zero id, so they go in the first bucket
+	for i := 0; i < K+2; i++ {
+		var id ID
+		id[0], id[1] = 0x80, byte(i)
+		old, _ := tb.seen(Node{ID: id, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 1}})
+		if old != nil {
+			t.Errorf("Good nodes should not be questioned")
+		}
+	}
+	if tb.len() != K {
+		t.Errorf("Bucket should hold %d nodes, has %d", K, tb.len())
+	}
+	// a node failing twice is bad, and makes way for the next
+	tb.failed(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1})
+	tb.failed(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1})
+	var id ID
+	id[0], id[1] = 0x80, 0xff
+	tb.seen(Node{ID: id, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 0xff), Port: 1}})
+	closest := tb.closest(id, 1)
+	if len(closest) != 1 || closest[0].ID != id {
+		t.Errorf("Wrong closest: %v", closest)
+	}
+	for _, n := range tb.closest(self, K) {
+		if n.ID[1] == 3 {
+			t.Errorf("Bad node still in the table")
+		}
+	}
+
+	// a questionable node is pinged before a new one may replace it
+	tb.buckets[0][0].lastSeen = time.Now().Add(-goodFor)
+	id[1] = 0xfe
+	n := Node{ID: id, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 0xfe), Port: 1}}
+	old, addr := tb.seen(n)
+	if old == nil || addr == nil {
+		t.Fatalf("Questionable node should be pinged")
+	}
+	if again, _ := tb.seen(n); again != nil {
+		t.Errorf("Node pinged twice")
+	}
+	tb.failed(addr)
+	tb.replace(old, n)
+	if c := tb.closest(id, 1); c[0].ID != id {
+		t.Errorf("Questionable node not replaced")
+	}
+}
+
+func TestTokens(t *testing.T) {
+	tk := newTokens()
+	ip := net.IPv4(10, 0, 0, 1)
+	tok := tk.token(ip)
+	if !tk.valid(tok, ip) || tk.valid(tok, net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("Token should only be valid for its ip")
+	}
+	tk.changedAt = time.Now().Add(-secretLife)
+	if !tk.valid(tok, ip) {
+		t.Errorf("Token of the last secret should be valid")
+	}
+	tk.changedAt = time.Now().Add(-secretLife)
+	if tk.valid(tok, ip) {
+		t.Errorf("Token should expire")
+	}
+}
+
+// swarm starts n nodes on loopback, all bootstrapped through the first
+func swarm(t *testing.T, n int) []*DHT {
+	var nodes []*DHT
+	for i := 0; i < n; i++ {
+		d, err := New(Config{Addr: "127.0.0.1:0", Timeout: 500 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+		t.Cleanup(func() { d.Close() })
+		nodes = append(nodes, d)
+	}
+	ctx := context.Background()
+	for _, d := range nodes[1:] {
+		if err := d.Bootstrap(ctx, []string{nodes[0].Addr().String()}); err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+	}
+	return nodes
+}
+
+func TestSwarm(t *testing.T) {
+	nodes := swarm(t, 30)
+	ctx := context.Background()
+	last := nodes[len(nodes)-1]
+	if last.table.len() < K {
+		t.Errorf("Routing table has only %d nodes", last.table.len())
+	}
+
+	// find_node finds a node by its id
+	found, err := nodes[5].FindNode(ctx, nodes[20].ID())
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if found[0].ID != nodes[20].ID() || found[0].Addr.Port != nodes[20].Addr().Port {
+		t.Errorf("Node not found: %v", found[0])
+	}
+
+	var infoHash ID
+	infoHash[0] = 0x42
+	if peers, err := nodes[3].Announce(ctx, infoHash, 7000); err != nil || len(peers) != 0 {
+		t.Fatalf("Wrong announce: %v %v", peers, err)
+	}
+	// implied port: the port of the announcing node
+	if _, err := nodes[4].Announce(ctx, infoHash, 0); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	peers, err := nodes[25].GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	ports := map[uint16]bool{}
+	for _, p := range peers {
+		ports[p.Port] = true
+	}
+	if len(peers) != 2 || !ports[7000] || !ports[uint16(nodes[4].Addr().Port)] {
+		t.Errorf("Wrong peers: %v", peers)
+	}
+
+	// an announce with a made up token is refused
+	_, err = nodes[6].query(ctx, nodes[0].Addr(), announceQuery, Args{InfoHash: &infoHash, Port: 1, Token: "made up"})
+	var kerr *Error
+	if !errors.As(err, &kerr) || kerr.Code != ProtocolError {
+		t.Errorf("Should refuse a bad token: %v", err)
+	}
+	if _, err = nodes[6].query(ctx, nodes[0].Addr(), "vote", Args{}); !errors.As(err, &kerr) || kerr.Code != MethodUnknown {
+		t.Errorf("Should not know the method: %v", err)
+	}
+
+	// a node that is gone times out, and is counted as failing
+	gone := nodes[1].Addr()
+	nodes[1].Close()
+	if _, err := nodes[2].Ping(ctx, gone); err != TimeoutError {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
+
+func TestHostilePackets(t *testing.T) {
+	for _, p := range []string{"d1:y99999999999999999:x", "d1:ad2:id" + strings.Repeat("l", 100)} {
+		if _, err := ParseMsg([]byte(p)); err == nil {
+			t.Errorf("%.30q should not decode", p)
+		}
+	}
+	nodes := swarm(t, 2)
+	conn, err := net.DialUDP("udp", nil, nodes[0].Addr())
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	defer conn.Close()
+	for _, p := range []string{"d1:y99999999999999999:x", "not bencode", ""} {
+		conn.Write([]byte(p))
+	}
+	// the node is still up
+	if _, err := nodes[1].Ping(context.Background(), nodes[0].Addr()); err != nil {
+		t.Errorf("Errored: %s", err)
+	}
+}
+
+func TestPeerStore(t *testing.T) {
+	d := &DHT{peers: map[ID]map[string]storedPeer{}}
+	peer := func(i int) formats.CompactAddr {
+		return formats.CompactAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 6881}
+	}
+	var h ID
+	for i := 0; i < maxStoredPeers+10; i++ {
+		d.storePeer(h, peer(i))
+	}
+	if len(d.peers[h]) != maxStoredPeers {
+		t.Errorf("Expected %d peers kept, got %d", maxStoredPeers, len(d.peers[h]))
+	}
+	for i := 1; i < maxStoredHashes+10; i++ {
+		h[0], h[1] = byte(i>>8), byte(i)
+		d.storePeer(h, peer(0))
+	}
+	if len(d.peers) != maxStoredHashes {
+		t.Errorf("Expected %d infohashes kept, got %d", maxStoredHashes, len(d.peers))
+	}
+	// expired peers make way for new infohashes
+	for _, peers := range d.peers {
+		for k, p := range peers {
+			p.at = time.Now().Add(-2 * peerLife)
+			peers[k] = p
+		}
+		break
+	}
+	h[0], h[1] = 0xff, 0xff
+	d.storePeer(h, peer(0))
+	if len(d.peers[h]) != 1 || len(d.peers) != maxStoredHashes {
+		t.Errorf("Expected the new infohash in place of the expired one, got %d infohashes", len(d.peers))
+	}
+}
@@ -0,0 +1,4 @@
+package dht
+
+// package `dht` is a node of the mainline DHT (BEP 5): https://www.bittorrent.org/beps/bep_0005.html
+// it finds peers of a torrent from its infohash alone, without trackers
@@ -0,0 +1,227 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// ID identifies a node, or a torrent by its infohash. both live in the same 160 bit space
+type ID [20]byte
+
+func RandomID() ID {
+	var id ID
+	if _, err := rand.Read(id[:]); err != nil {
+		panic("error while creating random node id: " + err.Error())
+	}
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// xor is the distance between two ids
+func (id ID) xor(other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// prefixLen gives the number of leading bits two ids share, 160 if they are the same
+func (id ID) prefixLen(other ID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 160
+}
+
+// closer reports whether `a` is closer to the id than `b`
+func (id ID) closer(a, b ID) bool {
+	for i := range id {
+		da, db := a[i]^id[i], b[i]^id[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// KRPC is a bencoded dictionary sent over udp: a query, a response to one, or an error
+const (
+	query    = "q"
+	response = "r"
+	errorMsg = "e"
+)
+
+// queries
+const (
+	pingQuery     = "ping"
+	findNodeQuery = "find_node"
+	getPeersQuery = "get_peers"
+	announceQuery = "announce_peer"
+)
+
+// error codes
+const (
+	GenericError  = 201
+	ServerError   = 202
+	ProtocolError = 203
+	MethodUnknown = 204
+)
+
+type Msg struct {
+	T string  `benc:"t"` // transaction id, echoed in the response
+	Y string  `benc:"y"` // q, r or e
+	Q string  `benc:"q,omitempty"`
+	A *Args   `benc:"a,omitempty"`
+	R *Return `benc:"r,omitempty"`
+	E *Error  `benc:"e,omitempty"`
+	V string  `benc:"v,omitempty"` // client version
+}
+
+// Args are the arguments of a query. the id of the querying node is always there, the others depend on the query
+type Args struct {
+	ID          ID     `benc:"id"`
+	Target      *ID    `benc:"target,omitempty"`    // find_node
+	InfoHash    *ID    `benc:"info_hash,omitempty"` // get_peers and announce_peer
+	Port        int    `benc:"port,omitempty"`
+	ImpliedPort int    `benc:"implied_port,omitempty"` // 1 to take the port the query came from instead of `port`
+	Token       string `benc:"token,omitempty"`
+}
+
+// Return are the values of a response
+type Return struct {
+	ID     ID       `benc:"id"`
+	Nodes  string   `benc:"nodes,omitempty"`  // compact ipv4 node info: the id then the compact address, 26 bytes each
+	Nodes6 string   `benc:"nodes6,omitempty"` // compact ipv6 node info, 38 bytes each
+	Token  string   `benc:"token,omitempty"`
+	Values []string `benc:"values,omitempty"` // compact addresses of peers
+}
+
+// ParseMsg decodes a KRPC message out of a packet. what anyone on the internet sends is decoded within the size of
+// the packet, and to a small depth
+func ParseMsg(b []byte) (*Msg, error) {
+	var m Msg
+	d := formats.NewBencDecoder(bytes.NewReader(b))
+	d.SetLimits(formats.Limits{MaxDepth: 16, MaxStrLen: len(b), MaxSize: int64(len(b))})
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Error is the error of a KRPC error message, a list of the code and a message
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.Code, e.Msg)
+}
+
+func (e *Error) MarshalBenc() ([]byte, error) {
+	return formats.Marshall([]any{e.Code, e.Msg})
+}
+
+func (e *Error) UnmarshalBenc(b []byte) error {
+	var l []any
+	if err := formats.Unmarshall(b, &l); err != nil {
+		return err
+	}
+	if len(l) != 2 {
+		return fmt.Errorf("KRPC error should be a list of two, got %d items", len(l))
+	}
+	code, ok := l[0].(int64)
+	msg, ok2 := l[1].([]byte)
+	if !ok || !ok2 {
+		return fmt.Errorf("KRPC error should be a code and a message")
+	}
+	e.Code, e.Msg = int(code), string(msg)
+	return nil
+}
+
+// Node is a node of the DHT, as it is known from compact node info
+type Node struct {
+	ID   ID
+	Addr *net.UDPAddr
+}
+
+// compactNodes packs nodes into compact node info, ipv4 and ipv6 apart
+func compactNodes(nodes []Node) (string, string) {
+	var v4, v6 []byte
+	for _, n := range nodes {
+		addr := formats.CompactAddr{IP: n.Addr.IP, Port: uint16(n.Addr.Port)}.Marshall()
+		if len(addr) == 6 {
+			v4 = append(append(v4, n.ID[:]...), addr...)
+		} else {
+			v6 = append(append(v6, n.ID[:]...), addr...)
+		}
+	}
+	return string(v4), string(v6)
+}
+
+// parseNodes splits compact node info. ipLen is 4 for `nodes`, 16 for `nodes6`
+func parseNodes(s string, ipLen int) ([]Node, error) {
+	l := 20 + ipLen + 2
+	if len(s)%l != 0 {
+		return nil, fmt.Errorf("Compact node info should be a multiple of %d bytes long, got %d", l, len(s))
+	}
+	var nodes []Node
+	for i := 0; i < len(s); i += l {
+		var n Node
+		copy(n.ID[:], s[i:i+20])
+		addrs, err := formats.ParseCompactAddrs([]byte(s[i+20:i+l]), ipLen)
+		if err != nil {
+			return nil, err
+		}
+		if addrs[0].Port == 0 {
+			continue
+		}
+		n.Addr = &net.UDPAddr{IP: addrs[0].IP, Port: int(addrs[0].Port)}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// nodes gives all the nodes of a response
+func (r *Return) nodes() ([]Node, error) {
+	v4, err := parseNodes(r.Nodes, net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	v6, err := parseNodes(r.Nodes6, net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+	return append(v4, v6...), nil
+}
+
+// peers gives the peers of a get_peers response. malformed values are skipped
+func (r *Return) peers() []formats.CompactAddr {
+	var peers []formats.CompactAddr
+	for _, v := range r.Values {
+		var ipLen int
+		switch len(v) {
+		case 6:
+			ipLen = net.IPv4len
+		case 18:
+			ipLen = net.IPv6len
+		default:
+			continue
+		}
+		addrs, _ := formats.ParseCompactAddrs([]byte(v), ipLen)
+		peers = append(peers, addrs...)
+	}
+	return peers
+}
@@ -0,0 +1,148 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// K is the number of nodes in a bucket, and of the closest nodes a lookup settles on
+const K = 8
+
+// a node that answered within this time is good. one that did not is questionable, until it is pinged again
+const goodFor = 15 * time.Minute
+
+// a node that failed this many queries in a row is bad, and the first to go when its bucket is full
+const maxFailures = 2
+
+// entry is a node in the routing table, with what we know of its liveness
+type entry struct {
+	Node
+	lastSeen time.Time // the last time it answered a query of ours, or sent one
+	failures int       // queries it failed to answer since
+	pinging  bool      // whether it is pinged to decide whether a new node takes its place
+}
+
+func (e *entry) good() bool {
+	return e.failures == 0 && time.Since(e.lastSeen) < goodFor
+}
+
+func (e *entry) bad() bool {
+	return e.failures >= maxFailures
+}
+
+// table is the routing table: nodes bucketed by the number of leading bits their id shares with ours.
+// a bucket keeps its nodes from the least recently seen to the most
+type table struct {
+	self    ID
+	mu      sync.Mutex
+	buckets [160][]*entry
+}
+
+func newTable(self ID) *table {
+	return &table{self: self}
+}
+
+func (t *table) bucket(id ID) int {
+	i := t.self.prefixLen(id)
+	if i == 160 {
+		return -1
+	}
+	return i
+}
+
+// seen notes that a node is alive. it is added if its bucket has room, or a bad node to make room for.
+// if the bucket is full of nodes that are not bad, it gives the least recently seen one if that is questionable,
+// for the caller to ping it at the address given: should it fail, `replace` puts the new node in its place
+func (t *table) seen(n Node) (*entry, *net.UDPAddr) {
+	i := t.bucket(n.ID)
+	if i < 0 || n.Addr == nil {
+		return nil, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.buckets[i]
+	for j, e := range b {
+		if e.ID == n.ID {
+			e.Addr, e.lastSeen, e.failures, e.pinging = n.Addr, time.Now(), 0, false
+			t.buckets[i] = append(append(b[:j:j], b[j+1:]...), e)
+			return nil, nil
+		}
+	}
+	e := &entry{Node: n, lastSeen: time.Now()}
+	if len(b) < K {
+		t.buckets[i] = append(b, e)
+		return nil, nil
+	}
+	for j, old := range b {
+		if old.bad() {
+			t.buckets[i] = append(append(b[:j:j], b[j+1:]...), e)
+			return nil, nil
+		}
+	}
+	if !b[0].good() && !b[0].pinging {
+		b[0].pinging = true
+		return b[0], b[0].Addr
+	}
+	return nil, nil
+}
+
+// replace puts `n` in the place of `old`, if old is still in the table and failed since
+func (t *table) replace(old *entry, n Node) {
+	i := t.bucket(old.ID)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.buckets[i]
+	for j, e := range b {
+		if e == old && e.failures > 0 {
+			t.buckets[i] = append(append(b[:j:j], b[j+1:]...), &entry{Node: n, lastSeen: time.Now()})
+			return
+		}
+	}
+}
+
+// failed notes that a node did not answer a query
+func (t *table) failed(addr *net.UDPAddr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.buckets {
+		for _, e := range b {
+			if e.Addr.IP.Equal(addr.IP) && e.Addr.Port == addr.Port {
+				e.failures++
+			}
+		}
+	}
+}
+
+// closest gives up to `n` nodes of the table closest to the target, bad nodes left out
+func (t *table) closest(target ID, n int) []Node {
+	t.mu.Lock()
+	var nodes []Node
+	for _, b := range t.buckets {
+		for _, e := range b {
+			if !e.bad() {
+				nodes = append(nodes, e.Node)
+			}
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(nodes, func(i, j int) bool {
+		return target.closer(nodes[i].ID, nodes[j].ID)
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// len gives the number of nodes in the table
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b)
+	}
+	return n
+}
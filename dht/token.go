@@ -0,0 +1,65 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// tokens are given out with get_peers responses, and must come back with announce_peer from the same ip.
+// a token is the hash of the ip with a secret that changes every `secretLife`. tokens of the last secret still count,
+// so a token is good for 5 to 10 minutes
+const secretLife = 5 * time.Minute
+
+type tokens struct {
+	mu        sync.Mutex
+	secret    [20]byte
+	prev      [20]byte
+	changedAt time.Time
+}
+
+func newTokens() *tokens {
+	t := &tokens{changedAt: time.Now()}
+	rand.Read(t.secret[:])
+	t.prev = t.secret
+	return t
+}
+
+func (t *tokens) rotate() {
+	if time.Since(t.changedAt) < secretLife {
+		return
+	}
+	t.prev = t.secret
+	rand.Read(t.secret[:])
+	t.changedAt = time.Now()
+}
+
+func tokenFor(secret [20]byte, ip net.IP) string {
+	h := sha1.New()
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h.Write(ip)
+	h.Write(secret[:])
+	return string(h.Sum(nil))
+}
+
+// token gives the token of an ip
+func (t *tokens) token(ip net.IP) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return tokenFor(t.secret, ip)
+}
+
+// valid reports whether a token was given to the ip, with the current secret or the last
+func (t *tokens) valid(token string, ip net.IP) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return hmac.Equal([]byte(token), []byte(tokenFor(t.secret, ip))) ||
+		hmac.Equal([]byte(token), []byte(tokenFor(t.prev, ip)))
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// seedPieces starts a peer that has all of `data`, the content of the torrent `m`, and uploads it to those who
+// are interested. it supports no extensions. a `corrupt` seed flips a byte of every block it sends. a `choky` seed chokes once, dropping
+// the requests it did not answer, and unchokes again
+func seedPieces(t *testing.T, m formats.MetaInfo, data []byte, corrupt, choky bool) PeerAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	infoH, _ := m.GetInfoHash()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := ParseHandShake(conn); err != nil {
+					return
+				}
+				// a peer of no extensions, whose choke drops the requests
+				h := &Shaker{infoHash: infoH}
+				copy(h.peerId[:], "-seed-")
+				if _, err := io.Copy(conn, h.Marshall()); err != nil {
+					return
+				}
+				n := len(m.Info.PiecesHash)
+				bf := make(formats.Bitfield, (n+7)/8)
+				for i := 0; i < n; i++ {
+					bf.Set(i)
+				}
+				if err := (&formats.Msg{ID: formats.BitField, Len: 1 + len(bf), Payload: bf}).Marshall(conn); err != nil {
+					return
+				}
+				choked, sent := true, 0
+				for {
+					msg, err := formats.ReadMessage(conn)
+					if err != nil {
+						return
+					}
+					switch msg.ID {
+					case formats.Interested:
+						choked = false
+						if formats.NewUnchoke().Marshall(conn) != nil {
+							return
+						}
+					case formats.Request:
+						if choked {
+							continue
+						}
+						ibl, err := formats.ParseIbl(msg)
+						if err != nil {
+							return
+						}
+						start, _ := m.PieceBounds(ibl.Index)
+						block := append([]byte(nil), data[start+ibl.Begin:start+ibl.Begin+ibl.Length]...)
+						if corrupt {
+							block[0] ^= 0xff
+						}
+						p := formats.PieceMsg{Index: uint32(ibl.Index), Begin: uint32(ibl.Begin), Block: block}
+						if formats.NewPieceMMsg(p).Marshall(conn) != nil {
+							return
+						}
+						if sent++; choky && sent == 2 {
+							// the requests that come meanwhile are dropped with the choke
+							if formats.NewChoke().Marshall(conn) != nil {
+								return
+							}
+							conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+							for {
+								if _, err := formats.ReadMessage(conn); err != nil {
+									break
+								}
+							}
+							conn.SetReadDeadline(time.Time{})
+							if formats.NewUnchoke().Marshall(conn) != nil {
+								return
+							}
+						}
+					}
+				}
+			}()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return PeerAddr{addr.IP, uint16(addr.Port)}
+}
+
+// seedMeta makes the torrent of `data`, hashing its pieces
+func seedMeta(t *testing.T, info formats.InfoDict, data []byte) formats.MetaInfo {
+	for i := 0; i < len(data); i += info.PieceLen {
+		end := i + info.PieceLen
+		if end > len(data) {
+			end = len(data)
+		}
+		info.PiecesHash = append(info.PiecesHash, sha1.Sum(data[i:end]))
+	}
+	raw, err := formats.Marshall(info)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	return formats.MetaInfo{Info: info, RawInfo: raw}
+}
+
+func TestStartDownload(t *testing.T) {
+	Init()
+	// the last piece is shorter than the others, and ends with a short block
+	data := make([]byte, 5*formats.BLOCK_LEN+100)
+	rand.Read(data)
+	m := seedMeta(t, formats.InfoDict{Name: "data.bin", PieceLen: 2 * formats.BLOCK_LEN, Length: len(data)}, data)
+	infoH, _ := m.GetInfoHash()
+
+	download := func(peers ...PeerAddr) (*Torrent, error) {
+		torr := &Torrent{InfoH: infoH, mInfo: m, size: len(data), fPath: t.TempDir(), peers: peers}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return torr, torr.Start(ctx)
+	}
+	check := func(torr *Torrent) {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join(torr.fPath, "data.bin"))
+		if err != nil || !bytes.Equal(b, data) {
+			t.Errorf("Wrong content written: %v", err)
+		}
+		select {
+		case <-torr.completed():
+		default:
+			t.Errorf("Torrent should be complete")
+		}
+	}
+
+	torr, err := download(seedPieces(t, m, data, false, false))
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	check(torr)
+	if torr.downloaded.Load() != int64(len(data)) {
+		t.Errorf("Expected %d bytes downloaded, got %d", len(data), torr.downloaded.Load())
+	}
+
+	// the requests a choke drops are sent again
+	torr, err = download(seedPieces(t, m, data, false, true))
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	check(torr)
+
+	// peers share the pieces, and the end game has both asked for the last blocks
+	torr, err = download(seedPieces(t, m, data, false, false), seedPieces(t, m, data, false, true))
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	check(torr)
+
+	// the pieces of a peer sending bad data, or none at all, are downloaded from the others
+	torr, err = download(seedPieces(t, m, data, true, false), PeerAddr{net.IPv4(127, 0, 0, 1), 1}, seedPieces(t, m, data, false, false))
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	check(torr)
+
+	if _, err := download(seedPieces(t, m, data, true, false)); err == nil {
+		t.Errorf("Should fail with no peer sending good pieces")
+	}
+}
+
+// silentPeer starts a peer that takes connections and never answers
+func silentPeer(t *testing.T) PeerAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return PeerAddr{addr.IP, uint16(addr.Port)}
+}
+
+func TestStartNewPeers(t *testing.T) {
+	Init()
+	data := make([]byte, 4*formats.BLOCK_LEN)
+	rand.Read(data)
+	m := seedMeta(t, formats.InfoDict{Name: "data.bin", PieceLen: 2 * formats.BLOCK_LEN, Length: len(data)}, data)
+	infoH, _ := m.GetInfoHash()
+
+	// the only peer known at first has nothing to give. the seed comes later, as from PEX
+	torr := &Torrent{InfoH: infoH, mInfo: m, size: len(data), fPath: t.TempDir(), peers: []PeerAddr{silentPeer(t)}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- torr.Start(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	torr.addPeers([]PeerAddr{seedPieces(t, m, data, false, false)})
+	if err := <-errc; err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(torr.fPath, "data.bin")); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("Wrong content written: %v", err)
+	}
+}
+
+func TestStartSelected(t *testing.T) {
+	Init()
+	// pieces of two blocks. the skipped file spans pieces 0 to 2
+	data := make([]byte, 8*formats.BLOCK_LEN)
+	rand.Read(data)
+	m := seedMeta(t, formats.InfoDict{Name: "dir", PieceLen: 2 * formats.BLOCK_LEN, Files: []formats.Info{
+		{Length: formats.BLOCK_LEN, Path: []string{"a"}},
+		{Length: 4 * formats.BLOCK_LEN, Path: []string{"b"}},
+		{Length: 3 * formats.BLOCK_LEN, Path: []string{"c"}},
+	}}, data)
+	infoH, _ := m.GetInfoHash()
+
+	torr := &Torrent{InfoH: infoH, mInfo: m, size: len(data), fPath: t.TempDir(), peers: []PeerAddr{seedPieces(t, m, data, false, false)}}
+	prio, err := SelectFiles(m, []string{"a", "c=high"})
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := torr.SetFilePriorities(prio); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := torr.Start(ctx); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+
+	for p, content := range map[string][]byte{"a": data[:formats.BLOCK_LEN], "c": data[5*formats.BLOCK_LEN:]} {
+		b, err := os.ReadFile(filepath.Join(torr.fPath, "dir", p))
+		if err != nil || !bytes.Equal(b, content) {
+			t.Errorf("Wrong content written to %s: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(torr.fPath, "dir", "b")); !os.IsNotExist(err) {
+		t.Errorf("Skipped file should not be created: %v", err)
+	}
+	// the pieces 0 and 2 are those of a and c, piece 1 is b's alone
+	if torr.have.Has(1) || !torr.have.Has(0) || !torr.have.Has(2) || !torr.have.Has(3) {
+		t.Errorf("Wrong pieces downloaded: %08b", torr.have)
+	}
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
 )
 
 type driver struct {
@@ -20,17 +29,55 @@ func newDriver() *driver {
 }
 
 func (d *driver) Drive() error {
-	if len(os.Args) < 2 {
-		str := `odor expects two or three arguments: 
-				1: the path to the torrent file, 
-				2: the path where you wuld have the downloaded file(s) saved (optional)`
+	// the peer id of our handshakes and the key of our announces
+	Init()
+	if len(os.Args) >= 2 && os.Args[1] == "create" {
+		return d.create(os.Args[2:])
+	}
+	flags := flag.NewFlagSet("odor", flag.ContinueOnError)
+	trust := flags.String("trust", "", "directory of the keys (<signer>.pem) and certificates of trusted torrent signers")
+	require := flags.Bool("require-signed", false, "refuse torrents without a valid signature of a trusted signer, instead of warning")
+	stream := flags.Bool("stream", false, "download the pieces in order, for the content to be read as it comes")
+	var selected selections
+	flags.Var(&selected, "select", "file to download, by index or glob of its path, with a priority: 3, '*.iso' or 'docs/*=low'. "+
+		"repeat for more files. the others are skipped. priorities are skip, low, normal and high")
+	flags.IntVar(&minQueue, "min-queue", minQueue, "block requests kept going with a peer at first, and at least")
+	flags.IntVar(&maxQueue, "max-queue", maxQueue, "most block requests kept going with a peer. the same as -min-queue for a fixed queue")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	args := flags.Args()
+	if len(args) < 1 {
+		str := `odor expects one or two arguments: 
+				1: the path to the torrent file, or a magnet link
+				2: the path where you wuld have the downloaded file(s) saved (optional)
+			flags: [-trust dir] [-require-signed] [-min-queue n] [-max-queue n] [-select file[=priority]]... [-stream]
+			or, to make a torrent: odor create [-a tracker] [-o out.torrent] [-key key.pem [-cert cert.pem]] <path>`
 		d.Printf("%s\n", str)
 		return fmt.Errorf(str)
 	}
+	if minQueue < 1 || maxQueue < minQueue {
+		s := "-max-queue must be at least -min-queue, which must be at least 1"
+		d.Println(s)
+		return fmt.Errorf(s)
+	}
+	if *require && *trust == "" {
+		s := "-require-signed needs a trust store: -trust dir"
+		d.Println(s)
+		return fmt.Errorf(s)
+	}
+	if *trust != "" {
+		ts, err := formats.LoadTrustStore(*trust)
+		if err != nil {
+			d.Printf("%s\n", err.Error())
+			return err
+		}
+		trustStore, requireSigned = ts, *require
+	}
 	var torrPath, fPath string
-	torrPath = os.Args[1]
-	if len(os.Args) == 3 {
-		fPath = os.Args[2]
+	torrPath = args[0]
+	if len(args) == 2 {
+		fPath = args[1]
 	} else {
 		path, exists := os.LookupEnv("HOME")
 		if !exists {
@@ -42,14 +89,56 @@ func (d *driver) Drive() error {
 		if err := os.MkdirAll(path, 0700); err != nil {
 			return err
 		}
+		fPath = path
 
 	}
-	ctx := context.TODO()
-	t, err := NewTorrent(ctx, torrPath, fPath)
+	// an interrupt ends the download, and the trackers are told we stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	// the DHT finds peers when the trackers don't. we go on without it if it cannot be joined
+	if node, err := StartDHT(ctx); err != nil {
+		d.Printf("Could not join the DHT: %s\n", err)
+	} else {
+		defer node.Close()
+	}
+	if l, err := StartLSD(); err != nil {
+		d.Printf("Could not start local service discovery: %s\n", err)
+	} else {
+		defer l.Close()
+	}
+	var t *Torrent
+	var err error
+	if strings.HasPrefix(torrPath, "magnet:") {
+		t, err = NewMagnetTorrent(ctx, torrPath, fPath)
+	} else {
+		t, err = NewTorrent(ctx, torrPath, fPath)
+	}
 	if err != nil {
 		d.Printf("%s\n", err.Error())
 		return err
 	}
+	for _, st := range t.Trackers().Status() {
+		d.Println(st)
+	}
+	if len(selected) > 0 {
+		// the files are known once we have the info dict
+		if err := t.FetchMetaInfo(ctx); err != nil {
+			d.Printf("%s\n", err.Error())
+			return err
+		}
+		prio, err := SelectFiles(t.mInfo, selected)
+		if err != nil {
+			d.Printf("%s\n", err.Error())
+			return err
+		}
+		if err := t.SetFilePriorities(prio); err != nil {
+			return err
+		}
+		for i, f := range t.mInfo.FileList() {
+			d.Printf("%d: %s (%d bytes): %s\n", i, filePathName(f), f.Length, prio[i])
+		}
+	}
+	t.SetStreaming(*stream)
 	d.Println("Torrent download begins...")
 	if err := t.Start(ctx); err != nil {
 		d.Printf("%s\n", err.Error())
@@ -58,3 +147,141 @@ func (d *driver) Drive() error {
 	d.Printf("Torrent %s save in directory: %s", t.name, t.fPath)
 	return nil
 }
+
+// selections collects the `-select` flags of a download
+type selections []string
+
+func (s *selections) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *selections) Set(sel string) error {
+	*s = append(*s, sel)
+	return nil
+}
+
+// tiers collects the `-a` flags of the create command. each flag is a tier, its urls separated by commas
+type tiers [][]string
+
+func (t *tiers) String() string {
+	return fmt.Sprint(*t)
+}
+
+func (t *tiers) Set(s string) error {
+	*t = append(*t, strings.Split(s, ","))
+	return nil
+}
+
+// create makes a .torrent file out of a file or directory:
+// odor create [-a tracker,...]... [-o out.torrent] [-c comment] [-l piece length] [-private] [-key key.pem [-cert cert.pem] [-signer name]] <path>
+func (d *driver) create(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	var announce tiers
+	flags.Var(&announce, "a", "tracker url. repeat for more tiers, separate urls of the same tier with commas")
+	out := flags.String("o", "", "where to write the torrent. <name>.torrent if not given")
+	comment := flags.String("c", "", "comment")
+	pieceLen := flags.Int("l", 0, "piece length in bytes. chosen from the size of the content if not given")
+	private := flags.Bool("private", false, "only get peers from the trackers")
+	keyPath := flags.String("key", "", "PEM ed25519 private key to sign the torrent with")
+	certPath := flags.String("cert", "", "PEM certificate of the signing key, put in the torrent")
+	signer := flags.String("signer", "", "name of the signer. the common name of the certificate, or the name of the key file if not given")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		s := "odor create expects the path of the file or directory to make a torrent of"
+		d.Println(s)
+		return fmt.Errorf(s)
+	}
+
+	b := formats.NewBuilder(flags.Arg(0))
+	b.Comment = *comment
+	b.CreatedBy = "odor"
+	b.PieceLen = *pieceLen
+	b.Private = *private
+	if len(announce) > 0 {
+		b.Announce = announce[0][0]
+		if len(announce) > 1 || len(announce[0]) > 1 {
+			b.AnnounceList = announce
+		}
+	}
+	m, err := b.Build()
+	if err != nil {
+		d.Printf("%s\n", err.Error())
+		return err
+	}
+	if *keyPath != "" {
+		if err := sign(m, *keyPath, *certPath, *signer); err != nil {
+			d.Printf("%s\n", err.Error())
+			return err
+		}
+	}
+	torr, err := formats.Marshall(m)
+	if err != nil {
+		return err
+	}
+	// what we publish must be canonical, else other clients may compute a different infohash
+	if err := formats.Validate(bytes.NewReader(torr)); err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = m.Info.Name + ".torrent"
+	}
+	if err := os.WriteFile(*out, torr, 0644); err != nil {
+		d.Printf("%s\n", err.Error())
+		return err
+	}
+	infoHash, err := m.GetInfoHash()
+	if err != nil {
+		return err
+	}
+	d.Printf("Torrent %s written to %s. infohash: %x", m.Info.Name, *out, infoHash)
+	return nil
+}
+
+// sign signs the torrent with the key at `keyPath`, and puts along the certificate at `certPath` if given
+func sign(m *formats.MetaInfo, keyPath, certPath, signer string) error {
+	block, err := readPEM(keyPath, "PRIVATE KEY")
+	if err != nil {
+		return err
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("%s: only ed25519 keys are supported", keyPath)
+	}
+	var cert *x509.Certificate
+	if certPath != "" {
+		block, err := readPEM(certPath, "CERTIFICATE")
+		if err != nil {
+			return err
+		}
+		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return err
+		}
+	} else if signer == "" {
+		signer = strings.TrimSuffix(filepath.Base(keyPath), filepath.Ext(keyPath))
+	}
+	return m.Sign(signer, key, cert)
+}
+
+// readPEM gives the first block of type `typ` in a PEM file
+func readPEM(path, typ string) (*pem.Block, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("No %s in %s", typ, path)
+		}
+		if block.Type == typ {
+			return block, nil
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// extension protocol: https://www.bittorrent.org/beps/bep_0010.html
+
+// CLIENT_VERSION is how we name ourselves in the extended handshake
+const CLIENT_VERSION = "odor 0.1"
+
+// MAX_REQQ is the number of outstanding requests we take from a peer
+const MAX_REQQ = 250
+
+// Extension rides on the extension protocol. It is registered on a PeerConn by name, and given the messages
+// the peer sends with the extended message id we gave it
+type Extension interface {
+	// Handshake is called when the extended handshake of a peer that supports the extension comes in
+	Handshake(c *PeerConn, h formats.ExtHandshake) error
+	// HandleMsg handles the payload of a message of the extension
+	HandleMsg(c *PeerConn, payload []byte) error
+}
+
+// extensions are those registered on a connection, and what the peer told of its own.
+// the extended message id we give an extension is its index in `names` + 1
+type extensions struct {
+	names  []string
+	exts   map[string]Extension
+	sent   bool                 // whether our extended handshake was sent. no extension can be registered after
+	shaken bool                 // whether the extended handshake of the peer came in
+	peer   formats.ExtHandshake // the extended handshake of the peer
+	ids    map[string]uint8     // extension names to the extended message ids the peer wants them sent with
+}
+
+// RegisterExt registers an extension, to be offered to the peer in our extended handshake
+func (c *PeerConn) RegisterExt(name string, e Extension) error {
+	if c.ext.sent {
+		return fmt.Errorf("Cannot register %s after the extended handshake was sent", name)
+	}
+	if _, ok := c.ext.exts[name]; ok {
+		return fmt.Errorf("Extension %s is already registered", name)
+	}
+	if len(c.ext.names) == 255 {
+		return fmt.Errorf("Too many extensions")
+	}
+	if c.ext.exts == nil {
+		c.ext.exts = map[string]Extension{}
+	}
+	c.ext.names = append(c.ext.names, name)
+	c.ext.exts[name] = e
+	return nil
+}
+
+// supports reports whether we and the peer both set a reserved bit in our handshakes
+func (c *PeerConn) supports(bit int) bool {
+	return c.shaker != nil && c.peerShaker != nil && c.shaker.HasBit(bit) && c.peerShaker.HasBit(bit)
+}
+
+// PeerSupportsExt reports whether the peer gave the extension an id in its extended handshake
+func (c *PeerConn) PeerSupportsExt(name string) bool {
+	_, ok := c.ext.ids[name]
+	return ok
+}
+
+// SendExtHandshake sends our extended handshake, with the extensions registered on the connection
+func (c *PeerConn) SendExtHandshake() error {
+	h := formats.ExtHandshake{M: map[string]int{}, V: CLIENT_VERSION, Reqq: MAX_REQQ}
+	for i, name := range c.ext.names {
+		h.M[name] = i + 1
+	}
+	if _, ok := c.ext.exts[formats.UT_METADATA]; ok && c.torrent != nil {
+		h.MetadataSize = len(c.torrent.metadata())
+	}
+	if ip := c.addr.ipv4.To4(); ip != nil {
+		h.YourIP = ip
+	} else if ip := c.addr.ipv4.To16(); ip != nil {
+		h.YourIP = ip
+	}
+	msg, err := formats.NewExtHandshake(h)
+	if err != nil {
+		return err
+	}
+	c.ext.sent = true
+	return msg.Marshall(c.conn)
+}
+
+// mergeExtHandshake updates the extended handshake of a peer with a later one. fields the later one leaves out are kept
+func mergeExtHandshake(old, h formats.ExtHandshake) formats.ExtHandshake {
+	m := map[string]int{}
+	for name, id := range old.M {
+		m[name] = id
+	}
+	for name, id := range h.M {
+		if id == 0 { // 0 disables the extension
+			delete(m, name)
+		} else {
+			m[name] = id
+		}
+	}
+	h.M = m
+	if h.V == "" {
+		h.V = old.V
+	}
+	if h.P == 0 {
+		h.P = old.P
+	}
+	if h.Reqq == 0 {
+		h.Reqq = old.Reqq
+	}
+	if h.YourIP == nil {
+		h.YourIP = old.YourIP
+	}
+	if h.MetadataSize == 0 {
+		h.MetadataSize = old.MetadataSize
+	}
+	return h
+}
+
+// sendExtended sends the payload of an extension message, with the extended message id the peer gave the extension
+func (c *PeerConn) sendExtended(name string, payload []byte) error {
+	id, ok := c.ext.ids[name]
+	if !ok {
+		return fmt.Errorf("Peer %s does not support %s", c.addr, name)
+	}
+	return formats.NewExtended(id, payload).Marshall(c.conn)
+}
+
+// handleExtended takes in the extended handshake of the peer, or dispatches a message to its extension
+func (c *PeerConn) handleExtended(msg *formats.Msg) error {
+	id, payload, err := formats.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+	if id == formats.ExtHandshakeId {
+		// the handshake may be sent again, to update what it said
+		h, err := formats.ParseExtHandshake(payload)
+		if err != nil {
+			return err
+		}
+		// a later one may carry only what changed. the extensions it leaves out stay as they were
+		h = mergeExtHandshake(c.ext.peer, h)
+		c.ext.ids = map[string]uint8{}
+		for name, id := range h.M {
+			if id > 0 && id < 256 {
+				c.ext.ids[name] = uint8(id)
+			}
+		}
+		c.ext.peer = h
+		c.ext.shaken = true
+		for _, name := range c.ext.names {
+			if !c.PeerSupportsExt(name) {
+				continue
+			}
+			if err := c.ext.exts[name].Handshake(c, h); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if int(id) > len(c.ext.names) { // not an id we gave out
+		return nil
+	}
+	return c.ext.exts[c.ext.names[id-1]].HandleMsg(c, payload)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// echoExt records what it is given
+type echoExt struct {
+	shaken bool
+	msgs   []string
+}
+
+func (e *echoExt) Handshake(c *PeerConn, h formats.ExtHandshake) error {
+	e.shaken = true
+	return nil
+}
+
+func (e *echoExt) HandleMsg(c *PeerConn, payload []byte) error {
+	e.msgs = append(e.msgs, string(payload))
+	return nil
+}
+
+// connPair connects two PeerConns over loopback tcp
+func connPair(t *testing.T) (*PeerConn, *PeerConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	other := <-accepted
+	t.Cleanup(func() { conn.Close(); other.Close() })
+	// the address of a connection is that of the peer
+	a := &PeerConn{conn: conn, addr: PeerAddr{net.IPv4(127, 0, 0, 2), 2}}
+	b := &PeerConn{conn: other, addr: PeerAddr{net.IPv4(127, 0, 0, 1), 1}}
+	return a, b
+}
+
+// shakePair does the handshake between two connections
+func shakePair(t *testing.T, a, b *PeerConn) {
+	var infoH formats.Sha1
+	var idA, idB [20]byte
+	idA[0], idB[0] = 'a', 'b'
+	errc := make(chan error)
+	go func() { errc <- b.Shake(NewShaker(infoH, idB)) }()
+	if err := a.Shake(NewShaker(infoH, idA)); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	a, b := connPair(t)
+	shakePair(t, a, b)
+	if !a.supports(extBit) || a.supports(dhtBit) {
+		t.Errorf("Wrong reserved bits: % x", a.peerShaker.reserved)
+	}
+
+	extA, extB := &echoExt{}, &echoExt{}
+	a.RegisterExt("ut_metadata", &utMetadata{})
+	a.RegisterExt("ut_echo", extA)
+	b.RegisterExt("ut_echo", extB)
+	if err := b.RegisterExt("ut_echo", extB); err == nil {
+		t.Errorf("Should not register an extension twice")
+	}
+	if err := a.SendExtHandshake(); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := b.SendExtHandshake(); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := b.RegisterExt("ut_late", &echoExt{}); err == nil {
+		t.Errorf("Should not register an extension after the extended handshake")
+	}
+	if err := b.readMsg(time.Second); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := a.readMsg(time.Second); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	h := b.ext.peer
+	if h.V != CLIENT_VERSION || h.Reqq != MAX_REQQ || h.M["ut_echo"] != 2 || !h.YourIPAddr().Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Errorf("Wrong extended handshake: %+v", h)
+	}
+	if !extA.shaken || !extB.shaken || !a.PeerSupportsExt("ut_echo") || a.PeerSupportsExt("ut_metadata") {
+		t.Errorf("Extensions not given the handshake")
+	}
+
+	// b gave ut_echo the id 1, a gave it 2
+	if err := a.sendExtended("ut_echo", []byte("to b")); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := b.sendExtended("ut_echo", []byte("to a")); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := a.sendExtended("ut_metadata", nil); err == nil {
+		t.Errorf("Should not send an extension the peer does not support")
+	}
+	if err := b.readMsg(time.Second); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := a.readMsg(time.Second); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if len(extB.msgs) != 1 || extB.msgs[0] != "to b" || len(extA.msgs) != 1 || extA.msgs[0] != "to a" {
+		t.Errorf("Wrong messages: %v %v", extA.msgs, extB.msgs)
+	}
+}
+
+func TestExtHandshakeUpdate(t *testing.T) {
+	a, b := connPair(t)
+	echo := &echoExt{}
+	b.RegisterExt("ut_echo", echo)
+	for _, h := range []formats.ExtHandshake{
+		{M: map[string]int{"ut_echo": 1, "ut_metadata": 2}, Reqq: 100, MetadataSize: 5000},
+		// only what changed: ut_metadata is disabled, ut_pex added
+		{M: map[string]int{"ut_metadata": 0, "ut_pex": 5}},
+	} {
+		msg, err := formats.NewExtHandshake(h)
+		if err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+		if err := msg.Marshall(a.conn); err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+		if err := b.readMsg(time.Second); err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+	}
+	if !b.PeerSupportsExt("ut_echo") || b.PeerSupportsExt("ut_metadata") || b.ext.ids["ut_pex"] != 5 || len(b.ext.ids) != 2 {
+		t.Errorf("Wrong extension ids: %v", b.ext.ids)
+	}
+	if p := b.ext.peer; p.Reqq != 100 || p.MetadataSize != 5000 || p.M["ut_echo"] != 1 || len(p.M) != 2 {
+		t.Errorf("Handshake not merged: %+v", p)
+	}
+	if !echo.shaken {
+		t.Errorf("Extension not given the handshake")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+func TestFastExtension(t *testing.T) {
+	a, b := connPair(t)
+	shakePair(t, a, b)
+	if !a.supports(fastBit) || !b.supports(fastBit) {
+		t.Fatalf("Fast extension not negotiated")
+	}
+	torr := &Torrent{}
+	torr.mInfo.RawInfo = formats.RawMessage("d4:name1:xe")
+	torr.mInfo.Info.PiecesHash = make([]formats.Sha1, 10)
+	torr.mInfo.Info.PieceLen = formats.BLOCK_LEN * 2
+	torr.mInfo.Info.Length = formats.BLOCK_LEN * 20
+	a.torrent = torr
+
+	// a seed that says Have All instead of sending its bitfield
+	formats.NewHaveAll().Marshall(b.conn)
+	if err := a.ReqBitFields(); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if !a.HasPiece(9) || !a.seed.Load() {
+		t.Errorf("Have All not taken in")
+	}
+	if a.HasPiece(10) || a.b[1] != 0xc0 {
+		t.Errorf("Spare bits of Have All should be clear: % x", a.b)
+	}
+
+	// choked, only the allowed fast pieces can be requested
+	formats.NewAllowedFast(4).Marshall(b.conn)
+	if err := a.readMsg(time.Second); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if !a.CanRequest(4) || a.CanRequest(5) {
+		t.Errorf("Wrong allowed fast set: %v", a.allowedFast)
+	}
+
+	// the picker gives a block of the allowed fast piece
+	pk := NewPicker(torr.mInfo)
+	pk.addPeer(a)
+	blocks, err := pk.next(a, 1)
+	if err != nil || len(blocks) != 1 || blocks[0].Index != 4 {
+		t.Fatalf("Expected a block of piece 4, got %v: %v", blocks, err)
+	}
+	ibl := blocks[0]
+	if err := a.RequestBlock(context.Background(), ibl.Index, ibl.Begin, ibl.Length); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	// with the fast extension, a choke leaves the requests be
+	formats.NewChoke().Marshall(b.conn)
+	if err := a.readMsg(time.Second); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if len(a.Requeued()) != 0 || !a.pending[ibl] {
+		t.Errorf("Choke should not drop requests with the fast extension")
+	}
+	// b, who does not upload, rejects the request
+	if err := b.readMsg(time.Second); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := a.readMsg(time.Second); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if a.pending[ibl] {
+		t.Errorf("Rejected request still pending")
+	}
+
+	// the rejected block goes back to the picker, as the download loop does, to be requested again
+	requeued := a.Requeued()
+	if len(requeued) != 1 || requeued[0] != ibl {
+		t.Fatalf("Expected %v requeued, got %v", ibl, requeued)
+	}
+	pk.dropped(a, ibl)
+	if !pk.pieces.needed(ibl) {
+		t.Errorf("Rejected block not needed again")
+	}
+	if blocks, _ := pk.next(a, 2); len(blocks) != 2 || (blocks[0] != ibl && blocks[1] != ibl) {
+		t.Errorf("Rejected block not picked again: %v", blocks)
+	}
+
+	// a reject of a block never requested is a protocol error
+	formats.NewReject(ibl).Marshall(b.conn)
+	if err := a.readMsg(time.Second); err == nil {
+		t.Errorf("Should not take a reject of a block not requested")
+	}
+}
+
+func TestReqBitFieldsWithoutFast(t *testing.T) {
+	a, b := connPair(t)
+	a.torrent = &Torrent{}
+	a.torrent.mInfo.Info.PiecesHash = make([]formats.Sha1, 10)
+	// no handshakes: the fast extension is not negotiated, and a peer with no pieces goes straight to Have
+	formats.NewHave(3).Marshall(b.conn)
+	if err := a.ReqBitFields(); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if !a.HasPiece(3) || a.HasPiece(2) {
+		t.Errorf("Wrong bitfield: % x", a.b)
+	}
+	formats.NewHaveAll().Marshall(b.conn)
+	if err := a.readMsg(time.Second); err == nil {
+		t.Errorf("Should not take Have All without the fast extension")
+	}
+}
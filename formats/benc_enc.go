@@ -1,13 +1,15 @@
 package formats
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
 	"strconv"
+	"time"
 )
 
-
 type BencEncoder struct {
 	wtr io.Writer
 }
@@ -18,88 +20,224 @@ func NewBencoder(wtr io.Writer) *BencEncoder {
 	}
 }
 
-// Bencoder expcets to be fed structs, it encodes it into a writer stream
-//comeback: is it necessary to restrict it to structs
+// Encode writes the bencoding of `v` into the writer stream.
+// structs are encoded as dictionaries, keyed by their `benc` tags, e.g. `benc:"piece length"` or `benc:"comment,omitempty"`.
+// dictionary keys are always written in sorted order, as the spec demands.
+// nothing is written if the value cannot be encoded
 func (b *BencEncoder) Encode(v any) error {
-	val := reflect.ValueOf(v).Elem() // this allows us to be able to take both structs and pointer to structs
-	if val.Kind() != reflect.Struct {
-		return fmt.Errorf("W expect to encode structs")
+	var buf bytes.Buffer
+	if err := marshall(reflect.ValueOf(v), &buf); err != nil {
+		return err
+	}
+	_, err := b.wtr.Write(buf.Bytes())
+	return err
+}
+
+// Marshall returns the bencoding of `v`. see `Encode`
+func Marshall(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewBencoder(&buf).Encode(v); err != nil {
+		return nil, err
 	}
-	return marshall(val, b.wtr)
+	return buf.Bytes(), nil
 }
 
+func writeStr(w *bytes.Buffer, b []byte) {
+	w.WriteString(strconv.Itoa(len(b)))
+	w.WriteByte(':')
+	w.Write(b)
+}
 
-// marshall is a subroutine used by `Encode` to do the actual marshalling of 
-func marshall(v reflect.Value, w io.Writer) error {
-	switch v.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64: {
-		fmt.Fprintf(w, "i%de", v.Int())
+func writeInt(w *bytes.Buffer, i int64) {
+	w.WriteByte('i')
+	w.WriteString(strconv.FormatInt(i, 10))
+	w.WriteByte('e')
+}
+
+// marshall is a subroutine used by `Encode` to do the actual marshalling of each value
+func marshall(v reflect.Value, w *bytes.Buffer) error {
+	if !v.IsValid() {
+		return fmt.Errorf("Cannot encode nil")
+	}
+	if v.Kind() == reflect.Pointer && v.IsNil() {
+		return fmt.Errorf("Cannot encode nil %s", v.Type())
+	}
+	if m, ok := marshaler(v); ok {
+		b, err := m.MarshalBenc()
+		if err != nil {
+			return err
+		}
+		// make sure it is exactly one value, else the whole output is corrupt
+		in := NewBencInput(bytes.NewReader(b))
+		if res := BencValue()(in); res.Err != nil || !in.Empty() {
+			return fmt.Errorf("%s.MarshalBenc returned invalid bencode: %q", v.Type(), b)
+		}
+		w.Write(b)
+		return nil
 	}
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64: {
-		fmt.Fprintf(w, "i%de", v.Uint())
-	} 
-	case reflect.String: {
-		s := v.String()
-		io.WriteString(w, (strconv.FormatInt(int64(len(s)), 10)))
-		if s != "" {
-			io.WriteString(w, fmt.Sprintf(":%s", s))
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("Cannot encode empty RawMessage")
+		}
+		w.Write(v.Bytes())
+		return nil
+	}
+	if v.Type() == timeType { // time is encoded as seconds since the unix epoch. e.g. `creation date`
+		t := v.Interface().(time.Time)
+		writeInt(w, t.Unix())
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("Cannot encode nil %s", v.Type())
+		}
+		return marshall(v.Elem(), w)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeInt(w, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		w.WriteByte('i')
+		w.WriteString(strconv.FormatUint(v.Uint(), 10))
+		w.WriteByte('e')
+	case reflect.Bool:
+		if v.Bool() {
+			writeInt(w, 1)
 		} else {
-			io.WriteString(w, ":")
+			writeInt(w, 0)
+		}
+	case reflect.String:
+		writeStr(w, []byte(v.String()))
+	case reflect.Slice, reflect.Array:
+		elem := v.Type().Elem()
+		if elem.Kind() == reflect.Uint8 { // byte slices and arrays (e.g. `Sha1`) are byte strings
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			writeStr(w, b)
+			return nil
 		}
-	} 
-	case reflect.Slice: {
-		io.WriteString(w, "l")
+		// a slice of hashes is written as their concatenation, e.g. `pieces` in the info dict
+		if v.Kind() == reflect.Slice && elem.Kind() == reflect.Array && elem.Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, 0, v.Len()*elem.Len())
+			for i := 0; i < v.Len(); i++ {
+				h := make([]byte, elem.Len())
+				reflect.Copy(reflect.ValueOf(h), v.Index(i))
+				b = append(b, h...)
+			}
+			writeStr(w, b)
+			return nil
+		}
+		w.WriteByte('l')
 		for i := 0; i < v.Len(); i++ {
 			if err := marshall(v.Index(i), w); err != nil {
-					return err
+				return err
 			}
 		}
-		// old way i tried
-		// if slInt, ok := v.Interface().([]int); ok {
-		// 	for _, i := range slInt {
-		// 		if err := marshall(reflect.ValueOf(i), w); err != nil {
-		// 			return err
-		// 		}
-		// 	}
-		// } 
-		io.WriteString(w, "e ")
-
-	}
-	case reflect.Map: {
-		io.WriteString(w, "d")
-		// first check if the first key is a string
-		for _, key := range v.MapKeys() {
-			value := v.MapIndex(key)
+		w.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("Dictionary keys must be strings, not %s", v.Type().Key())
+		}
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		w.WriteByte('d')
+		for _, k := range keys {
+			value := v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))
+			if isNil(value) {
+				continue
+			}
+			writeStr(w, []byte(k))
 			if err := marshall(value, w); err != nil {
-					return err
+				return err
 			}
 		}
-		io.WriteString(w, "e")
-	}
-	case reflect.Struct: { // bencode does not recognize structs, we only range through the fields
-		num := v.NumField()
-		for i := 0; i < num; i++ {
-			f := v.Field(i)
-			switch f.Kind() { // only our supported types are allowed here
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.String, reflect.Slice, reflect.Map: {
-				if err := marshall(f, w); err != nil {
-					return err
-				}
+		w.WriteByte('e')
+	case reflect.Struct: // bencode does not recognize structs, they are written as dictionaries
+		type field struct {
+			key string
+			val reflect.Value
+		}
+		fields := []field{}
+		seen := make(map[string]int) // index in `fields` of each key
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if !f.IsExported() {
+				continue
 			}
-			case reflect.Struct: {
-				if err := marshall(f, w); err != nil {
-					return err
-				}
+			name, omitempty := bencTag(f)
+			if name == "" {
+				continue
+			}
+			fv := v.Field(i)
+			if isNil(fv) || (omitempty && isEmpty(fv)) {
+				continue
 			}
-			default: {
-				return fmt.Errorf("Unsupported type!")				
+			if j, ok := seen[name]; ok { // a non-empty RawMessage wins over any other field with the same key
+				prev := fields[j].val
+				if (fv.Type() == rawMessageType && fv.Len() > 0) || (prev.Type() == rawMessageType && prev.Len() == 0) {
+					fields[j].val = fv
+				}
+				continue
 			}
+			seen[name] = len(fields)
+			fields = append(fields, field{name, fv})
+		}
+		sort.Slice(fields, func(i, j int) bool { return fields[i].key < fields[j].key })
+		w.WriteByte('d')
+		for _, f := range fields {
+			writeStr(w, []byte(f.key))
+			if err := marshall(f.val, w); err != nil {
+				return fmt.Errorf("%s: %w", f.key, err)
 			}
 		}
-	} 
-	default: {
-		return fmt.Errorf("Unsupported type!")
-	}
+		w.WriteByte('e')
+	default:
+		return fmt.Errorf("Unsupported type: %s", v.Type())
 	}
 	return nil
 }
+
+// marshaler returns the `BencMarshaler` implemented by `v` or by a pointer to it, if any
+func marshaler(v reflect.Value) (BencMarshaler, bool) {
+	if v.Kind() == reflect.Interface { // it is the dynamic value that may be a marshaler
+		return nil, false
+	}
+	if v.Type().Implements(marshalerType) {
+		return v.Interface().(BencMarshaler), true
+	}
+	if v.CanAddr() && reflect.PointerTo(v.Type()).Implements(marshalerType) {
+		return v.Addr().Interface().(BencMarshaler), true
+	}
+	return nil, false
+}
+
+// isNil reports whether a value has nothing to encode at all. such dictionary entries are left out
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// isEmpty reports whether a field tagged `omitempty` should be left out
+func isEmpty(v reflect.Value) bool {
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).IsZero()
+	}
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array: // an empty RawMessage included
+		return v.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package formats
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestEncodeSortedKeys(t *testing.T) {
+	m := map[string]any{
+		"zebra": 1,
+		"apple": "fruit",
+		"Zulu":  []int{1, -2},
+		"mid":   map[string]string{"b": "2", "a": "1"},
+	}
+	b, err := Marshall(m)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	expected := "d4:Zululi1ei-2ee5:apple5:fruit3:midd1:a1:11:b1:2e5:zebrai1ee"
+	if string(b) != expected {
+		t.Errorf("Expected: %s, got %s", expected, b)
+	}
+}
+
+func TestEncodeStruct(t *testing.T) {
+	var sha Sha1
+	sha[0] = 'x'
+	s := struct {
+		Name    string    `benc:"name"`
+		Skipped string    `benc:"skipped,omitempty"`
+		Untaged int       // left out
+		Hash    Sha1      `benc:"hash"`
+		Pieces  []Sha1    `benc:"pieces"`
+		Date    time.Time `benc:"date"`
+		Num     *int      `benc:"num,omitempty"`
+		Flag    bool      `benc:"a flag"`
+	}{
+		Name:   "n",
+		Hash:   sha,
+		Pieces: []Sha1{sha, sha},
+		Date:   time.Unix(1662000000, 0),
+	}
+	b, err := Marshall(&s)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	h := string(sha[:])
+	expected := "d6:a flagi0e4:datei1662000000e4:hash20:" + h + "4:name1:n6:pieces40:" + h + h + "e"
+	if string(b) != expected {
+		t.Errorf("Expected: %q, got %q", expected, b)
+	}
+}
+
+type roundTrip struct {
+	Str    string              `benc:"str"`
+	Bytes  []byte              `benc:"bytes"`
+	Int    int                 `benc:"int"`
+	Uint   uint32              `benc:"uint"`
+	Neg    int64               `benc:"neg"`
+	Hashes []Sha1              `benc:"hashes"`
+	Hash   Sha1                `benc:"hash"`
+	List   []string            `benc:"list"`
+	Nested [][]int             `benc:"nested"`
+	Dict   map[string]int      `benc:"dict"`
+	Inner  roundTripInner      `benc:"inner"`
+	Ptr    *roundTripInner     `benc:"ptr,omitempty"`
+	Infos  []roundTripInner    `benc:"infos"`
+	Lists  map[string][]string `benc:"lists"`
+}
+
+type roundTripInner struct {
+	Name string `benc:"name"`
+	Len  int    `benc:"length"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	f := func(in roundTrip) bool {
+		var buf bytes.Buffer
+		if err := NewBencoder(&buf).Encode(in); err != nil {
+			t.Logf("Encode errored: %s", err)
+			return false
+		}
+		encoded := buf.String()
+		var out roundTrip
+		if err := NewBencDecoder(&buf).Decode(&out); err != nil {
+			t.Logf("Decode errored: %s", err)
+			return false
+		}
+		if !reflect.DeepEqual(in, out) {
+			return false
+		}
+		// encoding what we decoded must give back the exact same bytes
+		again, err := Marshall(out)
+		return err == nil && string(again) == encoded
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRoundTripMetaInfo(t *testing.T) {
+	m := MetaInfo{
+		Announce:     "udp://tracker.example:6969",
+		CreationDate: time.Unix(1662000000, 0),
+		Comment:      "round trip",
+		Info: InfoDict{
+			PieceLen:   BLOCK_LEN * 2,
+			PiecesHash: []Sha1{{1}, {2}},
+			Name:       "file",
+			Length:     BLOCK_LEN*3 + 5,
+		},
+	}
+	b, err := Marshall(m)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	var out MetaInfo
+	if err := NewBencDecoder(bytes.NewReader(b)).Decode(&out); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	info, _ := Marshall(m.Info)
+	if !bytes.Equal(out.RawInfo, info) {
+		t.Errorf("Expected raw info: %q, got %q", info, out.RawInfo)
+	}
+	out.RawInfo = nil
+	if !reflect.DeepEqual(m, out) {
+		t.Errorf("Expected: %+v, got %+v", m, out)
+	}
+}
+
+// compactPeers is a list of ip:port pairs, written as a single string of 6 bytes per peer
+type compactPeers []string
+
+func (c compactPeers) MarshalBenc() ([]byte, error) {
+	var b []byte
+	for _, p := range c {
+		b = append(b, p...)
+	}
+	return Marshall(b)
+}
+
+func (c *compactPeers) UnmarshalBenc(b []byte) error {
+	var s string
+	if err := Unmarshall(b, &s); err != nil {
+		return err
+	}
+	if len(s)%6 != 0 {
+		return errors.New("compact peers must be a multiple of 6 bytes")
+	}
+	for i := 0; i < len(s); i += 6 {
+		*c = append(*c, s[i:i+6])
+	}
+	return nil
+}
+
+type badMarshaler struct{}
+
+func (badMarshaler) MarshalBenc() ([]byte, error) {
+	return []byte("i1ei2e"), nil
+}
+
+func TestMarshalers(t *testing.T) {
+	resp := struct {
+		Interval int          `benc:"interval"`
+		Peers    compactPeers `benc:"peers"`
+	}{
+		Interval: 1800,
+		Peers:    compactPeers{"abcdef", "ghijkl"},
+	}
+	b, err := Marshall(resp)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if expected := "d8:intervali1800e5:peers12:abcdefghijkle"; string(b) != expected {
+		t.Errorf("Expected: %q, got %q", expected, b)
+	}
+	resp.Peers = nil
+	if err := Unmarshall(b, &resp); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if !reflect.DeepEqual(resp.Peers, compactPeers{"abcdef", "ghijkl"}) {
+		t.Errorf("Wrong peers: %v", resp.Peers)
+	}
+	if err := Unmarshall([]byte("d5:peers5:abcdee"), &resp); err == nil {
+		t.Errorf("Should have errored with a bad peer list")
+	}
+	if _, err := Marshall(badMarshaler{}); err == nil {
+		t.Errorf("Should have errored with invalid bencode")
+	}
+}
+
+func TestDecodeAny(t *testing.T) {
+	var v any
+	if err := Unmarshall([]byte("d1:ad2:id20:aaaaaaaaaaaaaaaaaaaae1:q4:ping1:t2:aa1:y1:q1:lli-1e0:ee"), &v); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	expected := map[string]any{
+		"a": map[string]any{"id": []byte("aaaaaaaaaaaaaaaaaaaa")},
+		"q": []byte("ping"),
+		"t": []byte("aa"),
+		"y": []byte("q"),
+		"l": []any{int64(-1), []byte{}},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("Expected: %v, got %v", expected, v)
+	}
+	// encoding the generic value gives back the same bytes
+	b, err := Marshall(v)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if expected := "d1:ad2:id20:aaaaaaaaaaaaaaaaaaaae1:lli-1e0:e1:q4:ping1:t2:aa1:y1:qe"; string(b) != expected {
+		t.Errorf("Expected: %q, got %q", expected, b)
+	}
+
+	var l []any
+	if err := Unmarshall([]byte("li1e3:abce"), &l); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if !reflect.DeepEqual(l, []any{int64(1), []byte("abc")}) {
+		t.Errorf("Wrong list: %v", l)
+	}
+
+	// an interface holding a pointer is decoded into
+	var n int
+	v = &n
+	if err := Unmarshall([]byte("i7e"), &v); err != nil || n != 7 {
+		t.Errorf("Expected 7, got %d: %v", n, err)
+	}
+}
@@ -0,0 +1,380 @@
+package formats
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/OLUWAMUYIWA/odor/parsec"
+)
+
+// TokenKind is the kind of a bencode token
+type TokenKind uint8
+
+const (
+	DictStart TokenKind = iota // `d`
+	ListStart                  // `l`
+	Int                        // `i<digits>e`
+	String                     // `<length>:<bytes>`. dictionary keys too
+	End                        // `e`, the end of the last list or dictionary started
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case DictStart:
+		return "DictStart"
+	case ListStart:
+		return "ListStart"
+	case Int:
+		return "Int"
+	case String:
+		return "String"
+	case End:
+		return "End"
+	default:
+		return "Unknown"
+	}
+}
+
+// Token is a single item of a bencoded stream, as returned by `BencDecoder.Token`
+// `Int` holds the value of Int tokens, `Str` the bytes of String tokens
+type Token struct {
+	Kind TokenKind
+	Int  int64
+	Str  []byte
+}
+
+// Limits bounds what the decoder accepts, so hostile input cannot exhaust memory. A zero field means no limit
+type Limits struct {
+	MaxDepth  int   // how deep lists and dictionaries can nest
+	MaxStrLen int   // length of a single string
+	MaxSize   int64 // total number of bytes read from the input
+}
+
+// DefaultLimits are the limits of a new decoder. the depth is bounded because decoding into go values is recursive.
+// 64 MiB leaves room for the pieces of the largest torrents
+var DefaultLimits = Limits{MaxDepth: 512, MaxStrLen: 64 << 20}
+
+// strChunk is how much of a string is read at a time, so a length the input cannot back is not allocated up front
+const strChunk = 32 << 10
+
+var ErrLimit = errors.New("bencode limit exceeded")
+
+// SyntaxErr is invalid or, in strict mode, non-canonical bencode. Offset is the position in the input where it was found
+type SyntaxErr struct {
+	Offset int64
+	Msg    string
+}
+
+func (e *SyntaxErr) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.Msg, e.Offset)
+}
+
+// container is an open list or dictionary. for dictionaries, `key` is true when a key (or the end) should come next
+// and `last` is the last key read, to check that keys are sorted
+type container struct {
+	dict    bool
+	key     bool
+	last    []byte
+	hasLast bool
+}
+
+// SetStrict switches the decoder into strict mode, where non-canonical bencode is rejected:
+// integers with leading zeros or `-0`, string lengths with leading zeros, unsorted or duplicate dictionary keys,
+// and data after the end of the value. Otherwise (the default), these are accepted and reported by `Warnings`
+func (d *BencDecoder) SetStrict(strict bool) {
+	d.strict = strict
+}
+
+// Warnings returns the non-canonical encodings accepted so far in lenient mode
+func (d *BencDecoder) Warnings() []*SyntaxErr {
+	return d.warnings
+}
+
+// nonCanonical rejects, or in lenient mode records, an encoding that is valid but not canonical
+func (d *BencDecoder) nonCanonical(off int64, msg string) error {
+	err := &SyntaxErr{Offset: off, Msg: msg}
+	if d.strict {
+		return err
+	}
+	d.warnings = append(d.warnings, err)
+	return nil
+}
+
+// Validate checks that the input is a single value of canonical bencode, as it should be in torrents we publish
+func Validate(r io.Reader) error {
+	d := NewBencDecoder(r)
+	d.SetStrict(true)
+	return d.skip()
+}
+
+// InputOffset gives the number of bytes of the input consumed so far, e.g. to find where a value ends
+func (d *BencDecoder) InputOffset() int64 {
+	return d.in.pos
+}
+
+// SetLimits replaces the limits of the decoder
+func (d *BencDecoder) SetLimits(l Limits) {
+	d.limits = l
+}
+
+// Token returns the next token in the input, without building up the value it is part of.
+// It returns io.EOF when the input ends after a complete value, and an error for anything else that is not valid bencode
+// or that exceeds the limits of the decoder. Token and Decode can be mixed, e.g. to `Decode` only the value of one key.
+func (d *BencDecoder) Token() (Token, error) {
+	if d.in.Empty() {
+		if len(d.stack) == 0 {
+			return Token{}, io.EOF
+		}
+		return Token{}, parsec.IncompleteErr()
+	}
+	c := d.in.Car()
+	var top *container
+	if len(d.stack) > 0 {
+		top = &d.stack[len(d.stack)-1]
+	}
+	if top != nil && top.dict && top.key && c != 'e' && !isDigit(c) {
+		return Token{}, &SyntaxErr{Offset: d.in.pos, Msg: fmt.Sprintf("dictionary key must be a string, got %q", c)}
+	}
+	var tok Token
+	switch {
+	case c == 'e':
+		if top == nil {
+			return Token{}, &SyntaxErr{Offset: d.in.pos, Msg: "unexpected end"}
+		}
+		if top.dict && !top.key {
+			return Token{}, &SyntaxErr{Offset: d.in.pos, Msg: "dictionary key without a value"}
+		}
+		d.in.Cdr()
+		d.stack = d.stack[:len(d.stack)-1]
+		tok = Token{Kind: End}
+	case c == 'l' || c == 'd':
+		if d.limits.MaxDepth > 0 && len(d.stack) >= d.limits.MaxDepth {
+			return Token{}, fmt.Errorf("%w: nesting deeper than %d at offset %d", ErrLimit, d.limits.MaxDepth, d.in.pos)
+		}
+		d.in.Cdr()
+		if c == 'l' {
+			tok = Token{Kind: ListStart}
+		} else {
+			tok = Token{Kind: DictStart}
+		}
+		// the container is only a complete value of its parent when it ends. the parent is not updated until then
+		d.stack = append(d.stack, container{dict: c == 'd', key: true})
+		return tok, d.checkSize()
+	case c == 'i':
+		num, err := d.readInt()
+		if err != nil {
+			return Token{}, err
+		}
+		tok = Token{Kind: Int, Int: num}
+	case isDigit(c):
+		off := d.in.pos
+		s, err := d.readStr()
+		if err != nil {
+			return Token{}, err
+		}
+		tok = Token{Kind: String, Str: s}
+		if top != nil && top.dict && top.key {
+			if err := d.checkKey(top, s, off); err != nil {
+				return Token{}, err
+			}
+		}
+	default:
+		return Token{}, &SyntaxErr{Offset: d.in.pos, Msg: fmt.Sprintf("unexpected byte %q", c)}
+	}
+	if len(d.stack) > 0 {
+		if top := &d.stack[len(d.stack)-1]; top.dict {
+			top.key = !top.key
+		}
+	} else if !d.in.Empty() { // a complete value, but the input goes on
+		if err := d.nonCanonical(d.in.pos, "trailing data after the value"); err != nil {
+			return Token{}, err
+		}
+	}
+	return tok, d.checkSize()
+}
+
+// checkKey makes sure the keys of a dictionary come in sorted order, without duplicates
+func (d *BencDecoder) checkKey(top *container, key []byte, off int64) error {
+	if top.hasLast {
+		switch bytes.Compare(top.last, key) {
+		case 0:
+			if err := d.nonCanonical(off, fmt.Sprintf("duplicate dictionary key %q", key)); err != nil {
+				return err
+			}
+		case 1:
+			if err := d.nonCanonical(off, fmt.Sprintf("dictionary key %q is out of order", key)); err != nil {
+				return err
+			}
+		}
+	}
+	top.last, top.hasLast = key, true
+	return nil
+}
+
+// readInt reads an integer, noting whether it is written canonically
+func (d *BencDecoder) readInt() (int64, error) {
+	off := d.in.pos
+	d.in.Cdr() // the `i`
+	neg := false
+	if res := parsec.Tag('-')(d.in); res.Err == nil {
+		neg = true
+	}
+	digRes := parsec.TakeWhile(isDigit)(d.in)
+	if _, didErr := digRes.Errored(); didErr {
+		return 0, &SyntaxErr{Offset: off, Msg: "integer without digits"}
+	}
+	if res := parsec.Tag('e')(d.in); res.Err != nil {
+		return 0, &SyntaxErr{Offset: d.in.pos, Msg: "integer not terminated by 'e'"}
+	}
+	digits := string(digRes.Result.([]byte))
+	num, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, &SyntaxErr{Offset: off, Msg: "integer out of range"}
+	}
+	if neg && num == 0 {
+		if err := d.nonCanonical(off, "negative zero"); err != nil {
+			return 0, err
+		}
+	} else if len(digits) > 1 && digits[0] == '0' {
+		if err := d.nonCanonical(off, "integer with leading zeros"); err != nil {
+			return 0, err
+		}
+	}
+	if neg {
+		num = -num
+	}
+	return num, nil
+}
+
+func (d *BencDecoder) checkSize() error {
+	if d.limits.MaxSize > 0 && d.in.pos > d.limits.MaxSize {
+		return fmt.Errorf("%w: input larger than %d bytes", ErrLimit, d.limits.MaxSize)
+	}
+	return nil
+}
+
+// readStr reads a string, checking its length against the limits before taking it in
+func (d *BencDecoder) readStr() ([]byte, error) {
+	off := d.in.pos
+	numRes := parsec.TakeWhile(isDigit)(d.in)
+	if _, didErr := numRes.Errored(); didErr {
+		return nil, &SyntaxErr{Offset: off, Msg: "invalid string length"}
+	}
+	digits := string(numRes.Result.([]byte))
+	n, err := strconv.Atoi(digits)
+	if err != nil {
+		return nil, &SyntaxErr{Offset: off, Msg: "invalid string length"}
+	}
+	if len(digits) > 1 && digits[0] == '0' {
+		if err := d.nonCanonical(off, "string length with leading zeros"); err != nil {
+			return nil, err
+		}
+	}
+	if d.limits.MaxStrLen > 0 && n > d.limits.MaxStrLen {
+		return nil, fmt.Errorf("%w: string of length %d at offset %d", ErrLimit, n, off)
+	}
+	if d.limits.MaxSize > 0 && int64(n) > d.limits.MaxSize-d.in.pos {
+		return nil, fmt.Errorf("%w: string of length %d at offset %d", ErrLimit, n, off)
+	}
+	if res := parsec.Tag(':')(d.in); res.Err != nil {
+		return nil, &SyntaxErr{Offset: d.in.pos, Msg: "expected ':' after string length"}
+	}
+	var s []byte
+	for len(s) < n {
+		k := n - len(s)
+		if k > strChunk {
+			k = strChunk
+		}
+		s = append(s, make([]byte, k)...)
+		if err := d.in.read(s[len(s)-k:]); err != nil {
+			return nil, parsec.IncompleteErr()
+		}
+	}
+	if s == nil {
+		s = []byte{}
+	}
+	return s, nil
+}
+
+// more reports whether the current list or dictionary has more items, i.e. its end is not next
+func (d *BencDecoder) more() (bool, error) {
+	if d.in.Empty() {
+		return false, parsec.IncompleteErr()
+	}
+	return d.in.Car() != 'e', nil
+}
+
+// skip consumes the next value, however deep, one token at a time
+func (d *BencDecoder) skip() error {
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok.Kind {
+		case DictStart, ListStart:
+			depth++
+		case End:
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// value reads the next value into the generic types an empty interface is given by the decoder
+func (d *BencDecoder) value() (any, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok.Kind {
+	case Int:
+		return tok.Int, nil
+	case String:
+		return tok.Str, nil
+	case ListStart:
+		l := []any{}
+		for {
+			if more, err := d.more(); err != nil {
+				return nil, err
+			} else if !more {
+				break
+			}
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+		_, err := d.Token()
+		return l, err
+	case DictStart:
+		m := map[string]any{}
+		for {
+			if more, err := d.more(); err != nil {
+				return nil, err
+			} else if !more {
+				break
+			}
+			k, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			m[string(k.Str)] = v
+		}
+		_, err := d.Token()
+		return m, err
+	default:
+		return nil, &SyntaxErr{Offset: d.in.pos, Msg: "unexpected end"}
+	}
+}
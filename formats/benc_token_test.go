@@ -0,0 +1,183 @@
+package formats
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestToken(t *testing.T) {
+	d := NewBencDecoder(bytes.NewBufferString("d3:bari-42e3:fool4:spamdeee"))
+	expected := []Token{
+		{Kind: DictStart},
+		{Kind: String, Str: []byte("bar")},
+		{Kind: Int, Int: -42},
+		{Kind: String, Str: []byte("foo")},
+		{Kind: ListStart},
+		{Kind: String, Str: []byte("spam")},
+		{Kind: DictStart},
+		{Kind: End},
+		{Kind: End},
+		{Kind: End},
+	}
+	for i, exp := range expected {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatalf("Token %d errored: %s", i, err)
+		}
+		if !reflect.DeepEqual(tok, exp) {
+			t.Errorf("Token %d: expected %+v, got %+v", i, exp, tok)
+		}
+	}
+	if _, err := d.Token(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestTokenInvalid(t *testing.T) {
+	for _, in := range []string{
+		"di1ei2ee", // keys must be strings
+		"d3:fooe",  // a key without a value
+		"e",        // nothing to end
+		"x",
+		"l4:spa",
+		"li1e",
+	} {
+		d := NewBencDecoder(bytes.NewBufferString(in))
+		var err error
+		for err == nil {
+			_, err = d.Token()
+		}
+		if err == io.EOF {
+			t.Errorf("%q should not be valid", in)
+		}
+	}
+}
+
+func TestTokenThenDecode(t *testing.T) {
+	// walk to the `info` key and decode only its value
+	d := NewBencDecoder(bytes.NewBufferString("d8:announce3:url4:infod4:name4:fileee"))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+		if tok.Kind == String && string(tok.Str) == "info" {
+			break
+		}
+	}
+	var info InfoDict
+	if err := d.Decode(&info); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if info.Name != "file" {
+		t.Errorf("Wrong name: %q", info.Name)
+	}
+	if tok, err := d.Token(); err != nil || tok.Kind != End {
+		t.Errorf("Expected the end of the dict, got %+v: %v", tok, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		in     string
+		limits Limits
+	}{
+		{strings.Repeat("l", 10) + strings.Repeat("e", 10), Limits{MaxDepth: 5}},
+		{"999999999999:", Limits{MaxStrLen: 1 << 20}},
+		{"10:abcdefghij", Limits{MaxStrLen: 5}},
+		{"999999999:abc", Limits{MaxSize: 1 << 10}},
+		{"l" + strings.Repeat("i1e", 100) + "e", Limits{MaxSize: 100}},
+	}
+	for _, test := range tests {
+		d := NewBencDecoder(bytes.NewBufferString(test.in))
+		d.SetLimits(test.limits)
+		var err error
+		for err == nil {
+			_, err = d.Token()
+		}
+		if !errors.Is(err, ErrLimit) {
+			t.Errorf("%.20q should exceed the limits %+v, got %v", test.in, test.limits, err)
+		}
+		d = NewBencDecoder(bytes.NewBufferString(test.in))
+		d.SetLimits(test.limits)
+		var v any
+		if err := d.Decode(&v); !errors.Is(err, ErrLimit) {
+			t.Errorf("%.20q should exceed the limits %+v when decoding, got %v", test.in, test.limits, err)
+		}
+	}
+
+	// a length the data cannot back is an error, not an allocation
+	var m map[string]any
+	if err := Unmarshall([]byte("d1:y99999999999999999:x"), &m); err == nil {
+		t.Errorf("String longer than the data should be rejected")
+	}
+	var big []byte
+	if err := NewBencDecoder(bytes.NewBufferString("99999999999999999:x")).Decode(&big); err == nil {
+		t.Errorf("String longer than the default limit should be rejected")
+	}
+	// strings are read in chunks
+	long := strings.Repeat("x", 3*strChunk+1)
+	var got string
+	if err := Unmarshall([]byte(fmt.Sprintf("%d:%s", len(long), long)), &got); err != nil || got != long {
+		t.Errorf("Long string not read back: %v", err)
+	}
+
+	// within the limits
+	d := NewBencDecoder(bytes.NewBufferString("l5:abcdee"))
+	d.SetLimits(Limits{MaxDepth: 1, MaxStrLen: 5, MaxSize: 9})
+	var l []string
+	if err := d.Decode(&l); err != nil {
+		t.Errorf("Errored: %s", err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	tests := []struct {
+		in     string
+		offset int64
+	}{
+		{"i03e", 0},
+		{"i-0e", 0},
+		{"l04:spame", 1},
+		{"d1:bi1e1:ai2ee", 7}, // unsorted
+		{"d1:ai1e1:ai2ee", 7}, // duplicate
+		{"d1:ai1eei1e", 8},    // trailing data
+		{"ld1:a0:1:b0:ei00ee", 13},
+	}
+	for _, test := range tests {
+		err := Validate(bytes.NewBufferString(test.in))
+		var syntaxErr *SyntaxErr
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q should not validate, got %v", test.in, err)
+			continue
+		}
+		if syntaxErr.Offset != test.offset {
+			t.Errorf("%q: expected offset %d, got %d: %s", test.in, test.offset, syntaxErr.Offset, syntaxErr)
+		}
+
+		// lenient mode accepts them, with a warning
+		d := NewBencDecoder(bytes.NewBufferString(test.in))
+		var v any
+		if err := d.Decode(&v); err != nil {
+			t.Errorf("%q should decode in lenient mode, got %v", test.in, err)
+		}
+		if w := d.Warnings(); len(w) != 1 || w[0].Offset != test.offset {
+			t.Errorf("%q: expected a warning at offset %d, got %v", test.in, test.offset, w)
+		}
+	}
+
+	canonical := "d1:ai0e1:bli-1e0:d1:cdeeee"
+	if err := Validate(bytes.NewBufferString(canonical)); err != nil {
+		t.Errorf("%q should validate, got %v", canonical, err)
+	}
+	d := NewBencDecoder(bytes.NewBufferString(canonical))
+	var v any
+	if err := d.Decode(&v); err != nil || len(d.Warnings()) != 0 {
+		t.Errorf("%q should decode without warnings, got %v, %v", canonical, err, d.Warnings())
+	}
+}
@@ -2,18 +2,24 @@ package formats
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"reflect"
 	"strconv"
-	"unicode"
+	"strings"
+	"time"
 
 	"github.com/OLUWAMUYIWA/odor/parsec"
 )
 
 type BencInput struct {
 	R *bufio.Reader
+	// recording. `marks` are the positions in `rec` where each (possibly nested) recording began
+	rec   []byte
+	marks []int
+	pos   int64 // number of bytes consumed so far
 }
 
 func NewBencInput(r io.Reader) *BencInput {
@@ -23,18 +29,55 @@ func NewBencInput(r io.Reader) *BencInput {
 }
 
 // basically a peek but returned. the input must not be changed after a Car
+// an empty input gives a zero byte, so parsers must check `Empty` before trusting it
 func (b *BencInput) Car() byte {
-	s, _ := b.R.Peek(1)
+	s, err := b.R.Peek(1)
+	if err != nil {
+		return 0
+	}
 	return s[0]
 }
 
 // read what was last read+unread by Car and drop
 func (b *BencInput) Cdr() parsec.ParserInput {
-
-	b.R.ReadByte()
+	c, err := b.R.ReadByte()
+	if err != nil {
+		return b
+	}
+	b.pos++
+	if len(b.marks) > 0 {
+		b.rec = append(b.rec, c)
+	}
 	return b
 }
 
+// read fills `p` from the input at once, rather than a byte at a time like Cdr
+func (b *BencInput) read(p []byte) error {
+	n, err := io.ReadFull(b.R, p)
+	b.pos += int64(n)
+	if len(b.marks) > 0 {
+		b.rec = append(b.rec, p[:n]...)
+	}
+	return err
+}
+
+// record starts keeping every byte consumed from the input until the matching `stopRecord`
+func (b *BencInput) record() {
+	b.marks = append(b.marks, len(b.rec))
+}
+
+// stopRecord ends the last recording started and returns the bytes consumed since then
+func (b *BencInput) stopRecord() []byte {
+	mark := b.marks[len(b.marks)-1]
+	b.marks = b.marks[:len(b.marks)-1]
+	recorded := make([]byte, len(b.rec)-mark)
+	copy(recorded, b.rec[mark:])
+	if len(b.marks) == 0 {
+		b.rec = b.rec[:0]
+	}
+	return recorded
+}
+
 // we say that any error here is due to EOF, but that's unsound. There
 // might be an error while interpreting the rune. //comeback
 func (b *BencInput) Empty() bool {
@@ -51,298 +94,509 @@ func (b BencInput) String() string {
 	return s
 }
 
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// BencStr parses a byte string: `<length>:<bytes>`.
+// The result is a go string holding the raw bytes. They need not be valid utf-8, e.g. the `pieces` of the info dict
 func BencStr() parsec.Parsec {
+	digits := parsec.TakeWhile(isDigit)
+	colon := parsec.Tag(':')
 	return func(in parsec.ParserInput) parsec.PResult {
-		rem := in
 		if in.Empty() {
-			return parsec.PResult{
-				Result: nil,
-				Rem:    rem,
-				Err:    parsec.IncompleteErr(),
-			}
+			return parsec.PResult{Result: nil, Rem: in, Err: parsec.IncompleteErr()}
 		}
-		numRes := parsec.Number()(rem)
+		numRes := digits(in)
 		if err, didErr := numRes.Errored(); didErr {
-			return parsec.PResult{Result: nil, Rem: in, Err: err.(*(parsec.ParsecErr))}
+			return parsec.PResult{Result: nil, Rem: in, Err: err}
 		}
-		rem = numRes.Rem
-		resColon := parsec.Tag(':')(rem)
-
+		num, err := strconv.Atoi(string(numRes.Result.([]byte)))
+		if err != nil {
+			return parsec.PResult{Result: nil, Rem: in, Err: parsec.UnmatchedErr()}
+		}
+		resColon := colon(numRes.Rem)
 		if err, didErr := resColon.Errored(); didErr {
-			return parsec.PResult{Result: nil, Rem: in, Err: err.(*(parsec.ParsecErr))}
-		}
-		num := numRes.Result.(int)
-		rem = resColon.Rem
-		if num == 0 { // the case of the empty string: `0:`
-			return parsec.PResult{
-				Result: "",
-				Rem:    rem,
-				Err:    nil,
-			}
+			return parsec.PResult{Result: nil, Rem: in, Err: err}
 		}
-
-		// non-empty string
-		res := parsec.StrN(num)(rem)
-		if err, didErr := res.Errored(); didErr {
-			return parsec.PResult{Result: nil, Rem: in, Err: err.(*(parsec.ParsecErr))}
+		rem := resColon.Rem
+		var buf []byte // not `num` up front: the input may not have that many
+		for i := 0; i < num; i++ {
+			if rem.Empty() { // the length prefix promised more than the input has
+				return parsec.PResult{Result: nil, Rem: in, Err: parsec.IncompleteErr()}
+			}
+			buf = append(buf, rem.Car())
+			rem = rem.Cdr()
 		}
-
-		return res
+		return parsec.PResult{Result: string(buf), Rem: rem, Err: nil}
 	}
 }
 
+// BencInt parses an integer: `i<digits>e`, where the digits may be preceded by a minus sign
 func BencInt() parsec.Parsec {
-	l, r := byte('i'), byte('e')
-	guardedInt := parsec.GuardedWhile(l, r, func(r byte) bool { return unicode.IsDigit(rune(r)) })
+	pre, last, minus := parsec.Tag('i'), parsec.Tag('e'), parsec.Tag('-')
+	digits := parsec.TakeWhile(isDigit)
 	return func(in parsec.ParserInput) parsec.PResult {
-		res := guardedInt(in)
-		// the internal TaeWhile used to implement GuardedWhile returns a slice of runes as result
-		// l := res.Result.(*list.List)
-		// var digits []rune
-		// for e := l.Front(); e != nil; e = e.Next() {
-		// 	digits = append(digits, e.Value.(rune))
-		// }
-		digits, ok := res.Result.([]byte)
-		if !ok {
-			return parsec.PResult{
-				Result: nil,
-				Rem:    in,
-				Err:    parsec.UnmatchedErr(),
-			}
+		res := pre(in)
+		if err, didErr := res.Errored(); didErr {
+			return parsec.PResult{Result: nil, Rem: in, Err: err}
 		}
-		if _, did := res.Errored(); did {
-			return res
+		rem := res.Rem
+		neg := false
+		if res := minus(rem); res.Err == nil {
+			neg = true
+			rem = res.Rem
+		}
+		digRes := digits(rem)
+		if err, didErr := digRes.Errored(); didErr {
+			return parsec.PResult{Result: nil, Rem: in, Err: err}
+		}
+		end := last(digRes.Rem)
+		if err, didErr := end.Errored(); didErr {
+			return parsec.PResult{Result: nil, Rem: in, Err: err}
+		}
+		num, err := strconv.ParseInt(string(digRes.Result.([]byte)), 10, 64)
+		if err != nil {
+			return parsec.PResult{Result: nil, Rem: in, Err: parsec.ExceededErr()}
+		}
+		if neg {
+			num = -num
 		}
-		num, _ := strconv.ParseInt(string(digits), 10, 0)
-		res.Result = int(num)
-		return res
+		return parsec.PResult{Result: int(num), Rem: end.Rem, Err: nil}
 	}
 }
 
-// BencList:  possible return types: slice of strings, slice of ints, slice of maps, slice of slices of any of th above
+// BencValue parses any bencoded value. since every kind of value is identified by its first byte,
+// `Alt` never has to walk back more than that byte
+// it is built lazily because lists and dicts refer back to it
+func BencValue() parsec.Parsec {
+	return func(in parsec.ParserInput) parsec.PResult {
+		return parsec.Alt(BencInt(), BencStr(), BencList(), BenDict())(in)
+	}
+}
+
+// BencList:  the result is a slice of any of the possible types: strings, ints, slices or maps
 func BencList() parsec.Parsec {
 	pre := parsec.Tag('l')
 	last := parsec.Tag('e')
-	// since empty  lists exist, we use Many0
-	manyStr := BencStr().Many0().ThenDiscard(last)
-	manyInt := BencInt().Many0().ThenDiscard(last)
-	benDict := BenDict().Many0().ThenDiscard(last)
 	return func(in parsec.ParserInput) parsec.PResult {
 		res := pre(in)
 		if err, didErr := res.Errored(); didErr {
 			return parsec.PResult{Result: nil, Rem: in, Err: err}
 		}
 		rem := res.Rem
-
-		// fast path: an alternative between a list of integers, strings, or dictionaries
-		// `Alt` is not particularly wasteful because the kind of encoding we're dealing with quickly exits if the type were trying is wrong
-		res = parsec.Alt(manyInt, manyStr, benDict)(rem)
-		if _, didErr := res.Errored(); !didErr {
-			return res // return the result as is, its perfect
-		}
-
-		//might be a list of lists
-		l := [][]any{}
-		listsRes := parsec.PResult{
-			Result: l,
-			Rem:    in,
-			Err:    nil,
-		}
-
+		l := []any{}
+		value := BencValue()
 		for {
-			res = BencList()(rem) // use the same input as what was returned in the pre stage
-			if err, didErr := res.Errored(); didErr {
-				return parsec.PResult{
-					Result: nil,
-					Rem:    in,
-					Err:    err,
-				}
+			if rem.Empty() { // the list is open-ended: incomplete
+				return parsec.PResult{Result: nil, Rem: in, Err: parsec.IncompleteErr()}
 			}
-			currRes, ok := res.Result.([]any)
-			if !ok {
-				return parsec.PResult{
-					Result: nil,
-					Rem:    in,
-					Err:    parsec.UnmatchedErr(),
-				}
+			// we have reached the end: the rune `e`, which ends the list matches
+			if end := last(rem); end.Err == nil {
+				return parsec.PResult{Result: l, Rem: end.Rem, Err: nil}
 			}
-			l = append(l, currRes) // would be a slice of any of the possible types a list can contain
-			rem = res.Rem
-			listsRes.Rem = res.Rem
-
-			// now check whether to exit the loop or not
-			end := last(rem)
-			if err, didErr := end.Errored(); didErr && errors.Is(err, parsec.UnmatchedErr()) {
-				// UnmatchedErr means the rune does not match, meaning that we're not done yet, but theres more data to go
-				continue
-			} else if errors.Is(err, parsec.IncompleteErr()) { // there's no more data to eat, therefore, the list is open-ended: incomplete
-				return parsec.PResult{
-					Result: nil,
-					Rem:    in,
-					Err:    parsec.IncompleteErr(),
-				}
-			} else { // we have reached the end: the rune `e`, which ends the list matches
-				return listsRes
+			res = value(rem)
+			if err, didErr := res.Errored(); didErr {
+				return parsec.PResult{Result: nil, Rem: in, Err: err}
 			}
+			l = append(l, res.Result)
+			rem = res.Rem
 		}
-
 	}
-
 }
 
+// BenDict: the result is a map from the string keys to any of the possible types
 func BenDict() parsec.Parsec {
 	prefix := parsec.Tag('d')
 	suffix := parsec.Tag('e')
 	key := BencStr()
-	str := BencStr()
-	num := BencInt()
-	list := BencList()
-	nonDicts := parsec.Alt(num, str, list)
 	return func(in parsec.ParserInput) parsec.PResult {
 		dict := map[string]any{}
-
 		// first check the prefix for dictionaries
 		res := prefix(in)
 		if err, didErr := res.Errored(); didErr {
 			return parsec.PResult{Result: nil, Rem: in, Err: err}
 		}
 		rem := res.Rem
-		mapRes := parsec.PResult{
-			Result: dict,
-			Rem:    in,
-			Err:    nil,
-		}
+		value := BencValue()
 		for {
-			keyRes := key(rem)
-			if _, didErr := keyRes.Errored(); didErr { // comeback: coulld be the end of the dict
-				break
+			if rem.Empty() { // the dictionary is open-ended, not terminated by a `e`
+				return parsec.PResult{Result: nil, Rem: in, Err: parsec.IncompleteErr()}
 			}
-			rem = keyRes.Rem
-			k := keyRes.Result.(string)
-			v := nonDicts(rem)
-			rem = v.Rem
-			if err, didErr := v.Errored(); didErr { // i.e. none of these `nonDicts` parsers passed
-				if errors.Is(err, parsec.UnmatchedErr()) { // what we have here should be a dict inside a dict
-					res = BenDict()(rem)
-					if err, didErr := res.Errored(); didErr { // ow, we have no other type to match, we have erred
-						return parsec.PResult{
-							Result: nil,
-							Rem:    in,
-							Err:    err,
-						}
-					} else { // in this case, we were right. it is a dictionary
-						dict[k] = res.Result
-					}
-				} else if errors.Is(err, parsec.IncompleteErr()) { // we have an error here. a key without a value
-					return parsec.PResult{
-						Result: nil,
-						Rem:    in,
-						Err:    parsec.IncompleteErr(),
-					}
-				} // there's no `else` because we have only two kinds of errors
-
-			} else { // the value matches with the `nonDicts` parser. i.e. a fast path
-				// add the value to the cache
-				dict[k] = v
+			if end := suffix(rem); end.Err == nil {
+				return parsec.PResult{Result: dict, Rem: end.Rem, Err: nil}
 			}
-
-			// in any case, we then check if we're done
-			end := suffix(rem)
-			if err, didErr := end.Errored(); didErr && errors.Is(err, parsec.UnmatchedErr()) { // not yet done
-				continue
-			} else if errors.Is(err, parsec.IncompleteErr()) {
-				return parsec.PResult{ // certainly has to be an error. the dictionary is open-ended, not terminated by a `e`
-					Result: nil,
-					Rem:    in,
-					Err:    parsec.IncompleteErr(),
-				}
-			} else { // it matches the end
-				mapRes.Rem = end.Rem // the remainder becomes the remainder after the terminator has been taken
-				mapRes.Result = dict // just to be double-sure. comeback: may not be necessary
-				break                // we break ou of the loop
+			keyRes := key(rem)
+			if err, didErr := keyRes.Errored(); didErr {
+				return parsec.PResult{Result: nil, Rem: in, Err: err}
+			}
+			v := value(keyRes.Rem)
+			if err, didErr := v.Errored(); didErr { // a key without a value
+				return parsec.PResult{Result: nil, Rem: in, Err: err}
 			}
+			dict[keyRes.Result.(string)] = v.Result
+			rem = v.Rem
 		}
+	}
+}
 
-		return mapRes
+// UnmarshalTypeErr is returned by the decoder when a bencoded value cannot be stored in the go value meant to hold it
+// Path is the dot-separated list of dictionary keys (and list indices) leading to the value
+type UnmarshalTypeErr struct {
+	Value string // the kind of bencoded value: "integer", "string", "list" or "dictionary"
+	Type  reflect.Type
+	Path  string
+}
 
-	}
+func (e *UnmarshalTypeErr) Error() string {
+	return fmt.Sprintf("cannot decode bencoded %s into value of type %s at key: %q", e.Value, e.Type, e.Path)
 }
 
 type BencDecoder struct {
-	r io.Reader
+	in     *BencInput
+	limits Limits
+	stack  []container // lists and dictionaries opened by `Token` and not yet closed
+	// in strict mode, non-canonical bencode is an error. otherwise it is noted in `warnings`
+	strict   bool
+	warnings []*SyntaxErr
 }
 
 func NewBencDecoder(r io.Reader) *BencDecoder {
 	return &BencDecoder{
-		r: r,
+		in:     NewBencInput(r),
+		limits: DefaultLimits,
 	}
 }
 
-func ParseBenc(in parsec.ParserInput, m map[string]interface{}) error {
-	return nil
+// RawMessage is a raw bencoded value. It is stored by the decoder exactly as it was read, and written by the encoder as is.
+// A struct may have a RawMessage field with the same key as another field, both are filled by the decoder.
+// e.g. `MetaInfo` keeps the bytes of the info dict to compute the infohash, while still decoding it into an `InfoDict`.
+// When encoding such a struct, the RawMessage is preferred, unless it is empty
+type RawMessage []byte
+
+// BencMarshaler is implemented by types that know how to bencode themselves, e.g. compact peer lists.
+// MarshalBenc must return exactly one valid bencoded value
+type BencMarshaler interface {
+	MarshalBenc() ([]byte, error)
 }
 
-func (d *BencDecoder) Decode(structure any) error {
+// BencUnmarshaler is implemented by types that know how to decode themselves.
+// UnmarshalBenc is given the raw bytes of one bencoded value. it must copy them if it keeps them
+type BencUnmarshaler interface {
+	UnmarshalBenc([]byte) error
+}
 
-	m := make(map[string]interface{})
-	r := bufio.NewReader(d.r)
-	in := &BencInput{r}
-	err := ParseBenc(in, m)
-	if err != nil {
-		return err
-	}
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	rawMessageType  = reflect.TypeOf(RawMessage{})
+	marshalerType   = reflect.TypeOf((*BencMarshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*BencUnmarshaler)(nil)).Elem()
+)
 
-	ty := reflect.TypeOf(structure)
+// Unmarshall decodes the bencoded `data` into the value pointed to by `v`. see `Decode`.
+// no string can be longer than what is left of `data`
+func Unmarshall(data []byte, v any) error {
+	d := NewBencDecoder(bytes.NewReader(data))
+	if d.limits.MaxSize == 0 || d.limits.MaxSize > int64(len(data)) {
+		d.limits.MaxSize = int64(len(data))
+	}
+	return d.Decode(v)
+}
 
-	if ty.Kind() != reflect.Pointer {
+// Decode reads the next bencoded value from the input and stores it in the value pointed to by `v`.
+// structs are filled through their `benc` tags, e.g. `benc:"piece length"` or `benc:"comment,omitempty"`.
+// fields without the tag are left alone, so are dictionary keys that match no field.
+// Like `encoding/json`, an empty interface is given the generic value: an int64, a []byte for strings, an []any or a map[string]any
+func (d *BencDecoder) Decode(v any) error {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Pointer || val.IsNil() {
 		return errors.New("Cannot parse into non-pointer")
 	}
+	return d.decode(val.Elem(), "")
+}
 
-	// (reflect.Type).Elem() checks the value (either pointer or interface) and returns the value it points to
-	elem := ty.Elem()
-	if elem.Kind() != reflect.Struct {
-		return errors.New("Cannot parse into non-struct")
+// decode looks at the first byte of the next value to know what it is, and dispatches accordingly
+func (d *BencDecoder) decode(v reflect.Value, path string) error {
+	if d.in.Empty() {
+		if len(d.stack) == 0 {
+			return io.EOF
+		}
+		return parsec.IncompleteErr()
 	}
-
-	for i := 0; i < elem.NumField(); i++ {
-		field := elem.Field(i)
-		if field.Tag == "" {
-			continue
+	if v.Type() == rawMessageType {
+		raw, err := d.rawValue()
+		if err != nil {
+			return err
 		}
-		tagValue := field.Tag.Get("benc")
-
-		if tagValue == "" {
-			continue
+		v.SetBytes(raw)
+		return nil
+	}
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
 		}
-		kind := field.Type.Kind()
-
-		switch kind {
-		case reflect.String:
-			{
+		return d.decode(v.Elem(), path)
+	}
+	if v.CanAddr() && reflect.PointerTo(v.Type()).Implements(unmarshalerType) {
+		raw, err := d.rawValue()
+		if err != nil {
+			return err
+		}
+		if err := v.Addr().Interface().(BencUnmarshaler).UnmarshalBenc(raw); err != nil {
+			return fmt.Errorf("%w at key: %q", err, path)
+		}
+		return nil
+	}
+	if v.Kind() == reflect.Interface {
+		// an interface already holding a pointer gets the value decoded into what it points to
+		if !v.IsNil() && v.Elem().Kind() == reflect.Pointer && !v.Elem().IsNil() {
+			return d.decode(v.Elem(), path)
+		}
+		if v.NumMethod() > 0 {
+			return &UnmarshalTypeErr{Value: "value", Type: v.Type(), Path: path}
+		}
+		val, err := d.value()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(val))
+		return nil
+	}
+	switch c := d.in.Car(); {
+	case c == 'i':
+		return d.decodeInt(v, path)
+	case c == 'l':
+		return d.decodeList(v, path)
+	case c == 'd':
+		return d.decodeDict(v, path)
+	case isDigit(c):
+		return d.decodeStr(v, path)
+	default:
+		return fmt.Errorf("Invalid bencode: unexpected byte %q at key: %q", c, path)
+	}
+}
 
-			}
+// rawValue consumes the next value, returning its bytes as they were read
+func (d *BencDecoder) rawValue() ([]byte, error) {
+	d.in.record()
+	err := d.skip()
+	raw := d.in.stopRecord()
+	return raw, err
+}
 
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			{
+func (d *BencDecoder) decodeInt(v reflect.Value, path string) error {
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+	num := tok.Int
+	if v.Type() == timeType {
+		v.Set(reflect.ValueOf(time.Unix(num, 0)))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(num) {
+			return fmt.Errorf("Integer %d overflows %s at key: %q", num, v.Type(), path)
+		}
+		v.SetInt(num)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if num < 0 || v.OverflowUint(uint64(num)) {
+			return fmt.Errorf("Integer %d overflows %s at key: %q", num, v.Type(), path)
+		}
+		v.SetUint(uint64(num))
+	case reflect.Bool: // flags like `private` are encoded as 0 or 1
+		v.SetBool(num != 0)
+	default:
+		return &UnmarshalTypeErr{Value: "integer", Type: v.Type(), Path: path}
+	}
+	return nil
+}
 
+func (d *BencDecoder) decodeStr(v reflect.Value, path string) error {
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+	s := string(tok.Str)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+		return nil
+	case reflect.Slice:
+		elem := v.Type().Elem()
+		if elem.Kind() == reflect.Uint8 {
+			v.SetBytes([]byte(s))
+			return nil
+		}
+		// a byte string of fixed-size hashes, e.g. the `pieces` in the info dict into a []Sha1
+		if elem.Kind() == reflect.Array && elem.Elem().Kind() == reflect.Uint8 {
+			n := elem.Len()
+			if len(s)%n != 0 {
+				return fmt.Errorf("Length of string %d is not a multiple of %d at key: %q", len(s), n, path)
 			}
-
-		case reflect.Slice:
-			{
-
+			sl := reflect.MakeSlice(v.Type(), len(s)/n, len(s)/n)
+			for i := 0; i < sl.Len(); i++ {
+				reflect.Copy(sl.Index(i), reflect.ValueOf(s[i*n:(i+1)*n]))
 			}
+			v.Set(sl)
+			return nil
+		}
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if len(s) != v.Len() {
+				return fmt.Errorf("Expected string of length %d, got %d at key: %q", v.Len(), len(s), path)
+			}
+			reflect.Copy(v, reflect.ValueOf(s))
+			return nil
+		}
+	}
+	return &UnmarshalTypeErr{Value: "string", Type: v.Type(), Path: path}
+}
 
-		case reflect.Map:
-			{
-
+func (d *BencDecoder) decodeList(v reflect.Value, path string) error {
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return &UnmarshalTypeErr{Value: "list", Type: v.Type(), Path: path}
+	}
+	if _, err := d.Token(); err != nil { // the `l`
+		return err
+	}
+	i := 0
+	for {
+		if more, err := d.more(); err != nil {
+			return err
+		} else if !more {
+			break
+		}
+		elemPath := fmt.Sprintf("%s[%d]", path, i)
+		if v.Kind() == reflect.Slice {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(elem, elemPath); err != nil {
+				return err
 			}
+			v.Set(reflect.Append(v, elem))
+		} else {
+			if i >= v.Len() {
+				return fmt.Errorf("List too long for %s at key: %q", v.Type(), path)
+			}
+			if err := d.decode(v.Index(i), elemPath); err != nil {
+				return err
+			}
+		}
+		i++
+	}
+	if _, err := d.Token(); err != nil { // the `e`
+		return err
+	}
+	if v.Kind() == reflect.Slice && v.IsNil() { // an empty list is still a list
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	return nil
+}
 
-		default:
-			{
-				return fmt.Errorf("Data Type Not supported")
+func (d *BencDecoder) decodeDict(v reflect.Value, path string) error {
+	var fields map[string][]int
+	switch {
+	case v.Kind() == reflect.Struct:
+		fields = bencFields(v.Type())
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	default:
+		return &UnmarshalTypeErr{Value: "dictionary", Type: v.Type(), Path: path}
+	}
+	if _, err := d.Token(); err != nil { // the `d`
+		return err
+	}
+	for {
+		if more, err := d.more(); err != nil {
+			return err
+		} else if !more {
+			_, err := d.Token() // the `e`
+			return err
+		}
+		keyTok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		k := string(keyTok.Str)
+		keyPath := k
+		if path != "" {
+			keyPath = path + "." + k
+		}
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(elem, keyPath); err != nil {
+				return err
 			}
+			v.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), elem)
+			continue
+		}
+		idx, ok := fields[k]
+		if !ok { // a key we don't know about. parse and drop its value
+			if err := d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decodeField(v, idx, keyPath); err != nil {
+			return err
+		}
+	}
+}
 
+// decodeField decodes the value of a dictionary key into all the fields of the struct `v` that share the key
+func (d *BencDecoder) decodeField(v reflect.Value, idx []int, path string) error {
+	var raws []reflect.Value
+	var target reflect.Value
+	for _, i := range idx {
+		if f := v.Field(i); f.Type() == rawMessageType {
+			raws = append(raws, f)
+		} else {
+			target = f
 		}
 	}
+	if len(raws) == 0 {
+		return d.decode(target, path)
+	}
+	if !target.IsValid() {
+		return d.decode(raws[0], path)
+	}
+	d.in.record()
+	err := d.decode(target, path)
+	raw := d.in.stopRecord()
+	if err != nil {
+		return err
+	}
+	for _, f := range raws {
+		f.SetBytes(raw)
+	}
 	return nil
 }
+
+// bencTag splits a `benc` struct tag into the dictionary key and its options
+func bencTag(f reflect.StructField) (name string, omitempty bool) {
+	tag := f.Tag.Get("benc")
+	if tag == "" || tag == "-" {
+		return "", false
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	return name, opts == "omitempty"
+}
+
+// bencFields maps the dictionary keys of a struct type to the indices of the fields that hold them.
+// only exported fields with a `benc` tag take part
+func bencFields(t reflect.Type) map[string][]int {
+	fields := make(map[string][]int)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if name, _ := bencTag(f); name != "" {
+			fields[name] = append(fields[name], i)
+		}
+	}
+	return fields
+}
@@ -3,7 +3,10 @@ package formats
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha1"
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -63,9 +66,159 @@ func TestBencStr(t *testing.T) {
 }
 
 func TestBencList(t *testing.T) {
+	in := NewBencInput(bytes.NewBufferString("l4:spami-42eli1eelee4:rest"))
+	res := BencList()(in)
+	if err, didErr := res.Errored(); didErr {
+		t.Fatalf("Errored: %s", err)
+	}
+	expected := []any{"spam", -42, []any{1}, []any{}}
+	if !reflect.DeepEqual(res.Result, expected) {
+		t.Errorf("Expected: %v, got %v", expected, res.Result)
+	}
+	if n := res.Rem.Car(); n != '4' {
+		t.Errorf("Should be: %v, but is: %v", '4', n)
+	}
 
+	res = BencList()(NewBencInput(bytes.NewBufferString("l4:spam")))
+	if _, didErr := res.Errored(); !didErr {
+		t.Errorf("An unterminated list should not parse")
+	}
 }
 
 func TestBenDict(t *testing.T) {
+	in := NewBencInput(bytes.NewBufferString("d3:bar4:spam3:fooi42e4:listl1:ae4:dictd0:0:ee"))
+	res := BenDict()(in)
+	if err, didErr := res.Errored(); didErr {
+		t.Fatalf("Errored: %s", err)
+	}
+	expected := map[string]any{
+		"bar":  "spam",
+		"foo":  42,
+		"list": []any{"a"},
+		"dict": map[string]any{"": ""},
+	}
+	if !reflect.DeepEqual(res.Result, expected) {
+		t.Errorf("Expected: %v, got %v", expected, res.Result)
+	}
+}
+
+func TestDecodeMetaInfo(t *testing.T) {
+	var pieces bytes.Buffer
+	var sha1, sha2 Sha1
+	for i := range sha1 {
+		sha1[i], sha2[i] = byte(i), byte(0xff-i)
+	}
+	pieces.Write(sha1[:])
+	pieces.Write(sha2[:])
+	torr := "d8:announce18:udp://tracker:69697:comment4:test13:creation datei1662000000e" +
+		"4:infod6:lengthi40000e4:name8:file.iso12:piece lengthi32768e6:pieces40:" + pieces.String() +
+		"7:privatei1e6:sourcei7eee"
+	var m MetaInfo
+	if err := NewBencDecoder(bytes.NewBufferString(torr)).Decode(&m); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if m.Announce != "udp://tracker:6969" || m.Comment != "test" {
+		t.Errorf("Wrong strings: %q, %q", m.Announce, m.Comment)
+	}
+	if m.CreationDate.Unix() != 1662000000 {
+		t.Errorf("Wrong creation date: %s", m.CreationDate)
+	}
+	if m.Info.Name != "file.iso" || m.Info.PieceLen != 32768 || m.Info.Length != 40000 || !m.Info.Private {
+		t.Errorf("Wrong info dict: %+v", m.Info)
+	}
+	if !reflect.DeepEqual(m.Info.PiecesHash, []Sha1{sha1, sha2}) {
+		t.Errorf("Wrong pieces: %v", m.Info.PiecesHash)
+	}
+	if m.Size() != 40000 {
+		t.Errorf("Wrong size: %d", m.Size())
+	}
+}
 
+func TestDecodeTypeMismatch(t *testing.T) {
+	var m MetaInfo
+	err := NewBencDecoder(bytes.NewBufferString("d4:infod12:piece length3:abcee")).Decode(&m)
+	var typeErr *UnmarshalTypeErr
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("Expected a type error, got: %v", err)
+	}
+	if typeErr.Path != "info.piece length" {
+		t.Errorf("Wrong path: %q", typeErr.Path)
+	}
+
+	var s struct {
+		Nums map[string][]int `benc:"nums"`
+	}
+	if err := NewBencDecoder(bytes.NewBufferString("d4:numsd1:ali1ei2eeee")).Decode(&s); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if !reflect.DeepEqual(s.Nums, map[string][]int{"a": {1, 2}}) {
+		t.Errorf("Wrong map: %v", s.Nums)
+	}
+	err = NewBencDecoder(bytes.NewBufferString("d4:numsd1:ali1e1:xeee")).Decode(&s)
+	if !errors.As(err, &typeErr) || typeErr.Path != "nums.a[1]" {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+func TestRawInfoHash(t *testing.T) {
+	// unknown keys and keys out of order: re-encoding the info dict would give a different hash
+	info := "d4:name4:file6:lengthi5e12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa6:source4:odore"
+	torr := "d8:announce3:url4:info" + info + "e"
+	var m MetaInfo
+	if err := NewBencDecoder(bytes.NewBufferString(torr)).Decode(&m); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if string(m.RawInfo) != info {
+		t.Errorf("Expected raw info: %q, got %q", info, m.RawInfo)
+	}
+	if m.Info.Name != "file" || m.Info.Length != 5 {
+		t.Errorf("Info dict should be decoded too: %+v", m.Info)
+	}
+	h, err := m.GetInfoHash()
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if expected := sha1.Sum([]byte(info)); Sha1(expected) != h {
+		t.Errorf("Expected infohash: % x, got % x", expected, h)
+	}
+	// encoding the MetaInfo writes the raw dict back
+	b, err := Marshall(m)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if string(b) != torr {
+		t.Errorf("Expected: %q, got %q", torr, b)
+	}
+}
+
+func TestDecodeMultiFile(t *testing.T) {
+	torr := "d8:announce3:url4:infod5:filesld6:lengthi5e4:pathl1:a5:a.txteed6:lengthi0e4:pathl5:emptyeed6:lengthi20e4:pathl1:beee" +
+		"4:name3:dir12:piece lengthi8e6:pieces80:" + strings.Repeat("x", 80) + "ee"
+	var m MetaInfo
+	if err := NewBencDecoder(bytes.NewBufferString(torr)).Decode(&m); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if !m.Info.IsDir() || m.Size() != 25 {
+		t.Fatalf("Expected a directory of 25 bytes, got %d", m.Size())
+	}
+	if !reflect.DeepEqual(m.Info.Files[0].Path, []string{"a", "a.txt"}) {
+		t.Errorf("Wrong path: %v", m.Info.Files[0].Path)
+	}
+	// pieces of 8 bytes over files of 5, 0 and 20 bytes
+	expected := [][]FileSpan{
+		{{File: 0, Offset: 0, Begin: 0, Length: 5}, {File: 2, Offset: 0, Begin: 5, Length: 3}},
+		{{File: 2, Offset: 3, Begin: 0, Length: 8}},
+		{{File: 2, Offset: 11, Begin: 0, Length: 8}},
+		{{File: 2, Offset: 19, Begin: 0, Length: 1}},
+	}
+	for i, exp := range expected {
+		if spans := m.PieceSpans(i); !reflect.DeepEqual(spans, exp) {
+			t.Errorf("Piece %d: expected %v, got %v", i, exp, spans)
+		}
+	}
+
+	single := MetaInfo{Info: InfoDict{Name: "file", Length: 10, PieceLen: 8}}
+	if files := single.FileList(); len(files) != 1 || files[0].Path[0] != "file" || files[0].Length != 10 {
+		t.Errorf("Wrong single file: %v", files)
+	}
 }
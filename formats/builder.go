@@ -0,0 +1,162 @@
+package formats
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	minPieceLen    = BLOCK_LEN
+	maxPieceLen    = 16 << 20 // 16 MiB
+	targetNumPiece = 1500
+)
+
+// Builder makes the MetaInfo of a new torrent out of a file or a directory
+type Builder struct {
+	path string
+
+	PieceLen     int // chosen from the size of the content if zero
+	Announce     string
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // now, if zero
+	Private      bool
+	Workers      int // number of pieces hashed in parallel. the number of cpus if zero
+}
+
+func NewBuilder(path string) *Builder {
+	return &Builder{
+		path: path,
+	}
+}
+
+// PieceLenFor chooses a piece length for content of `size` bytes: the smallest power of two that
+// keeps the number of pieces around `targetNumPiece`, within 16 KiB and 16 MiB
+func PieceLenFor(size int) int {
+	pl := minPieceLen
+	for pl < maxPieceLen && size/pl > targetNumPiece {
+		pl *= 2
+	}
+	return pl
+}
+
+// Build walks the file or directory and hashes its pieces.
+// files in a directory are ordered by their path, and anything that is not a regular file is left out
+func (b *Builder) Build() (*MetaInfo, error) {
+	if b.PieceLen != 0 && (b.PieceLen < minPieceLen || b.PieceLen&(b.PieceLen-1) != 0) {
+		return nil, fmt.Errorf("Invalid piece length %d. it is a power of two of at least %d", b.PieceLen, minPieceLen)
+	}
+	stat, err := os.Stat(b.path)
+	if err != nil {
+		return nil, err
+	}
+	m := &MetaInfo{
+		Announce:     b.Announce,
+		AnounceList:  b.AnnounceList,
+		Comment:      b.Comment,
+		CreatedBy:    b.CreatedBy,
+		CreationDate: b.CreationDate,
+	}
+	if m.CreationDate.IsZero() {
+		m.CreationDate = time.Now()
+	}
+	m.Info.Name = stat.Name()
+	m.Info.Private = b.Private
+
+	// the paths on disk of the files, in the order of `FileList`
+	var paths []string
+	if !stat.IsDir() {
+		m.Info.Length = int(stat.Size())
+		paths = []string{b.path}
+	} else {
+		err := filepath.WalkDir(b.path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(b.path, p)
+			if err != nil {
+				return err
+			}
+			m.Info.Files = append(m.Info.Files, Info{
+				Length: int(info.Size()),
+				Path:   splitPath(rel),
+			})
+			paths = append(paths, p)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("No files in %s", b.path)
+		}
+	}
+
+	m.Info.PieceLen = b.PieceLen
+	if m.Info.PieceLen == 0 {
+		m.Info.PieceLen = PieceLenFor(m.Size())
+	}
+	if err := b.hashPieces(m, paths); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func splitPath(p string) []string {
+	dir, file := filepath.Split(p)
+	if dir == "" {
+		return []string{file}
+	}
+	return append(splitPath(filepath.Clean(dir)), file)
+}
+
+// hashPieces fills `PiecesHash`, reading and hashing many pieces at once
+func (b *Builder) hashPieces(m *MetaInfo, paths []string) error {
+	files := make([]*os.File, len(paths))
+	for i, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		files[i] = f
+	}
+
+	numPieces := (m.Size() + m.Info.PieceLen - 1) / m.Info.PieceLen
+	m.Info.PiecesHash = make([]Sha1, numPieces)
+	workers := b.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	g := new(errgroup.Group)
+	g.SetLimit(workers)
+	for i := 0; i < numPieces; i++ {
+		i := i
+		g.Go(func() error {
+			buf := make([]byte, m.PieceLen(i))
+			for _, span := range m.PieceSpans(i) {
+				if _, err := files[span.File].ReadAt(buf[span.Begin:span.Begin+span.Length], int64(span.Offset)); err != nil {
+					return fmt.Errorf("Could not read piece %d: %w", i, err)
+				}
+			}
+			m.Info.PiecesHash[i] = sha1.Sum(buf)
+			return nil
+		})
+	}
+	return g.Wait()
+}
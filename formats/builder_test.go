@@ -0,0 +1,131 @@
+package formats
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuilderDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "release")
+	files := map[string]string{
+		"b.txt":         strings.Repeat("b", 25000),
+		"sub/a.bin":     strings.Repeat("a", 10000),
+		"sub/deep/c.go": strings.Repeat("c", 9000),
+	}
+	var all []byte // the contents in the order the builder should put them: by path
+	for _, p := range []string{"b.txt", "sub/a.bin", "sub/deep/c.go"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, p), []byte(files[p]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, files[p]...)
+	}
+
+	b := NewBuilder(dir)
+	b.PieceLen = BLOCK_LEN
+	b.Announce = "udp://tracker:6969"
+	b.AnnounceList = [][]string{{"udp://tracker:6969"}, {"http://backup/announce"}}
+	b.CreatedBy = "odor"
+	b.CreationDate = time.Unix(1662000000, 0)
+	b.Private = true
+	b.Workers = 2
+	m, err := b.Build()
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if m.Info.Name != "release" || !m.Info.IsDir() || m.Size() != len(all) {
+		t.Fatalf("Wrong info dict: %+v", m.Info)
+	}
+	expectedFiles := []Info{
+		{Length: 25000, Path: []string{"b.txt"}},
+		{Length: 10000, Path: []string{"sub", "a.bin"}},
+		{Length: 9000, Path: []string{"sub", "deep", "c.go"}},
+	}
+	if !reflect.DeepEqual(m.Info.Files, expectedFiles) {
+		t.Errorf("Expected files: %v, got %v", expectedFiles, m.Info.Files)
+	}
+	if len(m.Info.PiecesHash) != 3 {
+		t.Fatalf("Expected 3 pieces, got %d", len(m.Info.PiecesHash))
+	}
+	for i := range m.Info.PiecesHash {
+		start, end := m.PieceBounds(i)
+		if Sha1(sha1.Sum(all[start:end])) != m.Info.PiecesHash[i] {
+			t.Errorf("Wrong hash for piece %d", i)
+		}
+	}
+
+	// what it makes must be canonical and decode to the same thing
+	torr, err := Marshall(m)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := Validate(bytes.NewReader(torr)); err != nil {
+		t.Errorf("Not canonical: %s", err)
+	}
+	var out MetaInfo
+	if err := Unmarshall(torr, &out); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	out.RawInfo = nil
+	if !reflect.DeepEqual(*m, out) {
+		t.Errorf("Expected: %+v, got %+v", *m, out)
+	}
+}
+
+func TestBuilderFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "file.iso")
+	content := bytes.Repeat([]byte{7}, BLOCK_LEN*3)
+	if err := os.WriteFile(p, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewBuilder(p).Build()
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if m.Info.IsDir() || m.Info.Name != "file.iso" || m.Info.Length != len(content) {
+		t.Errorf("Wrong info dict: %+v", m.Info)
+	}
+	if m.Info.PieceLen != BLOCK_LEN || len(m.Info.PiecesHash) != 3 {
+		t.Errorf("Expected 3 pieces of %d, got %d of %d", BLOCK_LEN, len(m.Info.PiecesHash), m.Info.PieceLen)
+	}
+}
+
+func TestBuilderPieceLen(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "file.iso")
+	if err := os.WriteFile(p, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, pl := range []int{-1, 1, BLOCK_LEN / 2, BLOCK_LEN + 1, 3 * BLOCK_LEN} {
+		b := NewBuilder(p)
+		b.PieceLen = pl
+		if _, err := b.Build(); err == nil {
+			t.Errorf("Piece length %d should be rejected", pl)
+		}
+	}
+	b := NewBuilder(p)
+	b.PieceLen = 4 * BLOCK_LEN
+	if m, err := b.Build(); err != nil || m.Info.PieceLen != 4*BLOCK_LEN {
+		t.Errorf("Piece length %d should be taken: %v", 4*BLOCK_LEN, err)
+	}
+}
+
+func TestPieceLenFor(t *testing.T) {
+	for size, expected := range map[int]int{
+		0:        BLOCK_LEN,
+		10 << 20: BLOCK_LEN, // 10 MiB: 16 KiB pieces make 640 of them
+		1 << 30:  1 << 20,   // 1 GiB: 1 MiB pieces make 1024
+		1 << 40:  16 << 20,
+	} {
+		if pl := PieceLenFor(size); pl != expected {
+			t.Errorf("Size %d: expected %d, got %d", size, expected, pl)
+		}
+	}
+}
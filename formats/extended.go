@@ -0,0 +1,131 @@
+package formats
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// https://www.bittorrent.org/beps/bep_0010.html
+
+// Extended is the message id of the extension protocol. the first byte of its payload is the extended message id:
+// 0 for the extended handshake, otherwise the id the receiver gave the extension in its own handshake
+const Extended MsgId = 20
+
+// ExtHandshakeId is the extended message id of the extended handshake
+const ExtHandshakeId uint8 = 0
+
+// ExtHandshake is the bencoded payload of the extended handshake
+type ExtHandshake struct {
+	M            map[string]int `benc:"m"`                       // extension names to the extended message ids the sender wants to receive them with. 0 disables one
+	V            string         `benc:"v,omitempty"`             // name and version of the client
+	P            int            `benc:"p,omitempty"`             // tcp port the sender listens on
+	Reqq         int            `benc:"reqq,omitempty"`          // number of outstanding requests the sender takes
+	YourIP       []byte         `benc:"yourip,omitempty"`        // the ip of the receiver as the sender sees it. 4 bytes for ipv4, 16 for ipv6
+	MetadataSize int            `benc:"metadata_size,omitempty"` // size of the info dict, for ut_metadata
+}
+
+// YourIPAddr gives `YourIP` as an ip, nil if it is missing or of the wrong length
+func (h ExtHandshake) YourIPAddr() net.IP {
+	if len(h.YourIP) != net.IPv4len && len(h.YourIP) != net.IPv6len {
+		return nil
+	}
+	return net.IP(h.YourIP)
+}
+
+// NewExtended creates an extended message with the extended message id `extId`
+func NewExtended(extId uint8, payload []byte) *Msg {
+	m := &Msg{}
+	m.ID = Extended
+	m.Len = 2 + len(payload)
+	m.Payload = append([]byte{extId}, payload...)
+	return m
+}
+
+// ParseExtended splits an extended message into its extended message id and the payload that follows it
+func ParseExtended(msg *Msg) (uint8, []byte, error) {
+	if msg.ID != Extended {
+		return 0, nil, fmt.Errorf("Expected %s, got ID %d", Extended, msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("Extended message without an extended message id")
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// NewExtHandshake creates the extended handshake message
+func NewExtHandshake(h ExtHandshake) (*Msg, error) {
+	b, err := Marshall(h)
+	if err != nil {
+		return nil, err
+	}
+	return NewExtended(ExtHandshakeId, b), nil
+}
+
+// ParseExtHandshake decodes the payload of an extended handshake
+func ParseExtHandshake(payload []byte) (ExtHandshake, error) {
+	var h ExtHandshake
+	if err := Unmarshall(payload, &h); err != nil {
+		return ExtHandshake{}, err
+	}
+	return h, nil
+}
+
+// https://www.bittorrent.org/beps/bep_0009.html
+
+// UT_METADATA is the name of the metadata exchange extension in the extended handshake
+const UT_METADATA = "ut_metadata"
+
+// METADATA_PIECE_LEN is the size of the pieces the info dict is sent in. the last one may be shorter
+const METADATA_PIECE_LEN = 16384
+
+type MetadataMsgType int
+
+const (
+	MetadataRequest MetadataMsgType = iota
+	MetadataData
+	MetadataReject
+)
+
+// MetadataMsg is a ut_metadata message. In a data message, the piece itself follows the bencoded dict
+type MetadataMsg struct {
+	Type      MetadataMsgType `benc:"msg_type"`
+	Piece     int             `benc:"piece"`
+	TotalSize int             `benc:"total_size,omitempty"` // size of the whole info dict, in data messages
+	Data      []byte          // not bencoded
+}
+
+// Marshall gives the payload of the extended message the ut_metadata message is sent in
+func (m MetadataMsg) Marshall() ([]byte, error) {
+	b, err := Marshall(m)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, m.Data...), nil
+}
+
+// ParseMetadataMsg decodes a ut_metadata message. Whatever follows the dict is the data of the piece
+func ParseMetadataMsg(payload []byte) (MetadataMsg, error) {
+	var m MetadataMsg
+	d := NewBencDecoder(bytes.NewReader(payload))
+	if err := d.Decode(&m); err != nil {
+		return MetadataMsg{}, err
+	}
+	switch m.Type {
+	case MetadataRequest, MetadataData, MetadataReject:
+	default:
+		return MetadataMsg{}, fmt.Errorf("Unknown ut_metadata message type %d", m.Type)
+	}
+	if m.Piece < 0 {
+		return MetadataMsg{}, fmt.Errorf("Invalid ut_metadata piece %d", m.Piece)
+	}
+	if m.Type == MetadataData {
+		m.Data = payload[d.InputOffset():]
+	}
+	return m, nil
+}
+
+// NumMetadataPieces gives the number of pieces an info dict of `size` bytes is sent in
+func NumMetadataPieces(size int) int {
+	return (size + METADATA_PIECE_LEN - 1) / METADATA_PIECE_LEN
+}
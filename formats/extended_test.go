@@ -0,0 +1,76 @@
+package formats
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestExtHandshake(t *testing.T) {
+	msg, err := NewExtHandshake(ExtHandshake{M: map[string]int{UT_METADATA: 3}, MetadataSize: 31235})
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := msg.Marshall(buf); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	read, err := ReadMessage(buf)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	id, payload, err := ParseExtended(read)
+	if err != nil || id != ExtHandshakeId {
+		t.Fatalf("Wrong extended message: %d %s", id, err)
+	}
+	if string(payload) != "d1:md11:ut_metadatai3ee13:metadata_sizei31235ee" {
+		t.Errorf("Wrong payload: %s", payload)
+	}
+	h, err := ParseExtHandshake(payload)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if h.M[UT_METADATA] != 3 || h.MetadataSize != 31235 {
+		t.Errorf("Wrong handshake: %+v", h)
+	}
+
+	h, err = ParseExtHandshake([]byte("d1:md6:ut_pexi0ee1:pi6881e4:reqqi500e1:v4:odor6:yourip4:\x7f\x00\x00\x01e"))
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if h.M["ut_pex"] != 0 || h.P != 6881 || h.Reqq != 500 || h.V != "odor" || !h.YourIPAddr().Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Wrong handshake: %+v", h)
+	}
+	if (ExtHandshake{YourIP: []byte{1, 2}}).YourIPAddr() != nil {
+		t.Errorf("Should not take an ip of the wrong length")
+	}
+}
+
+func TestMetadataMsg(t *testing.T) {
+	data := bytes.Repeat([]byte{'x'}, 100)
+	b, err := MetadataMsg{Type: MetadataData, Piece: 1, TotalSize: METADATA_PIECE_LEN + 100, Data: data}.Marshall()
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if !bytes.HasPrefix(b, []byte("d8:msg_typei1e5:piecei1e10:total_sizei16484ee")) {
+		t.Errorf("Wrong message: %s", b)
+	}
+	m, err := ParseMetadataMsg(b)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if m.Type != MetadataData || m.Piece != 1 || m.TotalSize != 16484 || !bytes.Equal(m.Data, data) {
+		t.Errorf("Wrong message: %+v", m)
+	}
+
+	m, err = ParseMetadataMsg([]byte("d8:msg_typei2e5:piecei0ee"))
+	if err != nil || m.Type != MetadataReject || m.Data != nil {
+		t.Errorf("Wrong reject: %+v %s", m, err)
+	}
+	if _, err := ParseMetadataMsg([]byte("d8:msg_typei7e5:piecei0ee")); err == nil {
+		t.Errorf("Should reject an unknown message type")
+	}
+	if NumMetadataPieces(METADATA_PIECE_LEN) != 1 || NumMetadataPieces(METADATA_PIECE_LEN+1) != 2 {
+		t.Errorf("Wrong number of pieces")
+	}
+}
@@ -0,0 +1,112 @@
+package formats
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// fast extension: https://www.bittorrent.org/beps/bep_0006.html
+
+const (
+	Suggest       MsgId = iota + 0x0D // suggest piece: <len=0005><id=13><piece index>
+	HaveAll                           // <len=0001><id=14>
+	HaveNone                          // <len=0001><id=15>
+	RejectRequest                     // <len=0013><id=16><index><begin><length>
+	AllowedFast                       // <len=0005><id=17><piece index>
+)
+
+// ALLOWED_FAST_K is the number of pieces in the allowed fast set we give a peer
+const ALLOWED_FAST_K = 10
+
+func NewHaveAll() *Msg {
+	return &Msg{ID: HaveAll, Len: 1}
+}
+
+func NewHaveNone() *Msg {
+	return &Msg{ID: HaveNone, Len: 1}
+}
+
+func NewSuggest(index uint32) *Msg {
+	return newIndexMsg(Suggest, index)
+}
+
+func NewAllowedFast(index uint32) *Msg {
+	return newIndexMsg(AllowedFast, index)
+}
+
+// NewReject tells a peer its request will not be answered
+func NewReject(ibl Ibl) *Msg {
+	m := NewRequest(ibl)
+	m.ID = RejectRequest
+	return m
+}
+
+func newIndexMsg(id MsgId, index uint32) *Msg {
+	m := &Msg{ID: id, Len: 5}
+	m.Payload = make([]byte, 4)
+	binary.BigEndian.PutUint32(m.Payload, index)
+	return m
+}
+
+// ParseIndex gets the piece index of a Have, Suggest or Allowed Fast message
+func ParseIndex(msg *Msg) (int, error) {
+	switch msg.ID {
+	case Have, Suggest, AllowedFast:
+	default:
+		return 0, fmt.Errorf("Expected a message with a piece index, got ID %d", msg.ID)
+	}
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("Payload length should be 4, but is: %d", len(msg.Payload))
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+// ParseIbl gets the block of a Request, Cancel or Reject message
+func ParseIbl(msg *Msg) (Ibl, error) {
+	switch msg.ID {
+	case Request, Cancel, RejectRequest:
+	default:
+		return Ibl{}, fmt.Errorf("Expected a message with a block, got ID %d", msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return Ibl{}, fmt.Errorf("Payload length should be 12, but is: %d", len(msg.Payload))
+	}
+	return Ibl{
+		Index:  int(binary.BigEndian.Uint32(msg.Payload[0:4])),
+		Begin:  int(binary.BigEndian.Uint32(msg.Payload[4:8])),
+		Length: int(binary.BigEndian.Uint32(msg.Payload[8:12])),
+	}, nil
+}
+
+// AllowedFastSet computes the `k` pieces a peer at `ip` may request while choked, out of `numPieces`.
+// Both ends compute the same set from the ip and the infohash, as BEP 6 lays out.
+// Only ipv4 is specified, ipv6 peers get no set
+func AllowedFastSet(ip net.IP, infoHash Sha1, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+	// the last byte is masked so peers on the same /24 get the same set
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+	set := make([]int, 0, k)
+	has := map[int]bool{}
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(numPieces))
+			if !has[index] {
+				has[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
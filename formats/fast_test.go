@@ -0,0 +1,73 @@
+package formats
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// the example of BEP 6
+	var infoHash Sha1
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+	ip := net.IPv4(80, 4, 4, 200)
+	expected := []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}
+	for _, k := range []int{7, 9} {
+		set := AllowedFastSet(ip, infoHash, 1313, k)
+		if len(set) != k {
+			t.Fatalf("Expected %d pieces, got %v", k, set)
+		}
+		for i := range set {
+			if set[i] != expected[i] {
+				t.Errorf("Expected %v, got %v", expected[:k], set)
+				break
+			}
+		}
+	}
+	if set := AllowedFastSet(ip, infoHash, 3, ALLOWED_FAST_K); len(set) != 3 {
+		t.Errorf("The set cannot be larger than the torrent: %v", set)
+	}
+	if set := AllowedFastSet(net.ParseIP("::1"), infoHash, 1313, 7); set != nil {
+		t.Errorf("No set for ipv6: %v", set)
+	}
+}
+
+func TestFastMessages(t *testing.T) {
+	buf := &bytes.Buffer{}
+	NewHaveAll().Marshall(buf)
+	if !bytes.Equal(buf.Bytes(), []byte{0, 0, 0, 1, 0x0e}) {
+		t.Errorf("Wrong Have All: % x", buf.Bytes())
+	}
+
+	buf.Reset()
+	ibl := Ibl{Index: 3, Begin: BLOCK_LEN, Length: 100}
+	if err := NewReject(ibl).Marshall(buf); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	msg, err := ReadMessage(buf)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if got, err := ParseIbl(msg); err != nil || msg.ID != RejectRequest || got != ibl {
+		t.Errorf("Wrong reject: %s %v %s", msg, got, err)
+	}
+
+	for _, m := range []*Msg{NewAllowedFast(7), NewSuggest(7), NewHave(7)} {
+		buf.Reset()
+		if err := m.Marshall(buf); err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+		msg, err := ReadMessage(buf)
+		if err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+		if i, err := ParseIndex(msg); err != nil || i != 7 || msg.ID != m.ID {
+			t.Errorf("Wrong %s: %d %s", m, i, err)
+		}
+	}
+	if _, err := ParseIndex(NewHaveAll()); err == nil {
+		t.Errorf("Have All has no index")
+	}
+}
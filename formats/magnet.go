@@ -0,0 +1,144 @@
+package formats
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet is what a magnet link tells of a torrent. Only the infohash is sure to be there.
+// web seeds, `ws`, are left out: we only download from peers
+// https://www.bittorrent.org/beps/bep_0009.html#magnet-uri-format
+type Magnet struct {
+	InfoHash   Sha1     // xt=urn:btih:<hex or base32 infohash>
+	Name       string   // dn: display name
+	Length     int      // xl: exact length in bytes, zero if not given
+	Trackers   []string // tr
+	Peers      []string // x.pe: host:port of peers to connect to directly
+	SelectOnly []int    // so: indices of the files to download (BEP 53). empty means all of them
+}
+
+// maxSelectOnly bounds the file indices `so` can hold, ranges included, as links come from anyone
+const maxSelectOnly = 1 << 16
+
+// ParseMagnet parses a magnet uri: `magnet:?xt=urn:btih:...&dn=...&tr=...`
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("Not a magnet link: %s", uri)
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	m := &Magnet{}
+	found := false
+	for key, values := range q {
+		// an exact topic may be numbered if there are many: xt.1, xt.2
+		if key != "xt" && !strings.HasPrefix(key, "xt.") {
+			continue
+		}
+		for _, xt := range values {
+			if !strings.HasPrefix(xt, "urn:btih:") {
+				continue
+			}
+			if m.InfoHash, err = parseBtih(strings.TrimPrefix(xt, "urn:btih:")); err != nil {
+				return nil, err
+			}
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Magnet link has no urn:btih exact topic: %s", uri)
+	}
+	m.Name = q.Get("dn")
+	if xl := q.Get("xl"); xl != "" {
+		if m.Length, err = strconv.Atoi(xl); err != nil {
+			return nil, fmt.Errorf("Invalid exact length %q in magnet link", xl)
+		}
+	}
+	m.Trackers = q["tr"]
+	m.Peers = q["x.pe"]
+	if so := q.Get("so"); so != "" {
+		if m.SelectOnly, err = parseSelectOnly(so); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// parseBtih decodes an infohash written as 40 hex digits, or as 32 base32 characters
+func parseBtih(s string) (Sha1, error) {
+	var h Sha1
+	var b []byte
+	var err error
+	switch len(s) {
+	case 40:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return h, fmt.Errorf("Invalid infohash %q in magnet link", s)
+	}
+	if err != nil {
+		return h, fmt.Errorf("Invalid infohash %q in magnet link: %w", s, err)
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// parseSelectOnly parses the file indices of `so`: a comma-separated list of indices and inclusive ranges, e.g. `0,2,4-6`
+func parseSelectOnly(so string) ([]int, error) {
+	var indices []int
+	for _, part := range strings.Split(so, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(first)
+		if err != nil || from < 0 {
+			return nil, fmt.Errorf("Invalid file index %q in magnet link", part)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(last); err != nil || to < from {
+				return nil, fmt.Errorf("Invalid file range %q in magnet link", part)
+			}
+		}
+		if to-from >= maxSelectOnly-len(indices) {
+			return nil, fmt.Errorf("Too many file indices in magnet link. at most %d are taken", maxSelectOnly)
+		}
+		for i := from; i <= to; i++ {
+			indices = append(indices, i)
+		}
+	}
+	return indices, nil
+}
+
+// String gives back a magnet link with the infohash in hex
+func (m *Magnet) String() string {
+	q := url.Values{}
+	if m.Name != "" {
+		q.Set("dn", m.Name)
+	}
+	if m.Length > 0 {
+		q.Set("xl", strconv.Itoa(m.Length))
+	}
+	q["tr"] = m.Trackers
+	q["x.pe"] = m.Peers
+	if len(m.SelectOnly) > 0 {
+		so := make([]string, len(m.SelectOnly))
+		for i, index := range m.SelectOnly {
+			so[i] = strconv.Itoa(index)
+		}
+		q.Set("so", strings.Join(so, ","))
+	}
+	s := "magnet:?xt=urn:btih:" + hex.EncodeToString(m.InfoHash[:])
+	if enc := q.Encode(); enc != "" {
+		s += "&" + enc
+	}
+	return s
+}
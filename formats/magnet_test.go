@@ -0,0 +1,64 @@
+package formats
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hexHash := "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+	var expectedHash Sha1
+	hex.Decode(expectedHash[:], []byte(hexHash))
+
+	uri := "magnet:?xt=urn:btih:" + hexHash + "&dn=build+42.iso&xl=1024" +
+		"&tr=udp%3A%2F%2Ftracker.example%3A6969&tr=http%3A%2F%2Fbackup.example%2Fannounce" +
+		"&ws=http%3A%2F%2Fmirror.example%2Fbuild.iso&x.pe=10.0.0.2%3A6881&x.pe=%5B%3A%3A1%5D%3A6882&so=0,2,4-6"
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	expected := &Magnet{
+		InfoHash:   expectedHash,
+		Name:       "build 42.iso",
+		Length:     1024,
+		Trackers:   []string{"udp://tracker.example:6969", "http://backup.example/announce"},
+		Peers:      []string{"10.0.0.2:6881", "[::1]:6882"},
+		SelectOnly: []int{0, 2, 4, 5, 6},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected: %+v, got %+v", expected, m)
+	}
+
+	// the same infohash in base32
+	b32, err := ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if b32.InfoHash != expectedHash {
+		t.Errorf("Expected % x, got % x", expectedHash, b32.InfoHash)
+	}
+
+	// parsing what String gives back yields the same magnet
+	again, err := ParseMagnet(m.String())
+	if err != nil || !reflect.DeepEqual(again, m) {
+		t.Errorf("Expected: %+v, got %+v: %v", m, again, err)
+	}
+}
+
+func TestParseMagnetInvalid(t *testing.T) {
+	for _, uri := range []string{
+		"http://example.com/?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"magnet:?dn=nothing",
+		"magnet:?xt=urn:btih:c12fe1",
+		"magnet:?xt=urn:btih:z12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=3-1",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=0-999999999999",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=0-9223372036854775807",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=0-60000,70000-80000",
+	} {
+		if _, err := ParseMagnet(uri); err == nil {
+			t.Errorf("%s should not parse", uri)
+		}
+	}
+}
@@ -48,6 +48,18 @@ func (m MsgId) String() string {
 		return "8"
 	case Port:
 		return "9"
+	case Suggest:
+		return "13"
+	case HaveAll:
+		return "14"
+	case HaveNone:
+		return "15"
+	case RejectRequest:
+		return "16"
+	case AllowedFast:
+		return "17"
+	case Extended:
+		return "20"
 	default:
 		return "10"
 	}
@@ -85,6 +97,18 @@ func (m Msg) String() string {
 		return "Port {Id: 9}"
 	case KepAlive:
 		return "KeepAlive"
+	case Suggest:
+		return "Suggest {Id: 13}"
+	case HaveAll:
+		return "HaveAll {Id: 14}"
+	case HaveNone:
+		return "HaveNone {Id: 15}"
+	case RejectRequest:
+		return "RejectRequest {Id: 16}"
+	case AllowedFast:
+		return "AllowedFast {Id: 17}"
+	case Extended:
+		return "Extended {Id: 20}"
 	default:
 		return "Unknown"
 	}
@@ -126,7 +150,7 @@ type Payload struct {
 // Marshall marshalls any constructed message into a writer. The type of message, specified by the `ID` determines how it is marshalled
 func (m *Msg) Marshall(w io.Writer) error {
 	switch m.ID {
-	case Choke | Unchoke | Interested | Uninterested: // <len=0001><id=x>
+	case Choke, Unchoke, Interested, Uninterested, HaveAll, HaveNone: // <len=0001><id=x>
 		{
 			//length
 			b := make([]byte, 5)
@@ -135,15 +159,15 @@ func (m *Msg) Marshall(w io.Writer) error {
 			_, err := w.Write(b)
 			return err
 		}
-	case Have: // have: <len=0005><id=4><piece index>
+	case Have, Suggest, AllowedFast: // have: <len=0005><id=4><piece index>
 		{
+			if len(m.Payload) != 4 {
+				return fmt.Errorf("%s's payload should be four bytes long", m)
+			}
 			b := make([]byte, 9)
 			binary.BigEndian.PutUint32(b[:4], uint32(5))
 			b[4] = uint8(m.ID)
-			n := copy(b[4:], m.Payload)
-			if n != 4 {
-				return fmt.Errorf("`Have`s payload should be four bytes long")
-			}
+			copy(b[5:], m.Payload)
 			if _, err := w.Write(b); err != nil {
 				return err
 			}
@@ -160,7 +184,7 @@ func (m *Msg) Marshall(w io.Writer) error {
 				return err
 			}
 		}
-	case Request: // request: <len=0013><id=6><index><begin><length>
+	case Request, RejectRequest: // request: <len=0013><id=6><index><begin><length>
 		{
 			buf := make([]byte, 17)
 			binary.BigEndian.PutUint32(buf[:4], 13)
@@ -171,7 +195,7 @@ func (m *Msg) Marshall(w io.Writer) error {
 				return err
 			}
 		}
-	case Piece: // piece: <len=0009+X><id=7><index><begin><block>
+	case Piece, Extended: // piece: <len=0009+X><id=7><index><begin><block>, extended: <len=0002+X><id=20><extended id><payload>
 		{
 			l := len(m.Payload) + 1
 			buf := make([]byte, l+4)
@@ -283,6 +307,17 @@ func NewHave(pieceIndex uint32) *Msg {
 	m.Len = 5
 	p := make([]byte, 4)
 	binary.BigEndian.PutUint32(p, pieceIndex)
+	m.Payload = p
+	return m
+}
+
+// NewPort tells a peer the udp port our DHT node listens on
+func NewPort(port uint16) *Msg {
+	m := &Msg{}
+	m.ID = Port
+	m.Len = 3
+	m.Payload = make([]byte, 2)
+	binary.BigEndian.PutUint16(m.Payload, port)
 	return m
 }
 
@@ -338,15 +373,15 @@ func ParsePieceMsg(msg *Msg) (PieceMsg, error) {
 	return PieceMsg{Index: (index), Begin: begin, Block: buf}, nil
 }
 
-// NewPieceMMsg creates a new marshallable `Msg` from
+// NewPieceMMsg creates a new marshallable `Msg` from a block of a piece
 func NewPieceMMsg(p PieceMsg) *Msg {
 	m := &Msg{}
-	m.ID = Request
+	m.ID = Piece
 	m.Len = 9 + len(p.Block)
 	payload := make([]byte, 8+len(p.Block))
 	binary.BigEndian.PutUint32(payload[0:4], p.Index)
 	binary.BigEndian.PutUint32(payload[4:8], p.Begin)
-	copy(payload, p.Block)
+	copy(payload[8:], p.Block)
 	m.Payload = payload
 	return m
 }
@@ -12,34 +12,73 @@ import (
 const BLOCK_LEN int = 16384
 
 type MetaInfo struct {
-	Info     InfoDict
-	Announce string // url of the tracker
+	Info     InfoDict   `benc:"info"`
+	RawInfo  RawMessage `benc:"info"`     // the info dict exactly as it was read. it is what the infohash is computed from
+	Announce string     `benc:"announce"` // url of the tracker
 
 	//optionals
-	AnounceList  []string
-	CreationDate time.Time
-	Comment      string
-	CreatedBy    string
-	Encoding     string
+	AnounceList  [][]string `benc:"announce-list,omitempty"` // tiers of tracker urls
+	CreationDate time.Time  `benc:"creation date,omitempty"`
+	Comment      string     `benc:"comment,omitempty"`
+	CreatedBy    string     `benc:"created by,omitempty"`
+	Encoding     string     `benc:"encoding,omitempty"`
+
+	Signatures map[string]Signature `benc:"signatures,omitempty"` // signatures of the info dict, by signer
 }
 
 // InfoDict describes the files of the torrent
 type InfoDict struct {
-	PieceLen   int    // piece length. number of bytes in each piece
-	PiecesHash []Sha1 //muiltiple of twenty. SHAs of the piece at the corresponding index. byte string
-	Name       string //name of file in single file mode, name of directory in directory mode
+	PieceLen   int    `benc:"piece length"` // piece length. number of bytes in each piece
+	PiecesHash []Sha1 `benc:"pieces"`       //muiltiple of twenty. SHAs of the piece at the corresponding index. byte string
+	Name       string `benc:"name"`         //name of file in single file mode, name of directory in directory mode
+
+	Private bool `benc:"private,omitempty"` //optional
 
-	private bool //optional
-	isDir   bool //specifies whether it is single-file mode or directory
+	// single-file mode only
+	Length int    `benc:"length,omitempty"`
+	MD5sum string `benc:"md5sum,omitempty"`
 
-	Files []Info // if single-file mode, the slice will contain one item
+	Files []Info `benc:"files,omitempty"` // directory mode only
 
 }
 
 type Info struct {
-	Length int //length of the file in bytes
-	MD5sum string
-	Path   string //name of the file if it is a single file. name of the directory if it is a directory
+	Length int      `benc:"length"` //length of the file in bytes
+	MD5sum string   `benc:"md5sum,omitempty"`
+	Path   []string `benc:"path"` // path of the file under the torrent's directory, one component for each subdirectory and the last for the file name
+}
+
+// IsDir specifies whether it is single-file mode or directory
+func (i InfoDict) IsDir() bool {
+	return len(i.Files) > 0
+}
+
+// Validate checks what the rest of the code relies on: a positive piece length, no negative length and a hash for
+// each piece of the content. a torrent from a file or from peers is checked before any use
+func (i InfoDict) Validate() error {
+	if i.PieceLen <= 0 {
+		return fmt.Errorf("Invalid piece length %d", i.PieceLen)
+	}
+	size := i.Length
+	if size < 0 {
+		return fmt.Errorf("Invalid length %d", size)
+	}
+	if i.IsDir() {
+		size = 0
+		for _, f := range i.Files {
+			if f.Length < 0 || size+f.Length < size {
+				return fmt.Errorf("Invalid length %d of file %v", f.Length, f.Path)
+			}
+			if len(f.Path) == 0 {
+				return fmt.Errorf("File without a path")
+			}
+			size += f.Length
+		}
+	}
+	if n := size/i.PieceLen + (size%i.PieceLen+i.PieceLen-1)/i.PieceLen; len(i.PiecesHash) != n {
+		return fmt.Errorf("Expected %d piece hashes for %d bytes in pieces of %d, got %d", n, size, i.PieceLen, len(i.PiecesHash))
+	}
+	return nil
 }
 
 func (m MetaInfo) String() string {
@@ -49,10 +88,14 @@ func (m MetaInfo) String() string {
 	)
 }
 
+// GetInfoHash computes the infohash: the sha1 hash of the bencoded info dict.
+// if the MetaInfo was decoded, the raw bytes of the dict are hashed, so keys unknown to `InfoDict` still count.
+// otherwise (e.g. a MetaInfo we're building) `Info` is encoded
 func (m MetaInfo) GetInfoHash() (Sha1, error) {
 	h := sha1.New()
-	benc := NewBencoder(h)
-	if err := benc.Encode(m.Info); err != nil {
+	if len(m.RawInfo) > 0 {
+		h.Write(m.RawInfo)
+	} else if err := NewBencoder(h).Encode(m.Info); err != nil {
 		return Sha1{}, err
 	}
 	sharr := *(*[20]byte)(h.Sum(nil))
@@ -63,9 +106,8 @@ func (m MetaInfo) GetInfoHash() (Sha1, error) {
 // Size gives the total size (in bytes) of the torrent, whether its a single file or not
 func (m MetaInfo) Size() int {
 	var size int
-	// comeback to ensure that isDir is set properly during decoding
-	if !m.Info.isDir {
-		return m.Info.Files[0].Length
+	if !m.Info.IsDir() {
+		return m.Info.Length
 	}
 
 	for _, s := range m.Info.Files {
@@ -113,3 +155,46 @@ func (m MetaInfo) NumBlocksInPiece(index int) int {
 	}
 	return pLen / BLOCK_LEN
 }
+
+// FileList gives the files of the torrent in the order their data comes in the pieces.
+// in single-file mode, it is the one file, named after the torrent
+func (m MetaInfo) FileList() []Info {
+	if !m.Info.IsDir() {
+		return []Info{{Length: m.Info.Length, MD5sum: m.Info.MD5sum, Path: []string{m.Info.Name}}}
+	}
+	return m.Info.Files
+}
+
+// FileSpan is the part of a piece that falls within one file
+type FileSpan struct {
+	File   int // index of the file in `FileList`
+	Offset int // where the span begins in the file
+	Begin  int // where the span begins in the piece
+	Length int
+}
+
+// PieceSpans maps a piece onto the files it covers, in order. A piece can begin in one file and end in another,
+// so long as the files are in between, possibly covering many small files
+func (m MetaInfo) PieceSpans(index int) []FileSpan {
+	start, end := m.PieceBounds(index)
+	spans := []FileSpan{}
+	fileStart := 0
+	for i, f := range m.FileList() {
+		fileEnd := fileStart + f.Length
+		if f.Length > 0 && fileEnd > start && fileStart < end { // empty files hold no piece data
+			s, e := fileStart, fileEnd
+			if s < start {
+				s = start
+			}
+			if e > end {
+				e = end
+			}
+			spans = append(spans, FileSpan{File: i, Offset: s - fileStart, Begin: s - start, Length: e - s})
+		}
+		if fileEnd >= end {
+			break
+		}
+		fileStart = fileEnd
+	}
+	return spans
+}
@@ -0,0 +1,32 @@
+package formats
+
+import "testing"
+
+func TestInfoDictValidate(t *testing.T) {
+	hashes := make([]Sha1, 3)
+	valid := []InfoDict{
+		{PieceLen: 4, Length: 10, PiecesHash: hashes},
+		{PieceLen: 5, Length: 15, PiecesHash: hashes},
+		{PieceLen: 4, Files: []Info{{Length: 6, Path: []string{"a"}}, {Length: 0, Path: []string{"b"}}, {Length: 3, Path: []string{"c"}}}, PiecesHash: hashes},
+		{PieceLen: 4},
+	}
+	for _, i := range valid {
+		if err := i.Validate(); err != nil {
+			t.Errorf("%+v should be valid: %s", i, err)
+		}
+	}
+	invalid := []InfoDict{
+		{Length: 10, PiecesHash: hashes},
+		{PieceLen: -4, Length: 10, PiecesHash: hashes},
+		{PieceLen: 4, Length: -10, PiecesHash: hashes},
+		{PieceLen: 4, Length: 13, PiecesHash: hashes},
+		{PieceLen: 4, Length: 8, PiecesHash: hashes},
+		{PieceLen: 4, Files: []Info{{Length: 20, Path: []string{"a"}}, {Length: -10, Path: []string{"b"}}}, PiecesHash: hashes},
+		{PieceLen: 4, Files: []Info{{Length: 10}}, PiecesHash: hashes},
+	}
+	for _, i := range invalid {
+		if err := i.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", i)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package formats
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// CompactAddr is the address of a peer as trackers, PEX and the DHT send it: the ip then the port, big endian.
+// 6 bytes for ipv4, 18 for ipv6
+type CompactAddr struct {
+	IP   net.IP
+	Port uint16
+}
+
+// Marshall gives the compact form of the address, 6 or 18 bytes long depending on the ip
+func (a CompactAddr) Marshall() []byte {
+	ip := a.IP.To4()
+	if ip == nil {
+		ip = a.IP.To16()
+	}
+	b := make([]byte, len(ip)+2)
+	copy(b, ip)
+	binary.BigEndian.PutUint16(b[len(ip):], a.Port)
+	return b
+}
+
+// ParseCompactAddrs splits a string of compact addresses. ipLen is 4 for ipv4 addresses, 16 for ipv6
+func ParseCompactAddrs(b []byte, ipLen int) ([]CompactAddr, error) {
+	l := ipLen + 2
+	if len(b)%l != 0 {
+		return nil, fmt.Errorf("Compact addresses should be a multiple of %d bytes long, got %d", l, len(b))
+	}
+	addrs := make([]CompactAddr, 0, len(b)/l)
+	for i := 0; i < len(b); i += l {
+		ip := make(net.IP, ipLen)
+		copy(ip, b[i:i+ipLen])
+		addrs = append(addrs, CompactAddr{IP: ip, Port: binary.BigEndian.Uint16(b[i+ipLen : i+l])})
+	}
+	return addrs, nil
+}
+
+// https://www.bittorrent.org/beps/bep_0011.html
+
+// UT_PEX is the name of the peer exchange extension in the extended handshake
+const UT_PEX = "ut_pex"
+
+// MAX_PEX_PEERS is the most peers a PEX message should add, and the most it should drop
+const MAX_PEX_PEERS = 50
+
+// flags of the peers a PEX message adds
+const (
+	PexEncryption  byte = 0x01 // prefers encryption
+	PexSeed        byte = 0x02 // is a seed, or uploads only
+	PexUTP         byte = 0x04 // supports uTP
+	PexHolepunch   byte = 0x08 // supports the holepunch extension
+	PexConnectable byte = 0x10 // takes incoming connections
+)
+
+// PexPeer is a peer a PEX message tells of
+type PexPeer struct {
+	Addr  CompactAddr
+	Flags byte // the Pex* flags, only for added peers
+}
+
+// PexMsg is the payload of a ut_pex message: the peers connected to since the last message, and those dropped.
+// each address family has its own keys, the flags of the added peers are one byte each, in the same order
+type PexMsg struct {
+	Added    []byte `benc:"added"`
+	AddedF   []byte `benc:"added.f"`
+	Dropped  []byte `benc:"dropped"`
+	Added6   []byte `benc:"added6,omitempty"`
+	Added6F  []byte `benc:"added6.f,omitempty"`
+	Dropped6 []byte `benc:"dropped6,omitempty"`
+}
+
+// NewPexMsg puts the peers into a PEX message, ipv4 and ipv6 apart
+func NewPexMsg(added, dropped []PexPeer) PexMsg {
+	var m PexMsg
+	for _, p := range added {
+		if p.Addr.IP.To4() != nil {
+			m.Added = append(m.Added, p.Addr.Marshall()...)
+			m.AddedF = append(m.AddedF, p.Flags)
+		} else {
+			m.Added6 = append(m.Added6, p.Addr.Marshall()...)
+			m.Added6F = append(m.Added6F, p.Flags)
+		}
+	}
+	for _, p := range dropped {
+		if p.Addr.IP.To4() != nil {
+			m.Dropped = append(m.Dropped, p.Addr.Marshall()...)
+		} else {
+			m.Dropped6 = append(m.Dropped6, p.Addr.Marshall()...)
+		}
+	}
+	return m
+}
+
+// Peers gives the added and dropped peers of the message. missing flags are taken to be zero
+func (m PexMsg) Peers() ([]PexPeer, []PexPeer, error) {
+	var added, dropped []PexPeer
+	for _, fam := range []struct {
+		added, flags, dropped []byte
+		ipLen                 int
+	}{{m.Added, m.AddedF, m.Dropped, net.IPv4len}, {m.Added6, m.Added6F, m.Dropped6, net.IPv6len}} {
+		addrs, err := ParseCompactAddrs(fam.added, fam.ipLen)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, a := range addrs {
+			p := PexPeer{Addr: a}
+			if i < len(fam.flags) {
+				p.Flags = fam.flags[i]
+			}
+			added = append(added, p)
+		}
+		if addrs, err = ParseCompactAddrs(fam.dropped, fam.ipLen); err != nil {
+			return nil, nil, err
+		}
+		for _, a := range addrs {
+			dropped = append(dropped, PexPeer{Addr: a})
+		}
+	}
+	return added, dropped, nil
+}
@@ -0,0 +1,59 @@
+package formats
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestCompactAddrs(t *testing.T) {
+	b := append(CompactAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}.Marshall(), CompactAddr{IP: net.IPv4(10, 0, 0, 2), Port: 80}.Marshall()...)
+	if !bytes.Equal(b[:6], []byte{10, 0, 0, 1, 0x1a, 0xe1}) {
+		t.Errorf("Wrong compact address: % x", b[:6])
+	}
+	addrs, err := ParseCompactAddrs(b, net.IPv4len)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if len(addrs) != 2 || !addrs[1].IP.Equal(net.IPv4(10, 0, 0, 2)) || addrs[1].Port != 80 {
+		t.Errorf("Wrong addresses: %v", addrs)
+	}
+	if _, err := ParseCompactAddrs(b[:7], net.IPv4len); err == nil {
+		t.Errorf("Should reject a truncated address")
+	}
+	if l := len((CompactAddr{IP: net.ParseIP("::1"), Port: 1}).Marshall()); l != 18 {
+		t.Errorf("Wrong ipv6 compact length %d", l)
+	}
+}
+
+func TestPexMsg(t *testing.T) {
+	added := []PexPeer{
+		{Addr: CompactAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, Flags: PexSeed | PexConnectable},
+		{Addr: CompactAddr{IP: net.ParseIP("2001:db8::1"), Port: 6882}, Flags: PexUTP},
+	}
+	dropped := []PexPeer{{Addr: CompactAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1}}}
+	b, err := Marshall(NewPexMsg(added, dropped))
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	var m PexMsg
+	if err := Unmarshall(b, &m); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	gotAdded, gotDropped, err := m.Peers()
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if len(gotAdded) != 2 || gotAdded[0].Flags != PexSeed|PexConnectable || !gotAdded[1].Addr.IP.Equal(added[1].Addr.IP) || gotAdded[1].Flags != PexUTP {
+		t.Errorf("Wrong added peers: %v", gotAdded)
+	}
+	if len(gotDropped) != 1 || gotDropped[0].Addr.Port != 1 {
+		t.Errorf("Wrong dropped peers: %v", gotDropped)
+	}
+
+	// flags may be missing
+	m = PexMsg{Added: CompactAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}.Marshall()}
+	if gotAdded, _, err = m.Peers(); err != nil || len(gotAdded) != 1 || gotAdded[0].Flags != 0 {
+		t.Errorf("Wrong added peers: %v %s", gotAdded, err)
+	}
+}
@@ -0,0 +1,176 @@
+package formats
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// signed torrents: https://www.bittorrent.org/beps/bep_0035.html
+
+var ErrUnsigned = errors.New("Torrent is not signed")
+
+// Signature is a signature of the info dict, under the name of its signer in `signatures`
+type Signature struct {
+	Certificate []byte     `benc:"certificate,omitempty"` // DER X.509 certificate of the signer, for those who trust its issuer
+	Info        RawMessage `benc:"info,omitempty"`        // a dict the signer signed along with the info dict
+	Signature   []byte     `benc:"signature"`             // ed25519 signature
+}
+
+// signedData is what a signature is over: the info dict as it is in the torrent, then the info of the signature if any
+func (m *MetaInfo) signedData(s Signature) ([]byte, error) {
+	if len(m.RawInfo) == 0 {
+		// a torrent we're building. the bytes we sign must be the ones that get written
+		raw, err := Marshall(m.Info)
+		if err != nil {
+			return nil, err
+		}
+		m.RawInfo = raw
+	}
+	return append(append([]byte{}, m.RawInfo...), s.Info...), nil
+}
+
+// Sign signs the info dict with an ed25519 key. if the certificate of the key is given it is put along, and the
+// signer is its common name
+func (m *MetaInfo) Sign(signer string, key ed25519.PrivateKey, cert *x509.Certificate) error {
+	var s Signature
+	if cert != nil {
+		pub, ok := cert.PublicKey.(ed25519.PublicKey)
+		if !ok || !pub.Equal(key.Public()) {
+			return fmt.Errorf("Certificate of %s is not for the signing key", cert.Subject.CommonName)
+		}
+		s.Certificate = cert.Raw
+		if signer == "" {
+			signer = cert.Subject.CommonName
+		}
+	}
+	if signer == "" {
+		return fmt.Errorf("A signature needs the name of its signer")
+	}
+	data, err := m.signedData(s)
+	if err != nil {
+		return err
+	}
+	s.Signature = ed25519.Sign(key, data)
+	if m.Signatures == nil {
+		m.Signatures = map[string]Signature{}
+	}
+	m.Signatures[signer] = s
+	return nil
+}
+
+// TrustStore holds who we take signatures from: signers known by their key, and issuers of certificates
+type TrustStore struct {
+	Keys  map[string]ed25519.PublicKey
+	Roots *x509.CertPool
+}
+
+// LoadTrustStore reads the .pem files of a directory. a PUBLIC KEY is the key of the signer the file is named after,
+// e.g. `releases.pem` holds the key of `releases`. a CERTIFICATE is trusted to issue certificates of signers
+func LoadTrustStore(dir string) (*TrustStore, error) {
+	ts := &TrustStore{Keys: map[string]ed25519.PublicKey{}, Roots: x509.NewCertPool()}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			var block *pem.Block
+			block, b = pem.Decode(b)
+			if block == nil {
+				break
+			}
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err := x509.ParsePKIXPublicKey(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", p, err)
+				}
+				pub, ok := key.(ed25519.PublicKey)
+				if !ok {
+					return nil, fmt.Errorf("%s: only ed25519 keys are supported", p)
+				}
+				ts.Keys[strings.TrimSuffix(filepath.Base(p), ".pem")] = pub
+			case "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", p, err)
+				}
+				ts.Roots.AddCert(cert)
+			}
+		}
+	}
+	return ts, nil
+}
+
+// key gives the key a signature is checked against: the one the store has for the signer, or that of its certificate
+// if the store trusts its issuer
+func (ts *TrustStore) key(signer string, s Signature) (ed25519.PublicKey, error) {
+	if pub, ok := ts.Keys[signer]; ok {
+		return pub, nil
+	}
+	if len(s.Certificate) == 0 {
+		return nil, fmt.Errorf("%s is not trusted", signer)
+	}
+	cert, err := x509.ParseCertificate(s.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Subject.CommonName != signer {
+		return nil, fmt.Errorf("Certificate is for %s, not %s", cert.Subject.CommonName, signer)
+	}
+	opts := x509.VerifyOptions{Roots: ts.Roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+	if _, err := cert.Verify(opts); err != nil {
+		return nil, fmt.Errorf("Certificate of %s is not trusted: %w", signer, err)
+	}
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Certificate of %s is not for an ed25519 key", signer)
+	}
+	return pub, nil
+}
+
+// Verify checks the signatures of the torrent against the trust store. it gives the trusted signers whose signature
+// is valid, and fails if there are none. signatures of signers that are not trusted are left alone,
+// but a bad signature of a trusted signer fails the torrent
+func (m *MetaInfo) Verify(ts *TrustStore) ([]string, error) {
+	if len(m.Signatures) == 0 {
+		return nil, ErrUnsigned
+	}
+	signers := make([]string, 0, len(m.Signatures))
+	for name := range m.Signatures {
+		signers = append(signers, name)
+	}
+	sort.Strings(signers)
+	var trusted, errs []string
+	for _, name := range signers {
+		s := m.Signatures[name]
+		pub, err := ts.key(name, s)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		data, err := m.signedData(s)
+		if err != nil {
+			return nil, err
+		}
+		if !ed25519.Verify(pub, data, s.Signature) {
+			return nil, fmt.Errorf("Invalid signature of %s", name)
+		}
+		trusted = append(trusted, name)
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("No trusted signature: %s", strings.Join(errs, "; "))
+	}
+	return trusted, nil
+}
@@ -0,0 +1,133 @@
+package formats
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newCert makes a certificate of `key` for `name`, signed by `parent` with `parentKey`, or self-signed if parent is nil
+func newCert(t *testing.T, name string, key ed25519.PrivateKey, parent *x509.Certificate, parentKey ed25519.PrivateKey) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func signedTorrent(t *testing.T, sign func(m *MetaInfo) error) *MetaInfo {
+	m := &MetaInfo{Announce: "http://tracker/announce"}
+	m.Info = InfoDict{PieceLen: BLOCK_LEN, PiecesHash: []Sha1{{1}}, Name: "release.tar", Length: 100}
+	if err := sign(m); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	torr, err := Marshall(m)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	var out MetaInfo
+	if err := Unmarshall(torr, &out); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	return &out
+}
+
+func TestSignatures(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca := newCert(t, "odor ca", caKey, nil, nil)
+	cert := newCert(t, "releases", key, ca, caKey)
+
+	byKey := signedTorrent(t, func(m *MetaInfo) error { return m.Sign("releases", key, nil) })
+	byCert := signedTorrent(t, func(m *MetaInfo) error { return m.Sign("", key, cert) })
+	if s := byCert.Signatures["releases"]; len(s.Certificate) == 0 {
+		t.Fatalf("Certificate not put along: %+v", byCert.Signatures)
+	}
+
+	keys := &TrustStore{Keys: map[string]ed25519.PublicKey{"releases": key.Public().(ed25519.PublicKey)}, Roots: x509.NewCertPool()}
+	roots := &TrustStore{Roots: x509.NewCertPool()}
+	roots.Roots.AddCert(ca)
+	none := &TrustStore{Roots: x509.NewCertPool()}
+
+	for _, m := range []*MetaInfo{byKey, byCert} {
+		if signers, err := m.Verify(keys); err != nil || len(signers) != 1 || signers[0] != "releases" {
+			t.Errorf("Expected to be signed by releases, got %v, %v", signers, err)
+		}
+		if _, err := m.Verify(none); err == nil {
+			t.Errorf("Should not be trusted")
+		}
+	}
+	if _, err := byCert.Verify(roots); err != nil {
+		t.Errorf("Errored: %s", err)
+	}
+	if _, err := byKey.Verify(roots); err == nil {
+		t.Errorf("Should not be trusted without a certificate")
+	}
+
+	// the info dict is changed after signing
+	byKey.RawInfo[len(byKey.RawInfo)-2] ^= 1
+	if _, err := byKey.Verify(keys); err == nil {
+		t.Errorf("Should not verify a changed info dict")
+	}
+
+	unsigned := signedTorrent(t, func(m *MetaInfo) error { return nil })
+	if _, err := unsigned.Verify(keys); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Expected ErrUnsigned, got %v", err)
+	}
+
+	// a certificate for a key other than the signing key
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	if err := (&MetaInfo{}).Sign("", other, cert); err == nil {
+		t.Errorf("Should not sign with a certificate of another key")
+	}
+}
+
+func TestLoadTrustStore(t *testing.T) {
+	dir := t.TempDir()
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newCert(t, "odor ca", key, nil, nil)
+	if err := os.WriteFile(filepath.Join(dir, "releases.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := LoadTrustStore(dir)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if !ts.Keys["releases"].Equal(pub) || len(ts.Keys) != 1 {
+		t.Errorf("Wrong keys: %v", ts.Keys)
+	}
+	if _, err := ca.Verify(x509.VerifyOptions{Roots: ts.Roots}); err != nil {
+		t.Errorf("Certificate not in the roots: %s", err)
+	}
+}
@@ -2,4 +2,4 @@ module github.com/OLUWAMUYIWA/odor
 
 go 1.19
 
-require golang.org/x/sync v0.0.0-20220929204114-8fcdb60fdcc0 // indirect
+require golang.org/x/sync v0.0.0-20220929204114-8fcdb60fdcc0
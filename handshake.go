@@ -2,8 +2,6 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 
@@ -17,10 +15,21 @@ const Null byte = 0
 
 // pstrlen: string length of <pstr>, as a single raw byte
 // pstr: string identifier of the protocol
-// reserved: eight (8) reserved bytes. All current implementations use all zeroes.
+// reserved: eight (8) reserved bytes. each bit set tells of an extension the client supports
 // peer_id: 20-byte string used as a unique ID for the client.
 
+// reserved bits, counted from the right of the reserved bytes
+const (
+	dhtBit  = 0  // DHT (BEP 5)
+	fastBit = 2  // the fast extension (BEP 6)
+	extBit  = 20 // the extension protocol (BEP 10)
+)
+
+// supportedBits are the reserved bits we set in our handshake
+var supportedBits = []int{fastBit, extBit}
+
 type Shaker struct {
+	reserved [8]byte      // extensions the client supports
 	infoHash formats.Sha1 // 20-byte SHA1 hash of the info key from the metainfo file. generated from the `info` dictionary of the torrent file
 	peerId   [20]byte     // random 20 bytes generated to identify the client
 }
@@ -29,49 +38,62 @@ func NewShaker(infoHash, peerId [20]byte) *Shaker {
 	h := &Shaker{}
 	h.infoHash = infoHash
 	h.peerId = peerId
+	for _, bit := range supportedBits {
+		h.setBit(bit)
+	}
+	if dhtNode != nil {
+		h.setBit(dhtBit)
+	}
 
 	return h
 }
 
+func (h *Shaker) setBit(bit int) {
+	h.reserved[7-bit/8] |= 1 << uint(bit%8)
+}
+
+// HasBit reports whether a reserved bit is set, i.e. whether the client supports the extension
+func (h *Shaker) HasBit(bit int) bool {
+	return h.reserved[7-bit/8]&(1<<uint(bit%8)) != 0
+}
+
 // Marshall marshalls an handshake object into a reader that can be read from
 func (h *Shaker) Marshall() io.Reader {
 	b := &bytes.Buffer{}
-	b.Grow(49) // the spec says It is (49+len(pstr)) bytes long.
+	b.Grow(49 + len(PROTOCOL)) // the spec says It is (49+len(pstr)) bytes long.
 	// write pstr len
 	b.WriteByte(byte(len(PROTOCOL)))
 	// write pstr
 	b.WriteString(PROTOCOL)
-	// write 8 mnull bytes. reserved
-	b.Write(bytes.Repeat([]byte{Null}, 8))
+	b.Write(h.reserved[:])
 
 	b.Write(h.infoHash[:])
 	b.Write(h.peerId[:])
 	return b
 }
 
-// ParseHandShake parses an handshake from a stream of bytes
+// ParseHandShake parses an handshake from a stream of bytes. it reads exactly the handshake, the messages that follow are left in `r`
 func ParseHandShake(r io.Reader) (*Shaker, error) {
+	h := &Shaker{}
 	//pstrLen
-	var h *Shaker
-	var pstrLen uint8
-	if err := binary.Read(r, binary.BigEndian, pstrLen); err != nil {
-		return nil, err
-	}
-	all, err := io.ReadAll(r)
-	if err != nil {
+	var pstrLen [1]byte
+	if _, err := io.ReadFull(r, pstrLen[:]); err != nil {
 		return nil, err
 	}
-	if len(all) != 48+int(pstrLen) {
-		return nil, errors.New("Handshake message flawed")
+	l := int(pstrLen[0])
+	all := make([]byte, 48+l)
+	if _, err := io.ReadFull(r, all); err != nil {
+		return nil, fmt.Errorf("Handshake message flawed: %w", err)
 	}
-	pstr := string(all[:pstrLen])
+	pstr := string(all[:l])
 	if pstr != PROTOCOL {
 		return nil, fmt.Errorf("We only support: %s", PROTOCOL)
 	}
 	//then the reserved 8 bytes
+	copy(h.reserved[:], all[l:l+8])
 	// trick
-	h.infoHash = *((*[20]byte)(all[pstrLen+8 : 28+pstrLen]))
-	h.peerId = *((*[20]byte)(all[28+pstrLen : 48+pstrLen]))
+	h.infoHash = *((*[20]byte)(all[l+8 : 28+l]))
+	h.peerId = *((*[20]byte)(all[28+l : 48+l]))
 	return h, nil
 }
 
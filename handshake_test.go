@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+func TestHandShake(t *testing.T) {
+	var infoH formats.Sha1
+	infoH[0] = 0xab
+	var id [20]byte
+	h := NewShaker(infoH, id)
+	got, err := ParseHandShake(h.Marshall())
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if !got.HasBit(extBit) || got.reserved[5] != 0x10 || got.infoHash != infoH {
+		t.Errorf("Wrong handshake: % x", got.reserved)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// http tracker protocol: https://www.bittorrent.org/beps/bep_0003.html#trackers
+// compact peer lists: https://www.bittorrent.org/beps/bep_0023.html
+
+// maxTrackerResp bounds the size of a response we read from a tracker
+const maxTrackerResp = 1 << 20
+
+type HTTPTClient struct {
+	announce  string
+	client    *http.Client
+	trackerId string // given by the tracker on an announce, and sent back on the ones after
+}
+
+func NewHTTPTClient(announce string) *HTTPTClient {
+	return &HTTPTClient{
+		announce: announce,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// httpAnnounceResp is the bencoded dict of an announce response
+type httpAnnounceResp struct {
+	FailureReason string             `benc:"failure reason,omitempty"`
+	Warning       string             `benc:"warning message,omitempty"`
+	Interval      int                `benc:"interval,omitempty"`
+	MinInterval   int                `benc:"min interval,omitempty"`
+	TrackerId     string             `benc:"tracker id,omitempty"`
+	Complete      int                `benc:"complete,omitempty"`
+	Incomplete    int                `benc:"incomplete,omitempty"`
+	Peers         formats.RawMessage `benc:"peers,omitempty"` // a compact string, or a list of dicts
+	Peers6        []byte             `benc:"peers6,omitempty"`
+}
+
+// httpPeer is a peer of a non compact response
+type httpPeer struct {
+	PeerId string `benc:"peer id,omitempty"`
+	IP     string `benc:"ip"` // an ipv4 or ipv6 address, or a dns name
+	Port   int    `benc:"port"`
+}
+
+// escape url-encodes every byte that is not unreserved. binary values like the infohash are sent as is
+func escape(b []byte) string {
+	var s strings.Builder
+	for _, c := range b {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			s.WriteByte(c)
+		} else {
+			fmt.Fprintf(&s, "%%%02X", c)
+		}
+	}
+	return s.String()
+}
+
+// announceURL adds the query of an announce to the url of the tracker, which may have a query of its own
+func (client *HTTPTClient) announceURL(req AnnounceReq) string {
+	q := []string{
+		"info_hash=" + escape(req.InfoHash[:]),
+		"peer_id=" + escape(req.PeerId[:]),
+		"port=" + strconv.Itoa(int(req.Port)),
+		"uploaded=" + strconv.FormatInt(req.Uploaded, 10),
+		"downloaded=" + strconv.FormatInt(req.Downloaded, 10),
+		"left=" + strconv.FormatInt(req.Left, 10),
+		"compact=1",
+		"key=" + strconv.FormatUint(uint64(req.Key), 16),
+	}
+	if req.Event != EventNone {
+		q = append(q, "event="+req.Event.String())
+	}
+	if req.NumWant >= 0 {
+		q = append(q, "numwant="+strconv.Itoa(req.NumWant))
+	}
+	if client.trackerId != "" {
+		q = append(q, "trackerid="+escape([]byte(client.trackerId)))
+	}
+	sep := "?"
+	if strings.Contains(client.announce, "?") {
+		sep = "&"
+	}
+	return client.announce + sep + strings.Join(q, "&")
+}
+
+// Announce announces to the tracker. a failure reason of the tracker is a *TrackerError,
+// a warning message is given with the response
+func (client *HTTPTClient) Announce(ctx context.Context, req AnnounceReq) (*AnnounceResp, error) {
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, client.announceURL(req), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTrackerResp))
+	if err != nil {
+		return nil, err
+	}
+	var r httpAnnounceResp
+	if err := formats.Unmarshall(body, &r); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Tracker responded with %s", resp.Status)
+		}
+		return nil, fmt.Errorf("Error parsing announce response: %w", err)
+	}
+	if r.FailureReason != "" {
+		return nil, &TrackerError{Reason: r.FailureReason}
+	}
+	if r.TrackerId != "" {
+		client.trackerId = r.TrackerId
+	}
+	a := &AnnounceResp{
+		interval:    uint32(r.Interval),
+		minInterval: uint32(r.MinInterval),
+		leechers:    uint32(r.Incomplete),
+		seeders:     uint32(r.Complete),
+		warning:     r.Warning,
+	}
+	if a.socks, err = parseHTTPPeers(r.Peers); err != nil {
+		return nil, err
+	}
+	if len(r.Peers6) > 0 {
+		addrs, err := formats.ParseCompactAddrs(r.Peers6, net.IPv6len)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			a.socks = append(a.socks, PeerAddr{addr.IP, addr.Port})
+		}
+	}
+	return a, nil
+}
+
+// parseHTTPPeers parses the peers of a response: compact ipv4 addresses, or a list of dicts.
+// peers of a list given by a name rather than an ip are left out
+func parseHTTPPeers(raw formats.RawMessage) ([]PeerAddr, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var socks []PeerAddr
+	if raw[0] == 'l' {
+		var peers []httpPeer
+		if err := formats.Unmarshall(raw, &peers); err != nil {
+			return nil, fmt.Errorf("Error parsing announce response peers: %w", err)
+		}
+		for _, p := range peers {
+			ip := net.ParseIP(p.IP)
+			if ip == nil || p.Port <= 0 || p.Port > 0xffff {
+				continue
+			}
+			socks = append(socks, PeerAddr{ip, uint16(p.Port)})
+		}
+		return socks, nil
+	}
+	var compact []byte
+	if err := formats.Unmarshall(raw, &compact); err != nil {
+		return nil, fmt.Errorf("Error parsing announce response peers: %w", err)
+	}
+	addrs, err := formats.ParseCompactAddrs(compact, net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		socks = append(socks, PeerAddr{addr.IP, addr.Port})
+	}
+	return socks, nil
+}
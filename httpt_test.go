@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+func TestHTTPTracker(t *testing.T) {
+	infoH := formats.Sha1{0x00, ' ', '%', '&', 0xff, 'a'}
+	req := AnnounceReq{InfoHash: infoH, PeerId: [20]byte{'-', 'O', 'D'}, Port: 6881, Left: 1000, Event: EventStarted, NumWant: 30, Key: 0xbeef}
+
+	var queries []url.Values
+	var resp string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		w.Write([]byte(resp))
+	}))
+	defer srv.Close()
+	client := NewHTTPTClient(srv.URL + "/announce?passkey=abc")
+	ctx := context.Background()
+
+	// compact peers, ipv4 and ipv6
+	resp = "d8:completei3e10:incompletei5e8:intervali1800e12:min intervali60e10:tracker id3:xyz" +
+		"5:peers12:\x7f\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe2" +
+		"6:peers618:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe3e"
+	a, err := client.Announce(ctx, req)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	q := queries[0]
+	expected := map[string]string{
+		"info_hash": string(infoH[:]), "peer_id": string(req.PeerId[:]), "port": "6881", "uploaded": "0", "downloaded": "0",
+		"left": "1000", "event": "started", "compact": "1", "numwant": "30", "key": "beef", "passkey": "abc", "trackerid": "",
+	}
+	for k, v := range expected {
+		if q.Get(k) != v {
+			t.Errorf("Expected %s=%q, got %q", k, v, q.Get(k))
+		}
+	}
+	if a.interval != 1800 || a.minInterval != 60 || a.seeders != 3 || a.leechers != 5 {
+		t.Errorf("Wrong response: %+v", a)
+	}
+	if len(a.socks) != 3 || a.socks[0].String() != "127.0.0.1:6881" || a.socks[1].String() != "10.0.0.2:6882" || a.socks[2].String() != "[::1]:6883" {
+		t.Errorf("Wrong peers: %v", a.socks)
+	}
+
+	// dict peers, and the tracker id of the last response sent back
+	resp = "d8:intervali900e15:warning message4:slow5:peersld2:ip9:127.0.0.27:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti7000eed2:ip9:some.host4:porti1eeee"
+	req.Event = EventNone
+	a, err = client.Announce(ctx, req)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if q := queries[1]; q.Get("trackerid") != "xyz" || q.Has("event") {
+		t.Errorf("Wrong query: %v", q)
+	}
+	if a.warning != "slow" || len(a.socks) != 1 || a.socks[0].String() != "127.0.0.2:7000" {
+		t.Errorf("Wrong response: %+v", a)
+	}
+
+	resp = "d14:failure reason12:unregisterede"
+	_, err = client.Announce(ctx, req)
+	var terr *TrackerError
+	if !errors.As(err, &terr) || terr.Reason != "unregistered" {
+		t.Errorf("Expected a tracker error, got %v", err)
+	}
+}
+
+func TestFindPeersHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("event") != "started" {
+			t.Errorf("Expected the started event, got %v", r.URL.Query())
+		}
+		w.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer srv.Close()
+	torr := &Torrent{}
+	torr.mInfo.Announce = srv.URL + "/announce"
+	if err := torr.findPeers(context.Background()); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if len(torr.peers) != 1 || torr.peers[0].String() != "127.0.0.1:6881" {
+		t.Errorf("Wrong peers: %v", torr.peers)
+	}
+}
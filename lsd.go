@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// local service discovery: https://www.bittorrent.org/beps/bep_0014.html
+
+// LSD_GROUPS are the multicast groups peers on the same network announce their torrents to
+var LSD_GROUPS = []string{"239.192.152.143:6771", "[ff15::efc0:988f]:6771"}
+
+// a torrent is announced every `lsdInterval`, and never more than once in `lsdMinInterval`
+const (
+	lsdInterval    = 5 * time.Minute
+	lsdMinInterval = time.Minute
+)
+
+// lsdMaxHashes is the most infohashes put in one announce, which has to fit in a datagram of less than 1400 bytes
+const lsdMaxHashes = 20
+
+type LSDConfig struct {
+	Groups    []string       // LSD_GROUPS if empty
+	Interface *net.Interface // the interface to join the groups on. the system picks one if nil
+	Port      int            // the port we take peer connections on
+}
+
+// LSD announces our torrents to the local network, and adds the peers announcing them to the torrents
+type LSD struct {
+	port   int
+	cookie string // tells our own announces apart, as they loop back to us
+	groups []*lsdGroup
+
+	mu        sync.Mutex
+	torrents  map[formats.Sha1]*Torrent
+	announced map[formats.Sha1]time.Time
+	closed    chan struct{}
+}
+
+type lsdGroup struct {
+	addr *net.UDPAddr
+	recv *net.UDPConn
+	send *net.UDPConn
+}
+
+// lsdNode is our LSD, nil if it does not run
+var lsdNode *LSD
+
+// StartLSD joins the LSD groups. torrents that are not private get peers of the local network from it
+func StartLSD() (*LSD, error) {
+	l, err := NewLSD(LSDConfig{Port: PORT})
+	if err != nil {
+		return nil, err
+	}
+	lsdNode = l
+	return l, nil
+}
+
+// NewLSD joins the groups of the config. it fails only if none could be joined: hosts without ipv6 still get ipv4
+func NewLSD(cfg LSDConfig) (*LSD, error) {
+	if len(cfg.Groups) == 0 {
+		cfg.Groups = LSD_GROUPS
+	}
+	cookie := make([]byte, 8)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, err
+	}
+	l := &LSD{
+		port:      cfg.Port,
+		cookie:    hex.EncodeToString(cookie),
+		torrents:  map[formats.Sha1]*Torrent{},
+		announced: map[formats.Sha1]time.Time{},
+		closed:    make(chan struct{}),
+	}
+	var errs []string
+	for _, grp := range cfg.Groups {
+		g, err := joinLSDGroup(grp, cfg.Interface)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		l.groups = append(l.groups, g)
+	}
+	if len(l.groups) == 0 {
+		return nil, fmt.Errorf("Could not join any LSD group: %s", strings.Join(errs, "; "))
+	}
+	for _, g := range l.groups {
+		go l.serve(g)
+	}
+	go l.run()
+	return l, nil
+}
+
+func joinLSDGroup(grp string, ifi *net.Interface) (*lsdGroup, error) {
+	addr, err := net.ResolveUDPAddr("udp", grp)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+		// the zone picks the interface ipv6 multicast goes out of
+		if ifi != nil {
+			addr.Zone = ifi.Name
+		}
+	}
+	recv, err := net.ListenMulticastUDP(network, ifi, addr)
+	if err != nil {
+		return nil, err
+	}
+	send, err := net.ListenUDP(network, nil)
+	if err != nil {
+		recv.Close()
+		return nil, err
+	}
+	return &lsdGroup{addr: addr, recv: recv, send: send}, nil
+}
+
+func (l *LSD) Close() error {
+	select {
+	case <-l.closed:
+		return nil
+	default:
+	}
+	close(l.closed)
+	for _, g := range l.groups {
+		g.recv.Close()
+		g.send.Close()
+	}
+	return nil
+}
+
+// Add announces a torrent, and takes the peers that announce it from now on
+func (l *LSD) Add(t *Torrent) {
+	l.mu.Lock()
+	l.torrents[t.InfoH] = t
+	l.mu.Unlock()
+	l.announce([]formats.Sha1{t.InfoH}, false)
+}
+
+// has reports whether peers of the local network announcing the torrent are added to it
+func (l *LSD) has(t *Torrent) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.torrents[t.InfoH] == t
+}
+
+func (l *LSD) Remove(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.torrents, t.InfoH)
+	delete(l.announced, t.InfoH)
+}
+
+// announce sends the infohashes to every group. unless forced, those announced in the last `lsdMinInterval` are left out
+func (l *LSD) announce(hashes []formats.Sha1, force bool) {
+	now := time.Now()
+	l.mu.Lock()
+	var due []formats.Sha1
+	for _, h := range hashes {
+		if force || now.Sub(l.announced[h]) >= lsdMinInterval {
+			l.announced[h] = now
+			due = append(due, h)
+		}
+	}
+	l.mu.Unlock()
+	for len(due) > 0 {
+		n := len(due)
+		if n > lsdMaxHashes {
+			n = lsdMaxHashes
+		}
+		for _, g := range l.groups {
+			msg := lsdMsg(g.addr, l.port, due[:n], l.cookie)
+			// a group we cannot send to is left to the next announce
+			g.send.WriteToUDP(msg, g.addr)
+		}
+		due = due[n:]
+	}
+}
+
+// run announces all the torrents every `lsdInterval`
+func (l *LSD) run() {
+	ticker := time.NewTicker(lsdInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.closed:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			hashes := make([]formats.Sha1, 0, len(l.torrents))
+			for h := range l.torrents {
+				hashes = append(hashes, h)
+			}
+			l.mu.Unlock()
+			l.announce(hashes, true)
+		}
+	}
+}
+
+// serve takes in the announces of a group. the peer is added to the torrents of ours it announces,
+// which are announced back if it has been a while, so a peer that just came up need not wait for our next announce
+func (l *LSD) serve(g *lsdGroup) {
+	buf := make([]byte, 1500)
+	backoff := time.Duration(0)
+	for {
+		n, from, err := g.recv.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// the errors that are not fatal are waited out, a little longer each time
+			if backoff = 2 * backoff; backoff == 0 {
+				backoff = 10 * time.Millisecond
+			} else if backoff > time.Second {
+				backoff = time.Second
+			}
+			select {
+			case <-l.closed:
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+		ann, err := parseLSDMsg(buf[:n])
+		if err != nil || ann.cookie == l.cookie {
+			continue
+		}
+		peer := PeerAddr{from.IP, ann.port}
+		var ours []formats.Sha1
+		for _, h := range ann.hashes {
+			l.mu.Lock()
+			t, ok := l.torrents[h]
+			l.mu.Unlock()
+			if ok {
+				t.addPeers([]PeerAddr{peer})
+				ours = append(ours, h)
+			}
+		}
+		if len(ours) > 0 {
+			l.announce(ours, false)
+		}
+	}
+}
+
+// lsdAnnounce is what an announce tells: the port the peer takes connections on, and the torrents it has
+type lsdAnnounce struct {
+	port   uint16
+	hashes []formats.Sha1
+	cookie string
+}
+
+// lsdMsg makes an announce, an http request over udp:
+//
+//	BT-SEARCH * HTTP/1.1\r\n
+//	Host: <group>\r\n
+//	Port: <port>\r\n
+//	Infohash: <hex infohash>\r\n
+//	...
+//	cookie: <cookie>\r\n
+//	\r\n
+//	\r\n
+func lsdMsg(group *net.UDPAddr, port int, hashes []formats.Sha1, cookie string) []byte {
+	var b bytes.Buffer
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", net.JoinHostPort(group.IP.String(), strconv.Itoa(group.Port)))
+	fmt.Fprintf(&b, "Port: %d\r\n", port)
+	for _, h := range hashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", h)
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n", cookie)
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+func parseLSDMsg(b []byte) (lsdAnnounce, error) {
+	var ann lsdAnnounce
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+	line, err := r.ReadLine()
+	if err != nil {
+		return ann, err
+	}
+	if line != "BT-SEARCH * HTTP/1.1" {
+		return ann, fmt.Errorf("Not an LSD announce: %q", line)
+	}
+	h, err := r.ReadMIMEHeader()
+	if err != nil {
+		return ann, err
+	}
+	port, err := strconv.ParseUint(h.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return ann, fmt.Errorf("LSD announce has a bad port: %q", h.Get("Port"))
+	}
+	ann.port = uint16(port)
+	for _, v := range h.Values("Infohash") {
+		var ih formats.Sha1
+		if len(v) != hex.EncodedLen(len(ih)) {
+			return ann, fmt.Errorf("LSD announce has a bad infohash: %q", v)
+		}
+		if _, err := hex.Decode(ih[:], []byte(v)); err != nil {
+			return ann, fmt.Errorf("LSD announce has a bad infohash: %q", v)
+		}
+		ann.hashes = append(ann.hashes, ih)
+	}
+	if len(ann.hashes) == 0 {
+		return ann, fmt.Errorf("LSD announce has no infohash")
+	}
+	ann.cookie = h.Get("Cookie")
+	return ann, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+func TestLSDMsg(t *testing.T) {
+	group := &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+	hashes := []formats.Sha1{{0x01, 0xab}, {0xff}}
+	msg := lsdMsg(group, 6881, hashes, "c00k1e")
+	ann, err := parseLSDMsg(msg)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if ann.port != 6881 || ann.cookie != "c00k1e" || len(ann.hashes) != 2 || ann.hashes[0] != hashes[0] || ann.hashes[1] != hashes[1] {
+		t.Errorf("Wrong announce: %+v", ann)
+	}
+
+	bad := []string{
+		"M-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: 0000000000000000000000000000000000000000\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: 0000000000000000000000000000000000000000\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: 00\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 1\r\n\r\n\r\n",
+	}
+	for _, b := range bad {
+		if _, err := parseLSDMsg([]byte(b)); err == nil {
+			t.Errorf("Should not parse: %q", b)
+		}
+	}
+}
+
+// multicastIfi gives the loopback interface if it takes multicast, or nil to let the system pick
+func multicastIfi() *net.Interface {
+	ifis, _ := net.Interfaces()
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagMulticast != 0 {
+			return &ifi
+		}
+	}
+	return nil
+}
+
+func waitPeers(torr *Torrent, n int) []PeerAddr {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		torr.mu.Lock()
+		peers := append([]PeerAddr(nil), torr.peers...)
+		torr.mu.Unlock()
+		if len(peers) >= n {
+			return peers
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestLSD(t *testing.T) {
+	// not the real groups, so we don't talk to other clients of the network
+	cfg := LSDConfig{Groups: []string{"239.192.152.143:16771", "[ff15::efc0:988f]:16771"}, Interface: multicastIfi()}
+	cfg.Port = 7001
+	a, err := NewLSD(cfg)
+	if err != nil {
+		t.Skipf("No multicast here: %s", err)
+	}
+	defer a.Close()
+	cfg.Port = 7002
+	b, err := NewLSD(cfg)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	defer b.Close()
+
+	infoH := formats.Sha1{0x5e, 0xed}
+	ta, tb := &Torrent{InfoH: infoH}, &Torrent{InfoH: infoH}
+	other := &Torrent{InfoH: formats.Sha1{0x07}}
+	a.Add(ta)
+	a.Add(other)
+	b.Add(tb)
+
+	// b announced after a took the torrent
+	peers := waitPeers(ta, 1)
+	if len(peers) == 0 {
+		t.Fatalf("No peer came from LSD")
+	}
+	for _, p := range peers {
+		if p.port != 7002 {
+			t.Errorf("Wrong peer: %s", p)
+		}
+	}
+	if len(waitPeers(other, 0)) != 0 {
+		t.Errorf("Peer added to a torrent it did not announce: %v", other.peers)
+	}
+	// a announced when b may not have had the torrent yet, and is too recent to announce back on its own
+	a.announce([]formats.Sha1{infoH}, true)
+	peers = waitPeers(tb, 1)
+	if len(peers) == 0 {
+		t.Fatalf("No peer came from LSD")
+	}
+	for _, p := range peers {
+		if p.port != 7001 {
+			t.Errorf("Wrong peer: %s", p)
+		}
+	}
+}
+
+func TestStartWaitsForLSD(t *testing.T) {
+	Init()
+	data := make([]byte, 4*formats.BLOCK_LEN)
+	rand.Read(data)
+	m := seedMeta(t, formats.InfoDict{Name: "data.bin", PieceLen: 2 * formats.BLOCK_LEN, Length: len(data)}, data)
+	infoH, _ := m.GetInfoHash()
+
+	// a magnet torrent with no peer at first. the seed is found on the local network later
+	torr := &Torrent{InfoH: infoH, fPath: t.TempDir()}
+	lsdNode = &LSD{torrents: map[formats.Sha1]*Torrent{}, announced: map[formats.Sha1]time.Time{}}
+	defer func() { lsdNode = nil }()
+	if err := torr.findPeers(context.Background()); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- torr.FetchMetaInfo(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	torr.addPeers([]PeerAddr{seedMetadata(t, infoH, m.RawInfo)})
+	if err := <-errc; err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+
+	// the download waits for peers that can send the pieces
+	go func() { errc <- torr.Start(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	torr.addPeers([]PeerAddr{seedPieces(t, m, data, false, false)})
+	if err := <-errc; err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(torr.fPath, "data.bin")); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("Wrong content written: %v", err)
+	}
+	if lsdNode.has(torr) {
+		t.Errorf("Torrent should be taken off LSD once its download ends")
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// metadata exchange: https://www.bittorrent.org/beps/bep_0009.html
+
+// maxMetadataSize bounds the info dict a peer can make us fetch
+const maxMetadataSize = 16 << 20
+
+// maxMetadataPeers is how many peers the info dict is fetched from at once
+const maxMetadataPeers = 5
+
+// metadataFetch puts the info dict together from the pieces different peers send
+type metadataFetch struct {
+	infoH  formats.Sha1
+	mu     sync.Mutex
+	size   int
+	pieces [][]byte
+	reqd   []bool // pieces requested from some peer, not yet received
+	raw    []byte // the info dict, once it matches the infohash
+	done   chan struct{}
+}
+
+func newMetadataFetch(infoH formats.Sha1) *metadataFetch {
+	return &metadataFetch{infoH: infoH, done: make(chan struct{})}
+}
+
+// setSize sets the size of the info dict, as the first peer tells it. peers telling another size are not used
+func (f *metadataFetch) setSize(size int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size <= 0 || size > maxMetadataSize {
+		return fmt.Errorf("Invalid metadata size %d", size)
+	}
+	if f.pieces == nil {
+		f.size = size
+		f.pieces = make([][]byte, formats.NumMetadataPieces(size))
+		f.reqd = make([]bool, len(f.pieces))
+		return nil
+	}
+	if size != f.size {
+		return fmt.Errorf("Metadata size %d does not match %d", size, f.size)
+	}
+	return nil
+}
+
+// next gives a missing piece to request, preferring those no peer was asked for yet.
+// it is false once the info dict is complete
+func (f *metadataFetch) next() (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.raw != nil {
+		return 0, false
+	}
+	missing := -1
+	for i, p := range f.pieces {
+		if p != nil {
+			continue
+		}
+		if !f.reqd[i] {
+			f.reqd[i] = true
+			return i, true
+		}
+		if missing < 0 {
+			missing = i
+		}
+	}
+	return missing, missing >= 0
+}
+
+// release gives back a piece a peer did not send, for other peers to request
+func (f *metadataFetch) release(i int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reqd[i] = false
+}
+
+// put stores a piece. once all are in, the info dict is checked against the infohash. if it does not match,
+// there is no telling which peer sent bad data, so all the pieces are fetched again
+func (f *metadataFetch) put(i int, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.raw != nil {
+		return nil
+	}
+	f.reqd[i] = false
+	want := formats.METADATA_PIECE_LEN
+	if i == len(f.pieces)-1 {
+		want = f.size - i*formats.METADATA_PIECE_LEN
+	}
+	if len(data) != want {
+		return fmt.Errorf("Metadata piece %d is %d bytes long, expected %d", i, len(data), want)
+	}
+	f.pieces[i] = data
+	for _, p := range f.pieces {
+		if p == nil {
+			return nil
+		}
+	}
+	raw := bytes.Join(f.pieces, nil)
+	if sha1.Sum(raw) != f.infoH {
+		for i := range f.pieces {
+			f.pieces[i] = nil
+		}
+		return fmt.Errorf("Info dict does not match the infohash % x", f.infoH)
+	}
+	f.raw = raw
+	close(f.done)
+	return nil
+}
+
+// FetchMetaInfo gets the info dict of a torrent started from a magnet link from its peers, a few of them at once,
+// each sending some of the pieces. Once the info dict matches the infohash, the torrent is like one started from a torrent file
+func (t *Torrent) FetchMetaInfo(ctx context.Context) error {
+	if t.HasMetaInfo() {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	f := newMetadataFetch(t.InfoH)
+
+	// peers are asked as they come, up to maxMetadataPeers at once. with none left, those of the local network are waited for
+	errc := make(chan error)
+	tried, running := 0, 0
+	var lastErr error
+	connect := func() chan struct{} {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for ; tried < len(t.peers) && running < maxMetadataPeers; tried++ {
+			p := t.peers[tried]
+			go func() {
+				err := t.fetchMetadataFrom(ctx, p, f)
+				select {
+				case errc <- err:
+				case <-ctx.Done():
+				}
+			}()
+			running++
+		}
+		return t.addedCh()
+	}
+	added := connect()
+	lsd := t.onLSD()
+	for {
+		select {
+		case <-f.done:
+			return t.setInfo(f.raw)
+		default:
+		}
+		if running == 0 && !lsd {
+			if lastErr == nil {
+				return fmt.Errorf("No peers to get the info dict of %x from", t.InfoH)
+			}
+			return fmt.Errorf("Could not get the info dict from any peer: %w", lastErr)
+		}
+		select {
+		case <-f.done:
+		case <-added:
+			added = connect()
+		case err := <-errc:
+			if running--; err != nil {
+				lastErr = err
+			}
+			added = connect()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// fetchMetadataFrom requests pieces of the info dict from a peer, one at a time, until there are none left
+func (t *Torrent) fetchMetadataFrom(ctx context.Context, addr PeerAddr, f *metadataFetch) error {
+	select {
+	case <-f.done:
+		return nil
+	default:
+	}
+	cl, err := NewConn(ctx, addr)
+	if err != nil {
+		return err
+	}
+	cl.torrent = t
+	ut := &utMetadata{ch: make(chan formats.MetadataMsg, 1)}
+	if err := cl.RegisterExt(formats.UT_METADATA, ut); err != nil {
+		return err
+	}
+	// the connection is closed as soon as we are done with it, so a pending read ends
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-f.done:
+		case <-quit:
+		}
+		cl.conn.Close()
+	}()
+
+	if err := cl.Shake(NewShaker(t.InfoH, peerId)); err != nil {
+		return err
+	}
+	if !cl.supports(extBit) {
+		return fmt.Errorf("Peer %s does not support the extension protocol", addr)
+	}
+	if err := cl.sendHaves(); err != nil {
+		return err
+	}
+	if err := cl.SendExtHandshake(); err != nil {
+		return err
+	}
+	// the bitfield and other messages may come before the extended handshake
+	for !cl.ext.shaken {
+		if err := cl.readMsg(10 * time.Second); err != nil {
+			return err
+		}
+	}
+	if !cl.PeerSupportsExt(formats.UT_METADATA) {
+		return fmt.Errorf("Peer %s does not support %s", addr, formats.UT_METADATA)
+	}
+	if err := f.setSize(cl.ext.peer.MetadataSize); err != nil {
+		return err
+	}
+
+	for {
+		i, ok := f.next()
+		if !ok {
+			return nil
+		}
+		m, err := ut.request(cl, i)
+		if err != nil {
+			f.release(i)
+			return err
+		}
+		if m.Type == formats.MetadataReject {
+			f.release(i)
+			return fmt.Errorf("Peer %s rejected metadata piece %d", addr, i)
+		}
+		if err := f.put(i, m.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// readMsg reads and handles one message from the peer
+func (c *PeerConn) readMsg(timeout time.Duration) error {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	msg, err := formats.ReadMessage(c.conn)
+	if err != nil {
+		return err
+	}
+	return c.handleMsg(msg)
+}
+
+// utMetadata is the ut_metadata extension of a connection. It answers requests for our info dict, and passes
+// data and rejects on to `ch`, if the info dict is being fetched from the peer
+type utMetadata struct {
+	ch chan formats.MetadataMsg
+}
+
+func (u *utMetadata) Handshake(c *PeerConn, h formats.ExtHandshake) error {
+	return nil
+}
+
+func (u *utMetadata) HandleMsg(c *PeerConn, payload []byte) error {
+	m, err := formats.ParseMetadataMsg(payload)
+	if err != nil {
+		return err
+	}
+	if m.Type == formats.MetadataRequest {
+		return c.serveMetadata(m.Piece)
+	}
+	if u.ch != nil {
+		select {
+		case u.ch <- m:
+		default:
+		}
+	}
+	return nil
+}
+
+// request requests a piece of the info dict and waits for the peer to send or reject it
+func (u *utMetadata) request(c *PeerConn, piece int) (formats.MetadataMsg, error) {
+	req, err := formats.MetadataMsg{Type: formats.MetadataRequest, Piece: piece}.Marshall()
+	if err != nil {
+		return formats.MetadataMsg{}, err
+	}
+	if err := c.sendExtended(formats.UT_METADATA, req); err != nil {
+		return formats.MetadataMsg{}, err
+	}
+	for {
+		if err := c.readMsg(10 * time.Second); err != nil {
+			return formats.MetadataMsg{}, err
+		}
+		select {
+		case m := <-u.ch:
+			if m.Piece == piece {
+				return m, nil
+			}
+		default:
+		}
+	}
+}
+
+// serveMetadata sends a piece of our info dict, or rejects the request if we don't have it (yet)
+func (c *PeerConn) serveMetadata(piece int) error {
+	var raw []byte
+	if c.torrent != nil {
+		raw = c.torrent.metadata()
+	}
+	resp := formats.MetadataMsg{Type: formats.MetadataReject, Piece: piece}
+	// the piece is checked before the multiplication, which a huge one would overflow
+	if piece >= 0 && piece < formats.NumMetadataPieces(len(raw)) {
+		start := piece * formats.METADATA_PIECE_LEN
+		end := start + formats.METADATA_PIECE_LEN
+		if end > len(raw) {
+			end = len(raw)
+		}
+		resp = formats.MetadataMsg{Type: formats.MetadataData, Piece: piece, TotalSize: len(raw), Data: raw[start:end]}
+	}
+	b, err := resp.Marshall()
+	if err != nil {
+		return err
+	}
+	return c.sendExtended(formats.UT_METADATA, b)
+}
+
+// metadata gives the raw info dict, nil if we don't have it
+func (t *Torrent) metadata() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.mInfo.RawInfo
+}
+
+// setInfo takes in the info dict fetched from peers, once it matches the infohash
+func (t *Torrent) setInfo(raw []byte) error {
+	var info formats.InfoDict
+	if err := formats.Unmarshall(raw, &info); err != nil {
+		return fmt.Errorf("Invalid info dict: %w", err)
+	}
+	// it is not taken in, so the torrent is left without one, to be fetched again
+	if err := info.Validate(); err != nil {
+		return fmt.Errorf("Invalid info dict: %w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mInfo.Info = info
+	t.mInfo.RawInfo = raw
+	t.size = t.mInfo.Size()
+	t.name = info.Name
+	// the files the magnet link selects, unless priorities were set already
+	if t.magnet != nil && len(t.magnet.SelectOnly) > 0 && t.filePrio == nil {
+		t.filePrio = selectOnly(len(t.mInfo.FileList()), t.magnet.SelectOnly)
+	}
+	t.notify()
+	return nil
+}
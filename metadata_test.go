@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// seedMetadata starts a peer that has the info dict `raw` for the torrent `infoH`, and sends it to those who ask
+func seedMetadata(t *testing.T, infoH formats.Sha1, raw []byte) PeerAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	seed := &Torrent{InfoH: infoH}
+	seed.mInfo.RawInfo = raw
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				cl := &PeerConn{conn: conn, torrent: seed}
+				cl.RegisterExt(formats.UT_METADATA, &utMetadata{})
+				h, err := ParseHandShake(conn)
+				if err != nil {
+					return
+				}
+				var id [20]byte
+				copy(id[:], "-seed-")
+				cl.shaker, cl.peerShaker = NewShaker(infoH, id), h
+				if _, err := io.Copy(conn, cl.shaker.Marshall()); err != nil {
+					return
+				}
+				// a bitfield before the extended handshake
+				bf := &formats.Msg{ID: formats.BitField, Len: 2, Payload: []byte{0xff}}
+				if err := bf.Marshall(conn); err != nil {
+					return
+				}
+				if err := cl.SendExtHandshake(); err != nil {
+					return
+				}
+				for {
+					msg, err := formats.ReadMessage(conn)
+					if err != nil || cl.handleMsg(msg) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return PeerAddr{addr.IP, uint16(addr.Port)}
+}
+
+func TestFetchMetaInfo(t *testing.T) {
+	Init()
+	// enough pieces for the info dict to take more than one metadata piece
+	info := formats.InfoDict{PieceLen: 16384, PiecesHash: make([]formats.Sha1, 1000), Name: "big.iso", Length: 16384 * 1000}
+	raw, err := formats.Marshall(info)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if formats.NumMetadataPieces(len(raw)) < 2 {
+		t.Fatalf("Info dict too small: %d", len(raw))
+	}
+	infoH := formats.Sha1(sha1.Sum(raw))
+
+	torr := &Torrent{InfoH: infoH, fPath: t.TempDir()}
+	torr.peers = []PeerAddr{seedMetadata(t, infoH, raw), seedMetadata(t, infoH, raw), {net.IPv4(127, 0, 0, 1), 1}}
+	if err := torr.FetchMetaInfo(context.Background()); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if !torr.HasMetaInfo() || torr.name != "big.iso" || torr.size != 16384*1000 || len(torr.pieceHashes()) != 1000 {
+		t.Errorf("Wrong torrent: %s %d", torr.name, torr.size)
+	}
+	if h, _ := torr.mInfo.GetInfoHash(); h != infoH {
+		t.Errorf("Wrong infohash: % x", h)
+	}
+
+	// an info dict that matches the infohash but cannot be downloaded is not taken
+	broken, err := formats.Marshall(formats.InfoDict{Name: "broken", Length: 100, PiecesHash: make([]formats.Sha1, 1)})
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	brokenH := formats.Sha1(sha1.Sum(broken))
+	zero := &Torrent{InfoH: brokenH}
+	zero.peers = []PeerAddr{seedMetadata(t, brokenH, broken)}
+	if err := zero.FetchMetaInfo(context.Background()); err == nil || zero.HasMetaInfo() {
+		t.Errorf("Should not take an info dict with no piece length")
+	}
+
+	// a peer sending some other info dict is of no use
+	bad := &Torrent{InfoH: infoH}
+	bad.peers = []PeerAddr{seedMetadata(t, infoH, raw[:len(raw)-1])}
+	if err := bad.FetchMetaInfo(context.Background()); err == nil || bad.HasMetaInfo() {
+		t.Errorf("Should not take an info dict that does not match the infohash")
+	}
+}
+
+func TestServeMetadataBounds(t *testing.T) {
+	a, b := connPair(t)
+	a.torrent = &Torrent{}
+	a.torrent.mInfo.RawInfo = make([]byte, formats.METADATA_PIECE_LEN+1)
+	a.ext.ids = map[string]uint8{formats.UT_METADATA: 3}
+	for piece, expected := range map[int]formats.MetadataMsgType{1: formats.MetadataData, 2: formats.MetadataReject, 1 << 50: formats.MetadataReject} {
+		if err := a.serveMetadata(piece); err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+		msg, err := formats.ReadMessage(b.conn)
+		if err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+		_, payload, err := formats.ParseExtended(msg)
+		if err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+		m, err := formats.ParseMetadataMsg(payload)
+		if err != nil || m.Type != expected || m.Piece != piece {
+			t.Errorf("Piece %d: expected a message of type %d, got %+v: %v", piece, expected, m, err)
+		}
+	}
+}
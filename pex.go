@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// peer exchange: https://www.bittorrent.org/beps/bep_0011.html
+
+// pexInterval is how often connected peers are told of the peers we connected to and dropped.
+// it is also the least time between two messages we take in from a peer, give or take `pexSlack`
+const pexInterval = time.Minute
+
+const pexSlack = 5 * time.Second
+
+// maxCandidates bounds the peers the torrent keeps to connect to
+const maxCandidates = 2000
+
+// maxConns bounds the peers a download is connected to at once
+const maxConns = 50
+
+// utPex is the ut_pex extension of a connection
+type utPex struct {
+	t        *Torrent
+	lastRecv time.Time // when the last message of the peer was taken in
+
+	mu   sync.Mutex // updates are sent from `runPex`, not the goroutine reading the connection
+	id   uint8      // the extended message id the peer gave ut_pex
+	sent map[string]formats.PexPeer
+}
+
+func newUtPex(t *Torrent) *utPex {
+	return &utPex{t: t, sent: map[string]formats.PexPeer{}}
+}
+
+func (u *utPex) Handshake(c *PeerConn, h formats.ExtHandshake) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.id = uint8(h.M[formats.UT_PEX])
+	return nil
+}
+
+// HandleMsg adds the peers of a PEX message to the candidates of the torrent. a peer should not send more than one message
+// a minute, those coming sooner are dropped. only the first MAX_PEX_PEERS added peers of a message are taken
+func (u *utPex) HandleMsg(c *PeerConn, payload []byte) error {
+	now := time.Now()
+	if !u.lastRecv.IsZero() && now.Sub(u.lastRecv) < pexInterval-pexSlack {
+		return nil
+	}
+	u.lastRecv = now
+	var m formats.PexMsg
+	if err := formats.Unmarshall(payload, &m); err != nil {
+		return err
+	}
+	added, _, err := m.Peers()
+	if err != nil {
+		return err
+	}
+	if len(added) > formats.MAX_PEX_PEERS {
+		added = added[:formats.MAX_PEX_PEERS]
+	}
+	addrs := make([]PeerAddr, 0, len(added))
+	for _, p := range added {
+		if p.Addr.Port == 0 || p.Addr.IP.IsUnspecified() {
+			continue
+		}
+		addrs = append(addrs, PeerAddr{p.Addr.IP, p.Addr.Port})
+	}
+	u.t.addPeers(addrs)
+	return nil
+}
+
+// update tells the peer of the connected peers it was not told of yet, and of those dropped since the last update
+func (u *utPex) update(c *PeerConn, connected []formats.PexPeer) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.id == 0 { // the peer does not support ut_pex, or did not shake yet
+		return nil
+	}
+	var added, dropped []formats.PexPeer
+	current := map[string]bool{}
+	self := c.addr.String()
+	for _, p := range connected {
+		k := PeerAddr{p.Addr.IP, p.Addr.Port}.String()
+		current[k] = true
+		if _, ok := u.sent[k]; ok || k == self || len(added) == formats.MAX_PEX_PEERS {
+			continue
+		}
+		added = append(added, p)
+	}
+	for k, p := range u.sent {
+		if !current[k] && len(dropped) < formats.MAX_PEX_PEERS {
+			dropped = append(dropped, p)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+	b, err := formats.Marshall(formats.NewPexMsg(added, dropped))
+	if err != nil {
+		return err
+	}
+	if err := formats.NewExtended(u.id, b).Marshall(c.conn); err != nil {
+		return err
+	}
+	for _, p := range added {
+		u.sent[PeerAddr{p.Addr.IP, p.Addr.Port}.String()] = p
+	}
+	for _, p := range dropped {
+		delete(u.sent, PeerAddr{p.Addr.IP, p.Addr.Port}.String())
+	}
+	return nil
+}
+
+// addPeers adds peers to those the torrent can connect to, leaving out those it knows of already.
+// it gives the number of peers added
+func (t *Torrent) addPeers(addrs []PeerAddr) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.known == nil {
+		t.known = map[string]bool{}
+		for _, p := range t.peers {
+			t.known[p.String()] = true
+		}
+	}
+	n := 0
+	for _, a := range addrs {
+		if len(t.peers) >= maxCandidates {
+			break
+		}
+		k := a.String()
+		if t.known[k] {
+			continue
+		}
+		t.known[k] = true
+		t.peers = append(t.peers, a)
+		n++
+	}
+	if n > 0 && t.added != nil {
+		close(t.added)
+		t.added = nil
+	}
+	return n
+}
+
+// addedCh is closed as the next peers are added. t.mu must be held
+func (t *Torrent) addedCh() chan struct{} {
+	if t.added == nil {
+		t.added = make(chan struct{})
+	}
+	return t.added
+}
+
+// pexPeers gives the connected peers, as PEX tells of them. we connected to them, so they take incoming connections
+func (t *Torrent) pexPeers() []formats.PexPeer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make([]formats.PexPeer, 0, len(t.clients))
+	for _, c := range t.clients {
+		p := formats.PexPeer{Addr: formats.CompactAddr{IP: c.addr.ipv4, Port: c.addr.port}, Flags: formats.PexConnectable}
+		if c.seed.Load() {
+			p.Flags |= formats.PexSeed
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// runPex sends PEX updates to the connected peers every `pexInterval`, until the context is done
+func (t *Torrent) runPex(ctx context.Context) {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		connected := t.pexPeers()
+		t.mu.Lock()
+		clients := append([]*PeerConn{}, t.clients...)
+		t.mu.Unlock()
+		for _, c := range clients {
+			if u, ok := c.ext.exts[formats.UT_PEX].(*utPex); ok {
+				// a failed write shows up on the connection itself
+				u.update(c, connected)
+			}
+		}
+	}
+}
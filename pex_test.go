@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+func TestPex(t *testing.T) {
+	a, b := connPair(t)
+	ta, tb := &Torrent{}, &Torrent{}
+	x := PeerAddr{net.IPv4(10, 0, 0, 1), 6881}
+	y := PeerAddr{net.ParseIP("2001:db8::2"), 6882}
+	z := PeerAddr{net.IPv4(10, 0, 0, 3), 6883}
+	tb.peers = []PeerAddr{x}
+
+	a.RegisterExt(formats.UT_PEX, newUtPex(ta))
+	b.RegisterExt(formats.UT_PEX, newUtPex(tb))
+	if err := a.SendExtHandshake(); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := b.SendExtHandshake(); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := a.readMsg(time.Second); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := b.readMsg(time.Second); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+
+	pexPeer := func(p PeerAddr) formats.PexPeer {
+		return formats.PexPeer{Addr: formats.CompactAddr{IP: p.ipv4, Port: p.port}, Flags: formats.PexConnectable}
+	}
+	u := a.ext.exts[formats.UT_PEX].(*utPex)
+	// the peer is not told of itself
+	if err := u.update(a, []formats.PexPeer{pexPeer(x), pexPeer(y), pexPeer(a.addr)}); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := b.readMsg(time.Second); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if len(tb.peers) != 2 || !tb.peers[1].ipv4.Equal(y.ipv4) {
+		t.Errorf("Wrong peers: %v", tb.peers)
+	}
+	if len(u.sent) != 2 {
+		t.Errorf("Wrong peers sent: %v", u.sent)
+	}
+
+	// x is dropped, z added. but the message comes too soon to be taken in
+	if err := u.update(a, []formats.PexPeer{pexPeer(y), pexPeer(z)}); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if err := b.readMsg(time.Second); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if len(tb.peers) != 2 {
+		t.Errorf("Should drop a PEX message coming within a minute: %v", tb.peers)
+	}
+	if _, ok := u.sent[x.String()]; ok || len(u.sent) != 2 {
+		t.Errorf("Wrong peers sent: %v", u.sent)
+	}
+	if n := tb.addPeers([]PeerAddr{x, z, z}); n != 1 {
+		t.Errorf("Added %d peers, expected 1", n)
+	}
+}
@@ -45,6 +45,19 @@ func (p *PiecesState) assertReqd(piece formats.Ibl) {
 
 }
 
+// requeue marks a requested block as needed again, e.g. after the peer rejected the request
+func (p *PiecesState) requeue(piece formats.Ibl) {
+	p.Reqd[piece.Index].done[piece.Begin/formats.BLOCK_LEN] = false
+}
+
+// reset marks the blocks of a piece as neither requested nor received, for the piece to be downloaded again
+func (p *PiecesState) reset(index int) {
+	for i := range p.Reqd[index].done {
+		p.Reqd[index].done[i] = false
+		p.Recvd[index].done[i] = false
+	}
+}
+
 // assertRecvd takes a PieceMsg` and uses it to assert that a particular block is received
 func (p *PiecesState) assertRecvd(piece formats.PieceMsg) {
 	p.Recvd[int(piece.Index)].done[int(piece.Begin)/formats.BLOCK_LEN] = true
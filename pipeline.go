@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// the number of block requests we keep going with a peer. it starts at minQueue, and follows the throughput of the
+// peer times its round trip time, so a fast peer far away gets enough requests to be kept busy. it is never more than
+// maxQueue, nor than what the peer says it takes. with minQueue == maxQueue it is fixed
+var (
+	minQueue = 2
+	maxQueue = 500
+)
+
+// defaultReqq is the number of outstanding requests a peer is taken to accept when it does not say
+const defaultReqq = 250
+
+// rateWindow is how long bytes are counted before the throughput of a peer is updated
+const rateWindow = 500 * time.Millisecond
+
+// pipeline measures a peer to size its queue of requests
+type pipeline struct {
+	sent  map[formats.Ibl]time.Time // when the pending requests were sent
+	rtt   time.Duration             // the shortest a block took to come after its request
+	rate  float64                   // bytes per second the peer sends, smoothed
+	bytes int                       // bytes received since `since`
+	since time.Time                 // start of the window `bytes` are counted in
+}
+
+// requested notes a request sent at `now`
+func (p *pipeline) requested(ibl formats.Ibl, now time.Time) {
+	if p.sent == nil {
+		p.sent = map[formats.Ibl]time.Time{}
+	}
+	p.sent[ibl] = now
+	if p.since.IsZero() {
+		p.since = now
+	}
+}
+
+// dropped forgets a request the peer will not answer
+func (p *pipeline) dropped(ibl formats.Ibl) {
+	delete(p.sent, ibl)
+}
+
+// received notes a block that came at `now`. the round trip time is the shortest wait of a block, as a longer one
+// is the time the request was queued at the peer
+func (p *pipeline) received(ibl formats.Ibl, now time.Time) {
+	if at, ok := p.sent[ibl]; ok {
+		delete(p.sent, ibl)
+		if d := now.Sub(at); p.rtt == 0 || d < p.rtt {
+			p.rtt = d
+		}
+	}
+	p.bytes += ibl.Length
+	if d := now.Sub(p.since); d >= rateWindow {
+		rate := float64(p.bytes) / d.Seconds()
+		if p.rate == 0 {
+			p.rate = rate
+		} else {
+			p.rate = 0.7*p.rate + 0.3*rate
+		}
+		p.bytes, p.since = 0, now
+	}
+}
+
+// depth is the number of requests to keep going with a peer that takes `reqq`. it is twice the blocks the peer
+// sends in a round trip: the throughput measured is bounded by the requests we kept going, so the depth can double
+// each window until the link is full
+func (p *pipeline) depth(reqq int) int {
+	d := minQueue
+	if p.rtt > 0 {
+		if bdp := int(2 * p.rate * p.rtt.Seconds() / float64(formats.BLOCK_LEN)); bdp+1 > d {
+			d = bdp + 1
+		}
+	}
+	if d > maxQueue {
+		d = maxQueue
+	}
+	if d > reqq {
+		d = reqq
+	}
+	if d < 1 {
+		d = 1
+	}
+	return d
+}
+
+// queueDepth gives the number of block requests to keep going with the peer
+func (c *PeerConn) queueDepth() int {
+	reqq := defaultReqq
+	if c.ext.shaken && c.ext.peer.Reqq > 0 {
+		reqq = c.ext.peer.Reqq
+	}
+	return c.pipe.depth(reqq)
+}
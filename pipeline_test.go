@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// simulate downloads for `d` from a peer `rtt` away that sends `bw` bytes per second, keeping as many requests
+// going as the pipeline says. it gives the bytes per second we got over the last second
+func simulate(p *pipeline, rtt time.Duration, bw float64, d time.Duration) float64 {
+	start := time.Unix(0, 0)
+	now := start
+	blockTime := time.Duration(float64(formats.BLOCK_LEN) / bw * float64(time.Second))
+	var queue []formats.Ibl // requests in flight, in order
+	var arrive []time.Time  // when each comes
+	last := start           // when the peer is done sending the last block it was asked for
+	begin, got := 0, 0
+	for now.Sub(start) < d {
+		for len(queue) < p.depth(defaultReqq) {
+			ibl := formats.Ibl{Begin: begin, Length: formats.BLOCK_LEN}
+			begin += formats.BLOCK_LEN
+			p.requested(ibl, now)
+			// the request takes half a round trip to get there, and the block is sent after those before it
+			at := now.Add(rtt / 2)
+			if at.Before(last) {
+				at = last
+			}
+			last = at.Add(blockTime)
+			queue, arrive = append(queue, ibl), append(arrive, last.Add(rtt/2))
+		}
+		now = arrive[0]
+		p.received(queue[0], now)
+		if now.Sub(start) > d-time.Second {
+			got += queue[0].Length
+		}
+		queue, arrive = queue[1:], arrive[1:]
+	}
+	return float64(got)
+}
+
+func TestPipeline(t *testing.T) {
+	p := &pipeline{}
+	if d := p.depth(defaultReqq); d != minQueue {
+		t.Errorf("Expected a depth of %d at first, got %d", minQueue, d)
+	}
+
+	// a fast peer far away: 4 MiB/s at 100ms is 25.6 blocks in a round trip
+	bw, rtt := float64(4<<20), 100*time.Millisecond
+	if got := simulate(p, rtt, bw, 20*time.Second); got < 0.9*bw {
+		t.Errorf("Expected the link to be saturated, got %.0f bytes per second of %.0f. depth: %d", got, bw, p.depth(defaultReqq))
+	}
+	if d := p.depth(defaultReqq); d < 26 || d > 60 {
+		t.Errorf("Expected a depth of about twice the bandwidth delay product, got %d", d)
+	}
+	if p.rtt < rtt || p.rtt > rtt+rtt/10 {
+		t.Errorf("Expected an rtt of about %s, got %s", rtt, p.rtt)
+	}
+
+	// the peer takes fewer requests than that
+	if d := p.depth(10); d != 10 {
+		t.Errorf("Expected the depth capped by the peer at 10, got %d", d)
+	}
+	// and so do we
+	defer func() { minQueue, maxQueue = 2, 500 }()
+	minQueue, maxQueue = 2, 8
+	if d := p.depth(defaultReqq); d != 8 {
+		t.Errorf("Expected the depth capped at 8, got %d", d)
+	}
+	// a fixed depth
+	minQueue, maxQueue = 4, 4
+	if d := (&pipeline{}).depth(defaultReqq); d != 4 {
+		t.Errorf("Expected a fixed depth of 4, got %d", d)
+	}
+
+	// a request the peer drops is not measured
+	ibl := formats.Ibl{Length: formats.BLOCK_LEN}
+	p.requested(ibl, time.Now())
+	p.dropped(ibl)
+	if _, ok := p.sent[ibl]; ok {
+		t.Errorf("Dropped request should be forgotten")
+	}
+}
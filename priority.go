@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// Priority is how much a file, or a piece, is wanted. pieces of a higher priority are picked first, skipped ones never
+type Priority int8
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("Priority(%d)", int8(p))
+}
+
+func ParsePriority(s string) (Priority, error) {
+	for p := PrioritySkip; p <= PriorityHigh; p++ {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown priority %q. it is one of skip, low, normal and high", s)
+}
+
+// filePathName is the path of a file within the torrent, with slashes, that selections match
+func filePathName(f formats.Info) string {
+	return strings.Join(f.Path, "/")
+}
+
+// SelectFiles gives the priorities of the files of a torrent, in the order of the file list, out of selections like
+// `3`, `*.iso` or `linux/*=high`: the index of a file or a glob of its path, and a priority, normal if not given.
+// files no selection picks are skipped, and a later selection of a file overrides an earlier one
+func SelectFiles(m formats.MetaInfo, selections []string) ([]Priority, error) {
+	files := m.FileList()
+	prio := make([]Priority, len(files))
+	for _, sel := range selections {
+		pattern, p := sel, PriorityNormal
+		if i := strings.LastIndex(sel, "="); i >= 0 {
+			var err error
+			if p, err = ParsePriority(sel[i+1:]); err != nil {
+				return nil, err
+			}
+			pattern = sel[:i]
+		}
+		if i, err := strconv.Atoi(pattern); err == nil {
+			if i < 0 || i >= len(files) {
+				return nil, fmt.Errorf("No file %d. the torrent has %d files", i, len(files))
+			}
+			prio[i] = p
+			continue
+		}
+		matched := false
+		for i, f := range files {
+			ok, err := path.Match(pattern, filePathName(f))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid selection %q: %w", sel, err)
+			}
+			if ok {
+				prio[i], matched = p, true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("Selection %q matches no file", sel)
+		}
+	}
+	return prio, nil
+}
+
+// selectOnly gives the priorities of the files that the `so` of a magnet link picks out of `n`: normal for those it
+// names, skip for the others. indices past the last file are left out
+func selectOnly(n int, so []int) []Priority {
+	prio := make([]Priority, n)
+	for _, i := range so {
+		if i < n {
+			prio[i] = PriorityNormal
+		}
+	}
+	return prio
+}
+
+// piecePriorities gives the priority of each piece: the highest of the files it holds data of.
+// with no file priorities, all pieces are normal
+func piecePriorities(m formats.MetaInfo, filePrio []Priority) []Priority {
+	prio := make([]Priority, len(m.Info.PiecesHash))
+	if filePrio == nil {
+		for i := range prio {
+			prio[i] = PriorityNormal
+		}
+		return prio
+	}
+	start := 0
+	for f, file := range m.FileList() {
+		if file.Length > 0 { // empty files hold no piece data
+			end := start + file.Length
+			for i := start / m.Info.PieceLen; i <= (end-1)/m.Info.PieceLen && i < len(prio); i++ {
+				if filePrio[f] > prio[i] {
+					prio[i] = filePrio[f]
+				}
+			}
+			start = end
+		}
+	}
+	return prio
+}
+
+// SetFilePriorities sets the priority of each file, in the order of the file list. it is taken when the download starts
+func (t *Torrent) SetFilePriorities(prio []Priority) error {
+	if n := len(t.mInfo.FileList()); len(prio) != n {
+		return fmt.Errorf("Expected the priorities of %d files, got %d", n, len(prio))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.filePrio = append([]Priority(nil), prio...)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+func TestSelectFiles(t *testing.T) {
+	m := formats.MetaInfo{Info: formats.InfoDict{Name: "artifacts", PieceLen: 4, Files: []formats.Info{
+		{Length: 6, Path: []string{"linux", "odor.tar.gz"}},
+		{Length: 6, Path: []string{"darwin", "odor.tar.gz"}},
+		{Length: 3, Path: []string{"README"}},
+		{Length: 5, Path: []string{"windows", "odor.zip"}},
+	}}}
+	m.Info.PiecesHash = make([]formats.Sha1, 5)
+
+	prio, err := SelectFiles(m, []string{"linux/*=high", "2", "*/*.zip=low", "darwin/*"})
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	expected := []Priority{PriorityHigh, PriorityNormal, PriorityNormal, PriorityLow}
+	if !reflect.DeepEqual(prio, expected) {
+		t.Errorf("Expected %v, got %v", expected, prio)
+	}
+	// a later selection overrides an earlier one
+	if prio, _ := SelectFiles(m, []string{"*/*", "darwin/*=skip"}); prio[1] != PrioritySkip || prio[0] != PriorityNormal || prio[2] != PrioritySkip {
+		t.Errorf("Wrong priorities: %v", prio)
+	}
+	for _, sel := range []string{"4", "-1", "*.iso", "linux/*=urgent", "[="} {
+		if _, err := SelectFiles(m, []string{sel}); err == nil {
+			t.Errorf("Selection %q should fail", sel)
+		}
+	}
+
+	// pieces: [0,4) linux, [4,8) linux darwin, [8,12) darwin, [12,16) README windows, [16,20) windows
+	prio = []Priority{PrioritySkip, PriorityHigh, PrioritySkip, PriorityLow}
+	expected = []Priority{PrioritySkip, PriorityHigh, PriorityHigh, PriorityLow, PriorityLow}
+	if pieces := piecePriorities(m, prio); !reflect.DeepEqual(pieces, expected) {
+		t.Errorf("Expected piece priorities %v, got %v", expected, pieces)
+	}
+	if pieces := piecePriorities(m, nil); pieces[0] != PriorityNormal || pieces[4] != PriorityNormal {
+		t.Errorf("Pieces should be normal without file priorities: %v", pieces)
+	}
+}
+
+func TestMagnetSelectOnly(t *testing.T) {
+	info := formats.InfoDict{Name: "dir", PieceLen: 4, PiecesHash: make([]formats.Sha1, 3), Files: []formats.Info{
+		{Length: 4, Path: []string{"a"}},
+		{Length: 4, Path: []string{"b"}},
+		{Length: 4, Path: []string{"c"}},
+	}}
+	raw, err := formats.Marshall(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// index 7 is past the files
+	torr := &Torrent{magnet: &formats.Magnet{SelectOnly: []int{0, 2, 7}}}
+	if err := torr.setInfo(raw); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if expected := []Priority{PriorityNormal, PrioritySkip, PriorityNormal}; !reflect.DeepEqual(torr.filePrio, expected) {
+		t.Errorf("Expected %v, got %v", expected, torr.filePrio)
+	}
+}
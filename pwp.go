@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strconv"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/OLUWAMUYIWA/odor/formats"
@@ -37,13 +39,25 @@ type PeerConn struct {
 	}
 	b     formats.Bitfield
 	haves []int // if the peer does not use bitfield it must be using haves
+
+	shaker     *Shaker     // our handshake
+	peerShaker *Shaker     // the handshake of the peer, with the extensions it supports
+	ext        extensions  // extension protocol extensions
+	torrent    *Torrent    // the torrent the connection is for, if any
+	seed       atomic.Bool // whether the peer has all the pieces
+
+	pending     map[formats.Ibl]bool // blocks requested from the peer, not yet sent or rejected
+	requeued    []formats.Ibl        // blocks the peer will not send, to be requested again
+	allowedFast map[int]bool         // pieces the peer lets us request while it chokes us
+	suggested   []int                // pieces the peer suggests we request
+	pipe        pipeline             // sizes the queue of requests to the peer
 }
 
 // NewConn creates a tcp connection with a new peer
 func NewConn(ctx context.Context, addr PeerAddr) (*PeerConn, error) {
 	cl := &PeerConn{}
-	a := net.JoinHostPort(addr.ipv4.String(), strconv.Itoa(int(addr.port)))
-	conn, err := net.DialTimeout("tcp", a, time.Second*5)
+	d := net.Dialer{Timeout: time.Second * 5}
+	conn, err := d.DialContext(ctx, "tcp", addr.String())
 	if err != nil {
 		return nil, err
 	}
@@ -66,74 +80,163 @@ func (c *PeerConn) Shake(h *Shaker) error {
 	if !verifyhandShake(h, hRes) {
 		return fmt.Errorf("Invalid infoHash gotten. expected: % x. Got % x", h.infoHash, hRes.infoHash)
 	}
+	c.shaker, c.peerShaker = h, hRes
 
 	return nil
 }
 
+// ReqBitFields reads the pieces the peer has: its bitfield, or with the fast extension Have All or Have None.
+// Without the fast extension, a peer with no pieces may send no bitfield at all, so any other message, or none
+// coming in time, means it has nothing yet
 func (c *PeerConn) ReqBitFields() error {
 	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer c.conn.SetDeadline(time.Time{})
-	msg, err := formats.ReadMessage(c.conn)
-	if err != nil {
-		return err
+	for {
+		msg, err := formats.ReadMessage(c.conn)
+		if errors.Is(err, os.ErrDeadlineExceeded) && !c.supports(fastBit) {
+			c.b = c.noPieces()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch msg.ID {
+		case formats.Extended: // the extended handshake may come before the bitfield
+			if err := c.handleMsg(msg); err != nil {
+				return err
+			}
+			continue
+		case formats.BitField:
+			c.b = formats.Bitfield(msg.Payload)
+			c.updateSeed()
+			return nil
+		case formats.HaveAll, formats.HaveNone:
+			return c.handleMsg(msg)
+		}
+		if c.supports(fastBit) {
+			return fmt.Errorf("Expected bitfield, Have All or Have None, got: %s", *msg)
+		}
+		c.b = c.noPieces()
+		return c.handleMsg(msg)
 	}
-	if msg.ID != formats.BitField {
-		return fmt.Errorf("Expected bitfield, got: %s", *msg)
+}
+
+// noPieces gives an empty bitfield the size of the torrent
+func (c *PeerConn) noPieces() formats.Bitfield {
+	return make(formats.Bitfield, (c.numPieces()+7)/8)
+}
+
+// numPieces gives the number of pieces of the torrent, 0 while they are not known
+func (c *PeerConn) numPieces() int {
+	if c.torrent == nil {
+		return 0
 	}
-	b := formats.Bitfield(msg.Payload)
-	c.b = b
-	return nil
+	return len(c.torrent.pieceHashes())
 }
 
-func (c PeerConn) HasPiece(i int) bool {
-	return c.b.Has(i)
+// sendHaves tells the peer of the pieces we have. we don't upload, so it has none of them to request.
+// with the fast extension, this has to be said before any other message
+func (c *PeerConn) sendHaves() error {
+	if !c.supports(fastBit) {
+		return nil
+	}
+	return formats.NewHaveNone().Marshall(c.conn)
 }
 
-func (c *PeerConn) ReqPiece(q Queue, p PiecesState) {
-	if q.chocked {
+// updateSeed notes whether the peer has all the pieces, once the pieces are known
+func (c *PeerConn) updateSeed() {
+	if c.torrent == nil || !c.torrent.HasMetaInfo() {
 		return
 	}
-	for q.len() != 0 {
-		pBlock := q.deq()
-		if p.needed(pBlock) {
-			req := formats.NewRequest(pBlock)
-			req.Marshall(c.conn)
-			p.assertReqd(pBlock)
-			break
+	for i := range c.torrent.pieceHashes() {
+		if !c.b.Has(i) {
+			return
 		}
 	}
+	c.seed.Store(true)
 }
 
-func (c *PeerConn) DownloadPiece(ctx context.Context, pReq *PieceReq, errchan chan error) {
-	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.conn.SetDeadline(time.Time{})
+func (c *PeerConn) HasPiece(i int) bool {
+	return c.b.Has(i)
+}
+
+// pieceTimeout bounds the wait for the next message of a peer while we download from it
+const pieceTimeout = 30 * time.Second
 
-	numReqsSent := 0
-	begin := 0
-	var blockLen int = formats.BLOCK_LEN
-	// request for all blocks
-	for c.state.numReqsSent < pReq.len && begin < pReq.len {
-		// if client is both unchoked and interested
-		if c.state.connState == UnChkdIntd {
-			// the last block is not bound to be same length as the first n blocks
-			if pReq.len-begin < formats.BLOCK_LEN {
-				blockLen = pReq.len - begin
+// download downloads from the peer the blocks the picker gives, keeping as many requests going as the queue depth
+// of the peer. the pieces whose blocks are all in are verified here and sent on `pChan`
+func (c *PeerConn) download(ctx context.Context, pk *Picker, pChan chan *Piece) error {
+	t := c.torrent
+	for {
+		// rejected blocks go back to the picker, and the blocks other peers sent first are cancelled
+		for _, ibl := range c.Requeued() {
+			pk.dropped(c, ibl)
+		}
+		for _, ibl := range pk.takeCancels(c) {
+			if !c.pending[ibl] {
+				continue
+			}
+			if err := formats.NewCancel(ibl).Marshall(c.conn); err != nil {
+				return err
+			}
+			// with the fast extension the peer answers a cancel, with the block or a reject
+			if !c.supports(fastBit) {
+				delete(c.pending, ibl)
+				c.pipe.dropped(ibl)
+			}
+		}
+		if n := c.queueDepth() - len(c.pending); n > 0 {
+			blocks, err := pk.next(c, n)
+			if err != nil {
+				return err
 			}
-			if err := c.RequestBlock(ctx, pReq.index, begin, blockLen); err != nil {
-				errchan <- err
-				return
+			for _, ibl := range blocks {
+				if err := c.RequestBlock(ctx, ibl.Index, ibl.Begin, ibl.Length); err != nil {
+					return err
+				}
 			}
-			begin += blockLen
-			numReqsSent++
 		}
+
+		c.conn.SetReadDeadline(time.Now().Add(pieceTimeout))
 		msg, err := formats.ReadMessage(c.conn)
+		c.conn.SetReadDeadline(time.Time{})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
-			errchan <- err
+			return err
+		}
+		if msg.ID != formats.Piece {
+			if err := c.handleMsg(msg); err != nil {
+				return err
+			}
+			continue
+		}
+		p, err := formats.ParsePieceMsg(msg)
+		if err != nil {
+			return err
+		}
+		if !c.pending[formats.Ibl{Index: int(p.Index), Begin: int(p.Begin), Length: len(p.Block)}] {
+			continue // not a block we wait for. maybe one we cancelled
+		}
+		if err := c.handleMsg(msg); err != nil {
+			return err
+		}
+		buf, done := pk.received(c, p)
+		if !done {
+			continue
+		}
+		ok := t.verifyPiece(int(p.Index), buf)
+		pk.verified(int(p.Index), ok)
+		if !ok {
+			continue
+		}
+		select {
+		case pChan <- &Piece{index: int(p.Index), buf: buf}:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		err = c.handleMsg(msg)
-
 	}
-
 }
 
 func (c *PeerConn) Unchoke() error {
@@ -150,16 +253,38 @@ func (c *PeerConn) Uninterested() error {
 }
 
 func (c *PeerConn) RequestBlock(ctx context.Context, index int, begin int, length int) error {
-	req := formats.NewRequest(formats.Ibl{Index: index, Begin: begin, Length: length})
-	return req.Marshall(c.conn)
+	ibl := formats.Ibl{Index: index, Begin: begin, Length: length}
+	req := formats.NewRequest(ibl)
+	if err := req.Marshall(c.conn); err != nil {
+		return err
+	}
+	if c.pending == nil {
+		c.pending = map[formats.Ibl]bool{}
+	}
+	c.pending[ibl] = true
+	c.pipe.requested(ibl, time.Now())
+	return nil
 }
 
 func (c *PeerConn) handleMsg(msg *formats.Msg) error {
+	switch msg.ID {
+	case formats.HaveAll, formats.HaveNone, formats.Suggest, formats.RejectRequest, formats.AllowedFast:
+		if !c.supports(fastBit) {
+			return fmt.Errorf("Got %s without the fast extension", *msg)
+		}
+	}
 	switch msg.ID {
 	case formats.Choke:
 		{
 			c.state.connState = Chkd
-			return c.conn.Close()
+			// without the fast extension, a choke drops the requests the peer did not answer.
+			// with it, the peer rejects them one by one
+			if !c.supports(fastBit) {
+				for ibl := range c.pending {
+					c.reject(ibl)
+				}
+			}
+			return nil
 		}
 	case formats.Unchoke:
 		{
@@ -168,25 +293,92 @@ func (c *PeerConn) handleMsg(msg *formats.Msg) error {
 		}
 	case formats.Have:
 		{
-			if msg.ID != formats.Have {
-				return fmt.Errorf("Error parsing Have message, incorrect ID")
-			}
-			if len(msg.Payload) != 4 {
-				return fmt.Errorf("Payload length should be 4, but is: %d", len(msg.Payload))
+			i, err := formats.ParseIndex(msg)
+			if err != nil {
+				return err
 			}
-			i := binary.BigEndian.Uint32(msg.Payload)
-			c.b.Set(int(i))
+			c.b.Set(i)
+			c.updateSeed()
+			c.updatePicker()
 			return nil
 		}
+	case formats.HaveAll:
+		c.b = c.noPieces()
+		// the spare bits past the last piece stay clear, as in a bitfield
+		for i := 0; i < c.numPieces(); i++ {
+			c.b.Set(i)
+		}
+		c.seed.Store(true)
+		c.updatePicker()
+		return nil
+	case formats.HaveNone:
+		c.b = c.noPieces()
+		c.updatePicker()
+		return nil
 	case formats.Piece:
 		{
-			_, err := formats.ParsePieceMsg(msg)
+			p, err := formats.ParsePieceMsg(msg)
 			if err != nil {
 				return err
 			}
+			ibl := formats.Ibl{Index: int(p.Index), Begin: int(p.Begin), Length: len(p.Block)}
+			delete(c.pending, ibl)
+			c.pipe.received(ibl, time.Now())
+			if c.torrent != nil {
+				c.torrent.downloaded.Add(int64(len(p.Block)))
+			}
 
 			return nil
 		}
+	case formats.Request:
+		// we don't upload. with the fast extension, the peer is told so instead of waiting
+		if !c.supports(fastBit) {
+			return nil
+		}
+		ibl, err := formats.ParseIbl(msg)
+		if err != nil {
+			return err
+		}
+		return formats.NewReject(ibl).Marshall(c.conn)
+	case formats.RejectRequest:
+		ibl, err := formats.ParseIbl(msg)
+		if err != nil {
+			return err
+		}
+		if !c.pending[ibl] {
+			return fmt.Errorf("Peer %s rejected a block we did not request: %v", c.addr, ibl)
+		}
+		c.reject(ibl)
+		return nil
+	case formats.AllowedFast:
+		i, err := formats.ParseIndex(msg)
+		if err != nil {
+			return err
+		}
+		if c.allowedFast == nil {
+			c.allowedFast = map[int]bool{}
+		}
+		c.allowedFast[i] = true
+		return nil
+	case formats.Suggest:
+		i, err := formats.ParseIndex(msg)
+		if err != nil {
+			return err
+		}
+		c.suggested = append(c.suggested, i)
+		return nil
+	case formats.Port:
+		// the peer runs a DHT node. it may take a place in our routing table
+		if len(msg.Payload) != 2 {
+			return fmt.Errorf("Payload length should be 2, but is: %d", len(msg.Payload))
+		}
+		if dhtNode != nil && c.supports(dhtBit) {
+			addr := &net.UDPAddr{IP: c.addr.ipv4, Port: int(binary.BigEndian.Uint16(msg.Payload))}
+			go dhtNode.AddNode(context.Background(), addr)
+		}
+		return nil
+	case formats.Extended:
+		return c.handleExtended(msg)
 		// comeback
 	default:
 		{
@@ -195,3 +387,33 @@ func (c *PeerConn) handleMsg(msg *formats.Msg) error {
 	}
 
 }
+
+// updatePicker tells the picker of the download the pieces the peer has now
+func (c *PeerConn) updatePicker() {
+	if c.torrent == nil {
+		return
+	}
+	if pk := c.torrent.getPicker(); pk != nil {
+		pk.update(c)
+	}
+}
+
+// reject takes back a request the peer will not answer, for the block to be requested again
+func (c *PeerConn) reject(ibl formats.Ibl) {
+	delete(c.pending, ibl)
+	c.pipe.dropped(ibl)
+	c.requeued = append(c.requeued, ibl)
+}
+
+// Requeued gives the blocks the peer rejected since the last call
+func (c *PeerConn) Requeued() []formats.Ibl {
+	r := c.requeued
+	c.requeued = nil
+	return r
+}
+
+// CanRequest reports whether a piece can be requested from the peer: it must have the piece, and not choke us,
+// unless the piece is in the allowed fast set it gave us
+func (c *PeerConn) CanRequest(index int) bool {
+	return c.b.Has(index) && (c.state.connState != Chkd || c.allowedFast[index])
+}
@@ -1,22 +1,520 @@
 package main
 
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// Picker picks the blocks each peer is asked for, for the workers of a download to share the pieces.
+// pieces of a higher priority go first, and skipped ones are not picked. of the same priority, pieces already started
+// go before new ones, so they get done and can be verified. new pieces are picked at random until the first one is
+// verified, then the rarest first. once every block is requested, the blocks still pending are requested from the
+// other peers too, and cancelled on the peers that did not send them first: the end game.
+// when streaming, the pieces readers need go before all others, the earliest deadline first, and new pieces are
+// picked in order
+type Picker struct {
+	mu      sync.Mutex
+	m       formats.MetaInfo
+	peers   map[*PeerConn]formats.Bitfield // the pieces of each peer, as they were counted in `avail`
+	avail   []int                          // the number of peers that have each piece
+	have    formats.Bitfield               // pieces verified
+	prio    []Priority                     // priority of each piece
+	pieces  PiecesState                    // blocks requested and received
+	left    int                            // blocks not requested, of the pieces we want and don't have
+	bufs    map[int][]byte                 // the pieces started, as their blocks come
+	from    map[int]map[*PeerConn]bool     // the peers that sent blocks of each piece started
+	reqs    map[formats.Ibl][]*PeerConn    // the peers a block is pending with. more than one in the end game
+	owner   map[int]*PeerConn              // pieces that failed their hash check, to be downloaded from one peer alone
+	cancels map[*PeerConn][]formats.Ibl    // requests another peer answered, for the worker of the peer to cancel
+	banned  map[*PeerConn]bool             // peers that sent a piece that failed its hash check
+	done    int                            // the number of pieces verified
+
+	deadlines  map[int]time.Time // pieces readers need, and by when. wanted even if skipped
+	sequential bool              // whether new pieces are picked in order
+}
+
+func NewPicker(m formats.MetaInfo) *Picker {
+	n := len(m.Info.PiecesHash)
+	p := &Picker{
+		m:       m,
+		peers:   map[*PeerConn]formats.Bitfield{},
+		avail:   make([]int, n),
+		have:    make(formats.Bitfield, (n+7)/8),
+		prio:    piecePriorities(m, nil),
+		pieces:  NewPieces(m),
+		bufs:    map[int][]byte{},
+		from:    map[int]map[*PeerConn]bool{},
+		reqs:    map[formats.Ibl][]*PeerConn{},
+		owner:   map[int]*PeerConn{},
+		cancels: map[*PeerConn][]formats.Ibl{},
+		banned:  map[*PeerConn]bool{},
+	}
+	p.countLeft()
+	return p
+}
+
+// setPriorities sets the priority of each piece
+func (p *Picker) setPriorities(prio []Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prio = prio
+	p.countLeft()
+}
+
+// setDeadlines sets the pieces readers need, and by when
+func (p *Picker) setDeadlines(deadlines map[int]time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadlines = deadlines
+	p.countLeft()
+}
+
+func (p *Picker) setSequential(on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sequential = on
+}
+
+// wants reports whether a piece is to be downloaded: one we don't have, not skipped or needed by a reader.
+// p.mu must be held
+func (p *Picker) wants(i int) bool {
+	if p.have.Has(i) {
+		return false
+	}
+	_, needed := p.deadlines[i]
+	return p.prio[i] != PrioritySkip || needed
+}
+
+// countLeft counts the blocks not requested of the pieces we want. p.mu must be held
+func (p *Picker) countLeft() {
+	p.left = 0
+	for i := range p.prio {
+		if !p.wants(i) {
+			continue
+		}
+		for _, reqd := range p.pieces.Reqd[i].done {
+			if !reqd {
+				p.left++
+			}
+		}
+	}
+}
+
+// missing gives the number of pieces we want that are not in `got`
+func (p *Picker) missing(got formats.Bitfield) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for i := range p.prio {
+		_, needed := p.deadlines[i]
+		if (p.prio[i] != PrioritySkip || needed) && !got.Has(i) {
+			n++
+		}
+	}
+	return n
+}
+
+// addPeer counts the pieces of a peer we download from
+func (p *Picker) addPeer(c *PeerConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peers[c] = nil
+	p.count(c)
+}
+
+// update counts the pieces a peer got since it was added, from its Have messages
+func (p *Picker) update(c *PeerConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.peers[c]; ok {
+		p.count(c)
+	}
+}
+
+// count brings the availability of the pieces up to date with the bitfield of a peer. p.mu must be held
+func (p *Picker) count(c *PeerConn) {
+	old := p.peers[c]
+	b := make(formats.Bitfield, len(p.have))
+	for i := range p.avail {
+		if c.HasPiece(i) {
+			b.Set(i)
+			if !old.Has(i) {
+				p.avail[i]++
+			}
+		} else if old.Has(i) {
+			p.avail[i]--
+		}
+	}
+	p.peers[c] = b
+}
+
+// removePeer forgets a peer we no longer download from. its pending blocks are for the others to request,
+// and so is the piece it was downloading alone
+func (p *Picker) removePeer(c *PeerConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.avail {
+		if p.peers[c].Has(i) {
+			p.avail[i]--
+		}
+	}
+	delete(p.peers, c)
+	for ibl, cs := range p.reqs {
+		for _, o := range cs {
+			if o == c {
+				p.drop(c, ibl)
+				break
+			}
+		}
+	}
+	for i, o := range p.owner {
+		if o == c {
+			p.reset(i)
+			p.owner[i] = nil
+		}
+	}
+	delete(p.cancels, c)
+}
+
+// dropped takes back a request the peer will not answer
+func (p *Picker) dropped(c *PeerConn, ibl formats.Ibl) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.drop(c, ibl)
+}
+
+// drop takes a peer off the requesters of a block. a block no one is asked for anymore is to be requested again.
+// p.mu must be held
+func (p *Picker) drop(c *PeerConn, ibl formats.Ibl) {
+	cs, ok := p.reqs[ibl]
+	if !ok {
+		return
+	}
+	for j, o := range cs {
+		if o == c {
+			cs = append(cs[:j:j], cs[j+1:]...)
+			break
+		}
+	}
+	if len(cs) > 0 {
+		p.reqs[ibl] = cs
+		return
+	}
+	delete(p.reqs, ibl)
+	p.pieces.requeue(ibl)
+	if p.wants(ibl.Index) {
+		p.left++
+	}
+}
+
+// reset makes a piece to be downloaded again from the start. the requests pending for it are cancelled. p.mu must be held
+func (p *Picker) reset(i int) {
+	if _, ok := p.bufs[i]; !ok {
+		return
+	}
+	for j, reqd := range p.pieces.Reqd[i].done {
+		if !reqd {
+			continue
+		}
+		if p.wants(i) {
+			p.left++
+		}
+		ibl := p.block(i, j)
+		for _, o := range p.reqs[ibl] {
+			p.cancels[o] = append(p.cancels[o], ibl)
+		}
+		delete(p.reqs, ibl)
+	}
+	p.pieces.reset(i)
+	delete(p.bufs, i)
+	delete(p.from, i)
+}
+
+func (p *Picker) block(i, j int) formats.Ibl {
+	return formats.Ibl{Index: i, Begin: j * formats.BLOCK_LEN, Length: p.m.BlockLen(i, j)}
+}
+
+// next picks up to `n` blocks to request from a peer, and takes them as requested
+func (p *Picker) next(c *PeerConn, n int) ([]formats.Ibl, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.banned[c] {
+		return nil, fmt.Errorf("Peer %s sent a piece that does not match its hash", c.addr)
+	}
+	blocks := p.urgent(c, n)
+	for len(blocks) < n {
+		i, j := p.partial(c), -1
+		switch {
+		case p.sequential:
+			j = p.seq(c)
+		case p.done == 0:
+			j = p.rpf(c)
+		default:
+			j = p.rf(c)
+		}
+		// a new piece goes before those started only if it is of a higher priority
+		if i < 0 || j >= 0 && p.prio[j] > p.prio[i] {
+			i = j
+		}
+		if i < 0 {
+			break
+		}
+		blocks = append(blocks, p.request(c, i, n-len(blocks))...)
+	}
+	if len(blocks) == 0 && p.left == 0 {
+		blocks = p.end(c, n)
+	}
+	return blocks, nil
+}
+
+// canPick reports whether blocks of a piece can be requested from a peer: the piece must be wanted, the peer must let
+// us request it, the piece must have blocks not requested, and not be downloaded by another peer alone. p.mu must be held
+func (p *Picker) canPick(c *PeerConn, i int) bool {
+	if !p.wants(i) || !c.CanRequest(i) {
+		return false
+	}
+	if o := p.owner[i]; o != nil && o != c {
+		return false
+	}
+	for j, reqd := range p.pieces.Reqd[i].done {
+		if !reqd && !p.pieces.Recvd[i].done[j] {
+			return true
+		}
+	}
+	return false
+}
+
+// partial gives the pieces started that the peer can be asked for, the rarest of the highest priority.
+// -1 if there are none. p.mu must be held
+func (p *Picker) partial(c *PeerConn) int {
+	best := -1
+	for i := range p.bufs {
+		if !p.canPick(c, i) {
+			continue
+		}
+		if best < 0 || p.prio[i] > p.prio[best] || p.prio[i] == p.prio[best] && p.avail[i] < p.avail[best] {
+			best = i
+		}
+	}
+	return best
+}
+
 // random first piece
 // When downloading first begins, as the peer has nothing to upload, a piece is selected at random to get the download started.
 // Random pieces are then chosen until the first piece is completed and checked.
-func rpf() {
-
+// the piece is one of the highest priority. it gives -1 if the peer has no piece we can start. p.mu must be held
+func (p *Picker) rpf(c *PeerConn) int {
+	pick, seen := -1, 0
+	for i := range p.avail {
+		if _, started := p.bufs[i]; started || !p.canPick(c, i) {
+			continue
+		}
+		if pick >= 0 && p.prio[i] < p.prio[pick] {
+			continue
+		}
+		if pick >= 0 && p.prio[i] > p.prio[pick] {
+			seen = 0
+		}
+		// each piece is kept with the same chance
+		if seen++; rand.Intn(seen) == 0 {
+			pick = i
+		}
+	}
+	return pick
 }
 
 // rarest first
 // stage 2
 // requests for the piece held by the lowest number of peers
-// most common pieces are left until later, and focus goes to replication of rarer pieces
-func rf() {
+// most common pieces are left until later, and focus goes to replication of rarer pieces.
+// the rarest of the highest priority are picked from at random. it gives -1 if the peer has no piece we can start.
+// p.mu must be held
+func (p *Picker) rf(c *PeerConn) int {
+	pick, seen := -1, 0
+	for i := range p.avail {
+		if _, started := p.bufs[i]; started || !p.canPick(c, i) {
+			continue
+		}
+		switch {
+		case pick < 0 || p.prio[i] > p.prio[pick] || p.prio[i] == p.prio[pick] && p.avail[i] < p.avail[pick]:
+			pick, seen = i, 1
+		case p.prio[i] == p.prio[pick] && p.avail[i] == p.avail[pick]:
+			if seen++; rand.Intn(seen) == 0 {
+				pick = i
+			}
+		}
+	}
+	return pick
+}
+
+// seq gives the first of the pieces of the highest priority the peer can start, -1 if there are none. p.mu must be held
+func (p *Picker) seq(c *PeerConn) int {
+	pick := -1
+	for i := range p.avail {
+		if _, started := p.bufs[i]; started || !p.canPick(c, i) {
+			continue
+		}
+		if pick < 0 || p.prio[i] > p.prio[pick] {
+			pick = i
+		}
+	}
+	return pick
+}
 
+// urgent gives up to `n` blocks of the pieces readers need, the earliest deadline first. the blocks of a piece past
+// its deadline that are pending with other peers are asked of this one too. p.mu must be held
+func (p *Picker) urgent(c *PeerConn, n int) []formats.Ibl {
+	if len(p.deadlines) == 0 {
+		return nil
+	}
+	pieces := make([]int, 0, len(p.deadlines))
+	for i := range p.deadlines {
+		if !p.have.Has(i) {
+			pieces = append(pieces, i)
+		}
+	}
+	sort.Slice(pieces, func(a, b int) bool { return p.deadlines[pieces[a]].Before(p.deadlines[pieces[b]]) })
+	now := time.Now()
+	var blocks []formats.Ibl
+	for _, i := range pieces {
+		if len(blocks) == n {
+			break
+		}
+		if p.canPick(c, i) {
+			blocks = append(blocks, p.request(c, i, n-len(blocks))...)
+			continue
+		}
+		if !p.deadlines[i].Before(now) {
+			continue
+		}
+		for j := range p.pieces.Reqd[i].done {
+			if ibl := p.block(i, j); len(blocks) < n && p.also(c, ibl) {
+				blocks = append(blocks, ibl)
+			}
+		}
+	}
+	return blocks
+}
+
+// request takes up to `n` blocks of a piece not requested yet as requested from a peer. p.mu must be held
+func (p *Picker) request(c *PeerConn, i, n int) []formats.Ibl {
+	if _, ok := p.bufs[i]; !ok {
+		p.bufs[i] = make([]byte, p.m.PieceLen(i))
+		p.from[i] = map[*PeerConn]bool{}
+	}
+	if o, ok := p.owner[i]; ok && o == nil {
+		p.owner[i] = c
+	}
+	var blocks []formats.Ibl
+	for j, reqd := range p.pieces.Reqd[i].done {
+		if len(blocks) == n {
+			break
+		}
+		if reqd || p.pieces.Recvd[i].done[j] {
+			continue
+		}
+		ibl := p.block(i, j)
+		p.pieces.assertReqd(ibl)
+		p.reqs[ibl] = []*PeerConn{c}
+		p.left--
+		blocks = append(blocks, ibl)
+	}
+	return blocks
 }
 
 // end game.
-// close to the end download ma slow. the client requests blocks from all peers
-func end() {
+// close to the end download ma slow. the client requests blocks from all peers.
+// it gives up to `n` blocks pending with other peers, and takes them as requested from this one too. p.mu must be held
+func (p *Picker) end(c *PeerConn, n int) []formats.Ibl {
+	var blocks []formats.Ibl
+	for ibl := range p.reqs {
+		if len(blocks) == n {
+			break
+		}
+		if p.also(c, ibl) {
+			blocks = append(blocks, ibl)
+		}
+	}
+	return blocks
+}
 
-}
\ No newline at end of file
+// also takes a block pending with other peers as requested from this one too, if it can be asked for it.
+// p.mu must be held
+func (p *Picker) also(c *PeerConn, ibl formats.Ibl) bool {
+	cs, pending := p.reqs[ibl]
+	if !pending || !c.CanRequest(ibl.Index) {
+		return false
+	}
+	if _, alone := p.owner[ibl.Index]; alone {
+		return false
+	}
+	for _, o := range cs {
+		if o == c {
+			return false
+		}
+	}
+	p.reqs[ibl] = append(cs, c)
+	return true
+}
+
+// received puts a block in its piece. the requests of the block pending with other peers are to be cancelled.
+// once all its blocks are in, the piece is given to be verified. a block that came already is left out
+func (p *Picker) received(c *PeerConn, pm formats.PieceMsg) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := int(pm.Index)
+	ibl := formats.Ibl{Index: i, Begin: int(pm.Begin), Length: len(pm.Block)}
+	cs, ok := p.reqs[ibl]
+	if !ok { // a block that came from another peer, or of a piece started again
+		return nil, false
+	}
+	for _, o := range cs {
+		if o != c {
+			p.cancels[o] = append(p.cancels[o], ibl)
+		}
+	}
+	delete(p.reqs, ibl)
+	copy(p.bufs[i][ibl.Begin:], pm.Block)
+	p.pieces.assertRecvd(pm)
+	p.from[i][c] = true
+	if !p.pieces.pieceDone(i) {
+		return nil, false
+	}
+	return p.bufs[i], true
+}
+
+// verified takes the outcome of the hash check of a piece. a piece that fails is downloaded again, from one peer alone
+// if more than one sent it, for the next failure to tell which peer sends bad data. a peer that sent it alone is banned
+func (p *Picker) verified(i int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok {
+		p.have.Set(i)
+		p.done++
+		delete(p.bufs, i)
+		delete(p.from, i)
+		delete(p.owner, i)
+		return
+	}
+	if from := p.from[i]; len(from) == 1 {
+		for c := range from {
+			p.banned[c] = true
+		}
+	}
+	p.reset(i)
+	p.owner[i] = nil
+}
+
+// takeCancels gives the requests to cancel on a peer, as another peer answered them first
+func (p *Picker) takeCancels(c *PeerConn) []formats.Ibl {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cancels := p.cancels[c]
+	delete(p.cancels, c)
+	return cancels
+}
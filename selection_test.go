@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// pickerPeer makes an unchoked peer that has the pieces given
+func pickerPeer(port uint16, n int, pieces ...int) *PeerConn {
+	c := &PeerConn{addr: PeerAddr{net.IPv4(127, 0, 0, 1), port}, b: make(formats.Bitfield, (n+7)/8)}
+	c.state.connState = UnChkd
+	for _, i := range pieces {
+		c.b.Set(i)
+	}
+	return c
+}
+
+// pickerMeta is a torrent of `n` pieces of two blocks each
+func pickerMeta(n int) formats.MetaInfo {
+	return formats.MetaInfo{Info: formats.InfoDict{
+		PieceLen:   2 * formats.BLOCK_LEN,
+		Length:     2 * formats.BLOCK_LEN * n,
+		PiecesHash: make([]formats.Sha1, n),
+	}}
+}
+
+func block(ibl formats.Ibl) formats.PieceMsg {
+	return formats.PieceMsg{Index: uint32(ibl.Index), Begin: uint32(ibl.Begin), Block: make([]byte, ibl.Length)}
+}
+
+func TestPickerRandomFirst(t *testing.T) {
+	firsts := map[int]bool{}
+	for k := 0; k < 50; k++ {
+		pk := NewPicker(pickerMeta(6))
+		a, b := pickerPeer(1, 6, 0, 1, 2, 3, 4, 5), pickerPeer(2, 6, 0, 1, 2, 3, 4, 5)
+		pk.addPeer(a)
+		pk.addPeer(b)
+		blocks, err := pk.next(a, 1)
+		if err != nil || len(blocks) != 1 {
+			t.Fatalf("Expected a block, got %v: %v", blocks, err)
+		}
+		firsts[blocks[0].Index] = true
+		// the piece a started goes first for b
+		more, _ := pk.next(b, 1)
+		if len(more) != 1 || more[0].Index != blocks[0].Index || more[0].Begin != formats.BLOCK_LEN {
+			t.Fatalf("Expected the rest of piece %d, got %v", blocks[0].Index, more)
+		}
+	}
+	if len(firsts) < 2 {
+		t.Errorf("First pieces should be random, got %v", firsts)
+	}
+}
+
+func TestPickerRarestFirst(t *testing.T) {
+	pk := NewPicker(pickerMeta(6))
+	a := pickerPeer(1, 6, 0, 1, 2, 3, 4, 5)
+	b := pickerPeer(2, 6, 0, 1, 2, 3)
+	c := pickerPeer(3, 6, 0, 1)
+	for _, p := range []*PeerConn{a, b, c} {
+		pk.addPeer(p)
+	}
+	// the first piece is verified: random first is over
+	blocks, _ := pk.next(c, 2)
+	for _, ibl := range blocks {
+		pk.received(c, block(ibl))
+	}
+	pk.verified(blocks[0].Index, true)
+
+	// of the pieces of b, 2 and 3 are the rarest
+	blocks, _ = pk.next(b, 4)
+	if len(blocks) != 4 {
+		t.Fatalf("Expected 4 blocks, got %v", blocks)
+	}
+	for _, ibl := range blocks {
+		if ibl.Index != 2 && ibl.Index != 3 {
+			t.Errorf("Expected pieces 2 and 3, got %v", blocks)
+		}
+	}
+	// a gets the pieces it alone has first, then the one left
+	blocks, _ = pk.next(a, 6)
+	if len(blocks) != 6 {
+		t.Fatalf("Expected 6 blocks, got %v", blocks)
+	}
+	for _, ibl := range blocks[:4] {
+		if ibl.Index < 4 {
+			t.Errorf("Expected pieces 4 and 5 first, got %v", blocks)
+		}
+	}
+
+	// a Have makes a piece less rare
+	c.b.Set(4)
+	pk.update(c)
+	if pk.avail[4] != 2 {
+		t.Errorf("Expected piece 4 with 2 peers, got %d", pk.avail[4])
+	}
+	pk.removePeer(a)
+	if pk.avail[4] != 1 || pk.avail[5] != 0 {
+		t.Errorf("Availability not updated on removal: %v", pk.avail)
+	}
+	// the blocks a was asked for are for the others
+	blocks, _ = pk.next(c, 2)
+	if len(blocks) != 2 || blocks[0].Index != 4 {
+		t.Errorf("Expected the blocks of piece 4 a left, got %v", blocks)
+	}
+}
+
+func TestPickerEndGame(t *testing.T) {
+	pk := NewPicker(pickerMeta(1))
+	a, b := pickerPeer(1, 1, 0), pickerPeer(2, 1, 0)
+	pk.addPeer(a)
+	pk.addPeer(b)
+	blocks, _ := pk.next(a, 5)
+	if len(blocks) != 2 {
+		t.Fatalf("Expected the 2 blocks, got %v", blocks)
+	}
+	// every block is requested: b is asked for those pending with a
+	dup, _ := pk.next(b, 5)
+	if len(dup) != 2 {
+		t.Fatalf("Expected the 2 blocks in the end game, got %v", dup)
+	}
+	if again, _ := pk.next(b, 5); len(again) != 0 {
+		t.Errorf("Blocks should be asked once of a peer, got %v", again)
+	}
+
+	if _, done := pk.received(a, block(blocks[0])); done {
+		t.Errorf("Piece should not be done")
+	}
+	if cancels := pk.takeCancels(b); len(cancels) != 1 || cancels[0] != blocks[0] {
+		t.Errorf("Expected %v cancelled on b, got %v", blocks[0], cancels)
+	}
+	// the same block from b is left out
+	if _, done := pk.received(b, block(blocks[0])); done {
+		t.Errorf("Duplicate block should be left out")
+	}
+	if buf, done := pk.received(b, block(blocks[1])); !done || len(buf) != 2*formats.BLOCK_LEN {
+		t.Errorf("Piece should be done")
+	}
+	if cancels := pk.takeCancels(a); len(cancels) != 1 || cancels[0] != blocks[1] {
+		t.Errorf("Expected %v cancelled on a, got %v", blocks[1], cancels)
+	}
+	pk.verified(0, true)
+	if blocks, _ := pk.next(a, 5); len(blocks) != 0 {
+		t.Errorf("Nothing should be left, got %v", blocks)
+	}
+}
+
+func TestPickerHashFailure(t *testing.T) {
+	pk := NewPicker(pickerMeta(1))
+	a, b := pickerPeer(1, 1, 0), pickerPeer(2, 1, 0)
+	pk.addPeer(a)
+	pk.addPeer(b)
+	x, _ := pk.next(a, 1)
+	y, _ := pk.next(b, 1)
+	pk.received(a, block(x[0]))
+	if _, done := pk.received(b, block(y[0])); !done {
+		t.Fatalf("Piece should be done")
+	}
+	// no telling who sent bad data. the piece goes to one peer alone
+	pk.verified(0, false)
+	blocks, err := pk.next(a, 5)
+	if err != nil || len(blocks) != 2 {
+		t.Fatalf("Expected the 2 blocks from a, got %v: %v", blocks, err)
+	}
+	if others, _ := pk.next(b, 5); len(others) != 0 {
+		t.Errorf("The piece should be a's alone, b got %v", others)
+	}
+	for _, ibl := range blocks {
+		pk.received(a, block(ibl))
+	}
+	pk.verified(0, false)
+	if _, err := pk.next(a, 5); err == nil {
+		t.Errorf("a sent a bad piece alone, and should be banned")
+	}
+	if blocks, err := pk.next(b, 5); err != nil || len(blocks) != 2 {
+		t.Errorf("Expected the 2 blocks from b, got %v: %v", blocks, err)
+	}
+}
+
+func TestPickerPriorities(t *testing.T) {
+	pk := NewPicker(pickerMeta(4))
+	pk.setPriorities([]Priority{PriorityLow, PrioritySkip, PriorityHigh, PriorityNormal})
+	if n := pk.missing(nil); n != 3 {
+		t.Errorf("Expected 3 pieces wanted, got %d", n)
+	}
+	a := pickerPeer(1, 4, 0, 1, 2, 3)
+	pk.addPeer(a)
+	first, _ := pk.next(a, 1)
+	if first[0].Index != 2 {
+		t.Fatalf("Expected the high piece first, got %v", first)
+	}
+	// the rest of it, then the normal piece, then the low one
+	blocks, _ := pk.next(a, 8)
+	var order []int
+	for _, ibl := range blocks {
+		order = append(order, ibl.Index)
+	}
+	if expected := []int{2, 3, 3, 0, 0}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("Expected the pieces %v, got %v", expected, order)
+	}
+	// the skipped piece is left out of the end game too
+	b := pickerPeer(2, 4, 1)
+	pk.addPeer(b)
+	if blocks, _ := pk.next(b, 8); len(blocks) != 0 {
+		t.Errorf("Skipped piece should not be picked, got %v", blocks)
+	}
+}
+
+func TestPickerDeadlines(t *testing.T) {
+	pk := NewPicker(pickerMeta(6))
+	pk.setPriorities([]Priority{PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal, PrioritySkip})
+	pk.setSequential(true)
+	a, b := pickerPeer(1, 6, 0, 1, 2, 3, 4, 5), pickerPeer(2, 6, 0, 1, 2, 3, 4, 5)
+	pk.addPeer(a)
+	pk.addPeer(b)
+	// new pieces in order
+	if blocks, _ := pk.next(a, 1); len(blocks) != 1 || blocks[0].Index != 0 {
+		t.Errorf("Expected piece 0 first, got %v", blocks)
+	}
+	// readers need the skipped piece 5 first, then 3. the piece past its deadline is asked of b too
+	now := time.Now()
+	pk.setDeadlines(map[int]time.Time{3: now.Add(time.Hour), 5: now.Add(-time.Second)})
+	if n := pk.missing(nil); n != 6 {
+		t.Errorf("Expected the skipped piece wanted, got %d pieces", n)
+	}
+	blocks, _ := pk.next(a, 3)
+	if len(blocks) != 3 || blocks[0].Index != 5 || blocks[1].Index != 5 || blocks[2].Index != 3 {
+		t.Fatalf("Expected pieces 5 and 3 first, got %v", blocks)
+	}
+	blocks, _ = pk.next(b, 4)
+	if len(blocks) != 4 || blocks[0].Index != 5 || blocks[1].Index != 5 || blocks[2] != (formats.Ibl{Index: 3, Begin: formats.BLOCK_LEN, Length: formats.BLOCK_LEN}) || blocks[3].Index != 0 {
+		t.Errorf("Expected piece 5 again, the rest of 3, then of 0, got %v", blocks)
+	}
+	// once no reader needs it, the skipped piece is not wanted
+	pk.setDeadlines(nil)
+	if n := pk.missing(nil); n != 5 {
+		t.Errorf("Expected 5 pieces wanted, got %d", n)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// Storage writes verified pieces into the files of the torrent. A single-file torrent is saved as `<dir>/<name>`,
+// a directory torrent as the tree `<dir>/<name>/<path...>`. Pieces are split across the files they span.
+// Skipped files are not created: the data a piece has of them goes to the part file, `<dir>/.<name>.parts`,
+// at the offset of the piece in the torrent
+type Storage struct {
+	mInfo    formats.MetaInfo
+	files    []*os.File // in the order of `FileList`. nil for skipped files
+	partPath string
+	readOnly bool
+	partMu   sync.Mutex // pieces are written concurrently
+	part     *os.File   // opened with the first piece that has data of a skipped file
+}
+
+// NewStorage creates the files of the torrent (and the directories holding them) in `dir`, each set to its full length.
+// the files `skip` has true for are not
+func NewStorage(dir string, m formats.MetaInfo, skip []bool) (*Storage, error) {
+	return openStorage(dir, m, skip, false)
+}
+
+// OpenStorage opens the files a download with the same `skip` creates, to read pieces back while it writes them.
+// nothing is created or truncated
+func OpenStorage(dir string, m formats.MetaInfo, skip []bool) (*Storage, error) {
+	return openStorage(dir, m, skip, true)
+}
+
+func openStorage(dir string, m formats.MetaInfo, skip []bool, readOnly bool) (*Storage, error) {
+	s := &Storage{mInfo: m, partPath: filepath.Join(dir, "."+m.Info.Name+".parts"), readOnly: readOnly}
+	for i, f := range m.FileList() {
+		if i < len(skip) && skip[i] {
+			s.files = append(s.files, nil)
+			continue
+		}
+		p, err := filePath(dir, m.Info, f)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if readOnly {
+			file, err := os.Open(p)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			s.files = append(s.files, file)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			s.Close()
+			return nil, err
+		}
+		file, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, file)
+		if err := file.Truncate(int64(f.Length)); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// filePath joins the path of a file under `dir`. the components come from the torrent, so they are
+// not allowed to climb out of the directory
+func filePath(dir string, info formats.InfoDict, f formats.Info) (string, error) {
+	comps := []string{info.Name}
+	if info.IsDir() {
+		comps = append(comps, f.Path...)
+	}
+	for _, c := range comps {
+		if c == "" || c == "." || c == ".." || strings.ContainsAny(c, `/\`) {
+			return "", fmt.Errorf("Invalid path component %q in torrent", c)
+		}
+	}
+	return filepath.Join(append([]string{dir}, comps...)...), nil
+}
+
+// WritePiece writes a whole piece at its place in the files it spans
+func (s *Storage) WritePiece(index int, buf []byte) error {
+	for _, span := range s.mInfo.PieceSpans(index) {
+		b := buf[span.Begin : span.Begin+span.Length]
+		f, off, err := s.at(index, span)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(b, off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadPiece reads a whole piece back from the files it spans
+func (s *Storage) ReadPiece(index int) ([]byte, error) {
+	buf := make([]byte, s.mInfo.PieceLen(index))
+	for _, span := range s.mInfo.PieceSpans(index) {
+		b := buf[span.Begin : span.Begin+span.Length]
+		f, off, err := s.at(index, span)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.ReadAt(b, off); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// at gives where the span of a piece is stored: in its file, or in the part file if the file is skipped
+func (s *Storage) at(index int, span formats.FileSpan) (*os.File, int64, error) {
+	if f := s.files[span.File]; f != nil {
+		return f, int64(span.Offset), nil
+	}
+	s.partMu.Lock()
+	defer s.partMu.Unlock()
+	if s.part == nil {
+		flag := os.O_CREATE | os.O_RDWR
+		if s.readOnly {
+			flag = os.O_RDONLY
+		}
+		part, err := os.OpenFile(s.partPath, flag, 0666)
+		if err != nil {
+			return nil, 0, err
+		}
+		s.part = part
+	}
+	return s.part, int64(index)*int64(s.mInfo.Info.PieceLen) + int64(span.Begin), nil
+}
+
+func (s *Storage) Close() error {
+	var err error
+	for _, f := range s.files {
+		if f == nil {
+			continue
+		}
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if s.part != nil {
+		if e := s.part.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
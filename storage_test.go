@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+func TestStorageMultiFile(t *testing.T) {
+	m := formats.MetaInfo{Info: formats.InfoDict{
+		Name:     "dir",
+		PieceLen: 8,
+		Files: []formats.Info{
+			{Length: 5, Path: []string{"a", "a.txt"}},
+			{Length: 0, Path: []string{"empty"}},
+			{Length: 14, Path: []string{"b"}},
+		},
+	}}
+	data := []byte("0123456789abcdefghi")
+	m.Info.PiecesHash = make([]formats.Sha1, 3)
+
+	dir := t.TempDir()
+	st, err := NewStorage(dir, m, nil)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	// write the pieces out of order
+	for _, i := range []int{2, 0, 1} {
+		start, end := m.PieceBounds(i)
+		if err := st.WritePiece(i, data[start:end]); err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		start, end := m.PieceBounds(i)
+		b, err := st.ReadPiece(i)
+		if err != nil || !bytes.Equal(b, data[start:end]) {
+			t.Errorf("Piece %d: expected %q, got %q: %v", i, data[start:end], b, err)
+		}
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+
+	expected := map[string]string{
+		"a/a.txt": "01234",
+		"empty":   "",
+		"b":       "56789abcdefghi",
+	}
+	for p, content := range expected {
+		b, err := os.ReadFile(filepath.Join(dir, "dir", p))
+		if err != nil || string(b) != content {
+			t.Errorf("%s: expected %q, got %q: %v", p, content, b, err)
+		}
+	}
+}
+
+func TestStorageBadPath(t *testing.T) {
+	m := formats.MetaInfo{Info: formats.InfoDict{
+		Name:     "dir",
+		PieceLen: 8,
+		Files:    []formats.Info{{Length: 5, Path: []string{"..", "escape"}}},
+	}}
+	if _, err := NewStorage(t.TempDir(), m, nil); err == nil {
+		t.Errorf("Should not write outside the torrent's directory")
+	}
+}
+
+func TestStorageSkip(t *testing.T) {
+	m := formats.MetaInfo{Info: formats.InfoDict{
+		Name:     "dir",
+		PieceLen: 8,
+		Files: []formats.Info{
+			{Length: 5, Path: []string{"a"}},
+			{Length: 14, Path: []string{"skipped", "b"}},
+			{Length: 3, Path: []string{"c"}},
+		},
+	}}
+	data := []byte("0123456789abcdefghijkl")
+	m.Info.PiecesHash = make([]formats.Sha1, 3)
+
+	dir := t.TempDir()
+	st, err := NewStorage(dir, m, []bool{false, true, false})
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".dir.parts")); !os.IsNotExist(err) {
+		t.Errorf("Part file should only be made for a piece that needs it: %v", err)
+	}
+	// the pieces at the ends of the skipped file. the one in between is not wanted
+	for _, i := range []int{0, 2} {
+		start, end := m.PieceBounds(i)
+		if err := st.WritePiece(i, data[start:end]); err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+		b, err := st.ReadPiece(i)
+		if err != nil || !bytes.Equal(b, data[start:end]) {
+			t.Errorf("Piece %d: expected %q, got %q: %v", i, data[start:end], b, err)
+		}
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "dir", "skipped")); !os.IsNotExist(err) {
+		t.Errorf("Skipped file should not be created: %v", err)
+	}
+	for p, content := range map[string]string{"a": "01234", "c": "jkl"} {
+		b, err := os.ReadFile(filepath.Join(dir, "dir", p))
+		if err != nil || string(b) != content {
+			t.Errorf("%s: expected %q, got %q: %v", p, content, b, err)
+		}
+	}
+	part, err := os.ReadFile(filepath.Join(dir, ".dir.parts"))
+	if err != nil || len(part) != 19 || string(part[5:8]) != "567" || string(part[16:19]) != "ghi" {
+		t.Errorf("Wrong part file %q: %v", part, err)
+	}
+
+	// readers open the same files read-only
+	st, err = OpenStorage(dir, m, []bool{false, true, false})
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	defer st.Close()
+	for i := 0; i < 3; i += 2 {
+		start, end := m.PieceBounds(i)
+		if b, err := st.ReadPiece(i); err != nil || !bytes.Equal(b, data[start:end]) {
+			t.Errorf("Piece %d: expected %q, got %q: %v", i, data[start:end], b, err)
+		}
+	}
+	if err := st.WritePiece(0, data[:8]); err == nil {
+		t.Errorf("Read-only storage should not be written")
+	}
+	if _, err := OpenStorage(t.TempDir(), m, nil); err == nil {
+		t.Errorf("Read-only storage should not create missing files")
+	}
+}
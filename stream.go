@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// streaming: readers of the torrent get the pieces they need before the others, and those a little ahead of them
+// right after, so the content can be read as it comes
+
+// readahead is how many bytes past its cursor a reader asks for
+var readahead = 4 << 20
+
+// deadlineStep is the time between the deadlines of consecutive pieces ahead of a reader. the piece at its cursor
+// is due at once
+const deadlineStep = 100 * time.Millisecond
+
+var ErrReaderClosed = errors.New("Reader is closed")
+
+// SetStreaming makes the download pick new pieces in order, for the content to be read from the start as it comes.
+// it is taken when the download starts
+func (t *Torrent) SetStreaming(on bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.streaming = on
+}
+
+// notify wakes those waiting for a piece or the info dict. t.mu must be held
+func (t *Torrent) notify() {
+	if t.progress != nil {
+		close(t.progress)
+		t.progress = nil
+	}
+}
+
+// progressCh is closed as the next piece is verified, the info dict comes in, or the download ends. t.mu must be held
+func (t *Torrent) progressCh() chan struct{} {
+	if t.progress == nil {
+		t.progress = make(chan struct{})
+	}
+	return t.progress
+}
+
+// skipped gives the files that are not created, those of skip priority. t.mu must be held
+func (t *Torrent) skipped() []bool {
+	skip := make([]bool, len(t.mInfo.FileList()))
+	for i := range t.filePrio {
+		skip[i] = t.filePrio[i] == PrioritySkip
+	}
+	return skip
+}
+
+// deadlines gives the pieces the readers need, each by the earliest deadline a reader gives it. t.mu must be held
+func (t *Torrent) deadlines() map[int]time.Time {
+	d := map[int]time.Time{}
+	for r := range t.readers {
+		for i, at := range r.deadlines {
+			if old, ok := d[i]; !ok || at.Before(old) {
+				d[i] = at
+			}
+		}
+	}
+	return d
+}
+
+// reader reads the content of a torrent as one stream, the files one after the other
+type reader struct {
+	t         *Torrent
+	pos       int64
+	deadlines map[int]time.Time // pieces from the cursor to the readahead. guarded by t.mu
+	closed    chan struct{}
+	close     sync.Once
+
+	// what the reader needs of the info dict, taken once it is known
+	known     bool
+	size      int64
+	pieceLen  int64
+	numPieces int
+
+	mu     sync.Mutex // guards st against Close
+	st     *Storage   // opened read-only with the first read
+	stSkip []bool     // the files st left out
+	index  int        // the piece in `buf`, -1 if none
+	buf    []byte
+}
+
+// NewReader gives a reader of the content of the torrent, the files one after the other. reads wait for the info dict
+// of a torrent started from a magnet link. a read waits for the piece it needs to be verified, which the download picks
+// before the others, along with those ahead of it. a read fails if the download ends without the piece
+func (t *Torrent) NewReader() io.ReadSeekCloser {
+	r := &reader{t: t, index: -1, closed: make(chan struct{})}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.readers == nil {
+		t.readers = map[*reader]bool{}
+	}
+	t.readers[r] = true
+	return r
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	select {
+	case <-r.closed:
+		return 0, ErrReaderClosed
+	default:
+	}
+	if err := r.info(); err != nil {
+		return 0, err
+	}
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	i := int(r.pos / r.pieceLen)
+	if i != r.index {
+		r.ask(i)
+		if err := r.wait(i); err != nil {
+			return 0, err
+		}
+		if err := r.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.buf[r.pos-int64(i)*r.pieceLen:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// info waits for the torrent to have its info dict, and takes what the reader needs of it
+func (r *reader) info() error {
+	for !r.known {
+		r.t.mu.Lock()
+		known, stopped, progress := r.takeInfo(), r.t.stopped, r.t.progressCh()
+		r.t.mu.Unlock()
+		if known {
+			return nil
+		}
+		if stopped {
+			return fmt.Errorf("Download ended without the info dict")
+		}
+		select {
+		case <-progress:
+		case <-r.closed:
+			return ErrReaderClosed
+		}
+	}
+	return nil
+}
+
+// takeInfo takes what the reader needs of the info dict, if the torrent has it. t.mu must be held
+func (r *reader) takeInfo() bool {
+	if !r.known && len(r.t.mInfo.RawInfo) > 0 {
+		r.size, r.pieceLen, r.numPieces = int64(r.t.size), int64(r.t.mInfo.Info.PieceLen), len(r.t.mInfo.Info.PiecesHash)
+		r.known = true
+	}
+	return r.known
+}
+
+// ask sets the deadlines of the piece at the cursor and of those up to `readahead` bytes ahead
+func (r *reader) ask(i int) {
+	ahead := (int64(readahead) + r.pieceLen - 1) / r.pieceLen
+	now := time.Now()
+	d := map[int]time.Time{}
+	for k := 0; int64(k) <= ahead && i+k < r.numPieces; k++ {
+		d[i+k] = now.Add(time.Duration(k) * deadlineStep)
+	}
+	r.t.mu.Lock()
+	defer r.t.mu.Unlock()
+	r.deadlines = d
+	r.t.updateDeadlines()
+}
+
+// updateDeadlines gives the deadlines of the readers to the download going on. t.mu must be held
+func (t *Torrent) updateDeadlines() {
+	if t.picker != nil {
+		t.picker.setDeadlines(t.deadlines())
+	}
+}
+
+// wait waits for a piece to be verified and written
+func (r *reader) wait(i int) error {
+	for {
+		r.t.mu.Lock()
+		has, stopped, progress := r.t.have.Has(i), r.t.stopped, r.t.progressCh()
+		r.t.mu.Unlock()
+		if has {
+			return nil
+		}
+		if stopped {
+			return fmt.Errorf("Download ended without piece %d", i)
+		}
+		select {
+		case <-progress:
+		case <-r.closed:
+			return ErrReaderClosed
+		}
+	}
+}
+
+// load reads a piece from the files
+func (r *reader) load(i int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.closed:
+		return ErrReaderClosed
+	default:
+	}
+	// the files are those the download created, which may have left out others since
+	r.t.mu.Lock()
+	m, skip := r.t.mInfo, r.t.diskSkip
+	r.t.mu.Unlock()
+	if r.st != nil && !sameSkip(r.stSkip, skip) {
+		r.st.Close()
+		r.st = nil
+	}
+	if r.st == nil {
+		st, err := OpenStorage(r.t.fPath, m, skip)
+		if err != nil {
+			return err
+		}
+		r.st, r.stSkip = st, skip
+	}
+	buf, err := r.st.ReadPiece(i)
+	if err != nil {
+		return err
+	}
+	r.buf, r.index = buf, i
+	return nil
+}
+
+func sameSkip(a, b []bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Seek moves the cursor, and asks for the pieces at the new one right away. a seek from the end waits for the info dict
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		if err := r.info(); err != nil {
+			return 0, err
+		}
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("Invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Seek to a negative position: %d", offset)
+	}
+	r.pos = offset
+	// without the info dict, the pieces are asked for by the next read
+	r.t.mu.Lock()
+	known := r.takeInfo()
+	r.t.mu.Unlock()
+	if known && offset < r.size {
+		r.ask(int(offset / r.pieceLen))
+	}
+	return offset, nil
+}
+
+// Close ends the reads going on, and the pieces it asked for are no longer needed
+func (r *reader) Close() error {
+	var err error
+	r.close.Do(func() {
+		close(r.closed)
+		r.t.mu.Lock()
+		delete(r.t.readers, r)
+		r.t.updateDeadlines()
+		r.t.mu.Unlock()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.st != nil {
+			err = r.st.Close()
+		}
+	})
+	return err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+func TestReader(t *testing.T) {
+	Init()
+	pieceLen := 2 * formats.BLOCK_LEN
+	readahead = 2 * pieceLen
+	defer func() { readahead = 4 << 20 }()
+	data := make([]byte, 10*pieceLen+100)
+	rand.Read(data)
+	m := seedMeta(t, formats.InfoDict{Name: "video.mkv", PieceLen: pieceLen, Length: len(data)}, data)
+	infoH, _ := m.GetInfoHash()
+	torr := &Torrent{InfoH: infoH, mInfo: m, size: len(data), fPath: t.TempDir(), peers: []PeerAddr{seedPieces(t, m, data, false, false)}}
+	torr.SetStreaming(true)
+
+	r := torr.NewReader()
+	defer r.Close()
+	// the pieces at the cursor are asked for before the download starts
+	if _, err := r.Seek(int64(6*pieceLen+100), io.SeekStart); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- torr.Start(ctx) }()
+
+	b := make([]byte, pieceLen)
+	if _, err := io.ReadFull(r, b); err != nil || !bytes.Equal(b, data[6*pieceLen+100:7*pieceLen+100]) {
+		t.Fatalf("Wrong content read: %v", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	all, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(all, data) {
+		t.Errorf("Wrong content read: %d bytes: %v", len(all), err)
+	}
+	if pos, err := r.Seek(-10, io.SeekEnd); err != nil || pos != int64(len(data)-10) {
+		t.Fatalf("Wrong seek to %d: %v", pos, err)
+	}
+	if all, err := io.ReadAll(r); err != nil || !bytes.Equal(all, data[len(data)-10:]) {
+		t.Errorf("Wrong end read: %q: %v", all, err)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("Should not seek before the start")
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+}
+
+func TestReaderSkipped(t *testing.T) {
+	Init()
+	pieceLen := 2 * formats.BLOCK_LEN
+	readahead = pieceLen
+	defer func() { readahead = 4 << 20 }()
+	data := make([]byte, 8*pieceLen)
+	rand.Read(data)
+	// b spans pieces 1 to 6
+	m := seedMeta(t, formats.InfoDict{Name: "dir", PieceLen: pieceLen, Files: []formats.Info{
+		{Length: pieceLen, Path: []string{"a"}},
+		{Length: 6 * pieceLen, Path: []string{"b"}},
+		{Length: pieceLen, Path: []string{"c"}},
+	}}, data)
+	infoH, _ := m.GetInfoHash()
+	torr := &Torrent{InfoH: infoH, mInfo: m, size: len(data), fPath: t.TempDir(), peers: []PeerAddr{seedPieces(t, m, data, false, false)}}
+	prio, _ := SelectFiles(m, []string{"a", "c"})
+	torr.SetFilePriorities(prio)
+
+	// a reader of b has the pieces it needs downloaded
+	r := torr.NewReader()
+	defer r.Close()
+	r.Seek(int64(2*pieceLen), io.SeekStart)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := torr.Start(ctx); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	b := make([]byte, 2*pieceLen)
+	if _, err := io.ReadFull(r, b); err != nil || !bytes.Equal(b, data[2*pieceLen:4*pieceLen]) {
+		t.Errorf("Wrong content read: %v", err)
+	}
+	// the download ended without the others
+	r.Seek(int64(5*pieceLen), io.SeekStart)
+	if _, err := r.Read(b); err == nil || !strings.Contains(err.Error(), "without piece 5") {
+		t.Errorf("Read of a piece not downloaded should fail, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(torr.fPath, "dir", "b")); !os.IsNotExist(err) {
+		t.Errorf("Reader should not create a skipped file: %v", err)
+	}
+}
+
+func TestReaderClose(t *testing.T) {
+	m := formats.MetaInfo{Info: formats.InfoDict{Name: "x", PieceLen: 4, Length: 8, PiecesHash: make([]formats.Sha1, 2)}}
+	torr := &Torrent{mInfo: m, size: 8, fPath: t.TempDir()}
+	r := torr.NewReader()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 4))
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrReaderClosed) {
+			t.Errorf("Expected %s, got %v", ErrReaderClosed, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Close should end the read")
+	}
+	if len(torr.readers) != 0 {
+		t.Errorf("Closed reader should be forgotten")
+	}
+}
+
+func TestReaderMagnet(t *testing.T) {
+	Init()
+	pieceLen := 2 * formats.BLOCK_LEN
+	data := make([]byte, 3*pieceLen+100)
+	rand.Read(data)
+	m := seedMeta(t, formats.InfoDict{Name: "video.mkv", PieceLen: pieceLen, Length: len(data)}, data)
+	infoH, _ := m.GetInfoHash()
+
+	// the link gives the size, `xl`, but the pieces are not known yet
+	torr := &Torrent{InfoH: infoH, size: len(data), fPath: t.TempDir(), peers: []PeerAddr{seedPieces(t, m, data, false, false)}}
+	r := torr.NewReader()
+	defer r.Close()
+	if pos, err := r.Seek(10, io.SeekStart); err != nil || pos != 10 {
+		t.Fatalf("Wrong seek to %d: %v", pos, err)
+	}
+	type result struct {
+		b   []byte
+		err error
+	}
+	read := make(chan result, 1)
+	go func() {
+		b, err := io.ReadAll(r)
+		read <- result{b, err}
+	}()
+	select {
+	case res := <-read:
+		t.Fatalf("Read should wait for the info dict, got %d bytes: %v", len(res.b), res.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// as FetchMetaInfo does
+	if err := torr.setInfo(m.RawInfo); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := torr.Start(ctx); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if res := <-read; res.err != nil || !bytes.Equal(res.b, data[10:]) {
+		t.Errorf("Wrong content read: %d bytes: %v", len(res.b), res.err)
+	}
+
+	// with no info dict to come, reads fail
+	gone := &Torrent{InfoH: infoH, size: len(data)}
+	r = gone.NewReader()
+	defer r.Close()
+	if err := gone.Start(ctx); err == nil {
+		t.Fatalf("Should not start with no peers")
+	}
+	if _, err := r.Read(make([]byte, 10)); err == nil || !strings.Contains(err.Error(), "info dict") {
+		t.Errorf("Expected the read to fail without the info dict, got %v", err)
+	}
+}
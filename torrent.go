@@ -5,14 +5,20 @@ import (
 	"context"
 	"crypto/sha1"
 	"fmt"
+	"log"
 	"math/rand"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/sync/errgroup"
 
+	"github.com/OLUWAMUYIWA/odor/dht"
 	"github.com/OLUWAMUYIWA/odor/formats"
 )
 
@@ -22,26 +28,88 @@ var peerId [20]byte
 func Init() {
 	// get peerID OAFA
 	getPerID := func() {
+		// seeded first, so no two clients get the same peer id
+		rand.Seed(time.Now().UnixNano())
 		_, err := rand.Read(peerId[:])
 		if err != nil {
 			panic("error while creating random peerId: " + err.Error())
 		}
-		// seed the random number enerator too
-		rand.Seed(time.Now().Unix())
+		trackerKey = rand.Uint32()
 	}
 	once.Do(getPerID)
 }
 
+// dhtNode is our node of the DHT, nil if it does not run
+var dhtNode *dht.DHT
+
+// StartDHT joins the DHT, listening on udp `PORT`. torrents started after it get peers from it too
+func StartDHT(ctx context.Context) (*dht.DHT, error) {
+	node, err := dht.New(dht.Config{Addr: ":" + strconv.Itoa(PORT)})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := node.Bootstrap(ctx, dht.BOOTSTRAP_NODES); err != nil {
+		node.Close()
+		return nil, err
+	}
+	dhtNode = node
+	return node, nil
+}
+
+// trustStore holds the signers torrents are checked against. signatures are not checked if it is nil
+var trustStore *formats.TrustStore
+
+// requireSigned refuses torrents that have no valid signature of a trusted signer. they are only warned of otherwise
+var requireSigned bool
+
+// checkSignatures verifies the signatures of a torrent file against `trustStore`
+func checkSignatures(m *formats.MetaInfo) error {
+	if trustStore == nil {
+		return nil
+	}
+	signers, err := m.Verify(trustStore)
+	if err != nil {
+		if requireSigned {
+			return fmt.Errorf("Refusing torrent %s: %w", m.Info.Name, err)
+		}
+		log.Printf("Warning: torrent %s: %s\n", m.Info.Name, err)
+		return nil
+	}
+	log.Printf("Torrent %s signed by %s\n", m.Info.Name, strings.Join(signers, ", "))
+	return nil
+}
+
 type Torrent struct {
 	mInfo formats.MetaInfo
 	InfoH formats.Sha1 // infohash
 	size  int          // size of torrent file in bytes
 	peers []PeerAddr
+	known map[string]bool // addresses of `peers`, so none is added twice
+	added chan struct{}   // closed as peers are added
 	// pl    int
-	name    string
-	mu      sync.Mutex
-	clients []*PeerConn // list of connections to peers this client is connected to
-	fPath   string      // path where to save the torrent
+	name     string
+	mu       sync.Mutex
+	clients  []*PeerConn     // list of connections to peers this client is connected to
+	fPath    string          // path where to save the torrent
+	magnet   *formats.Magnet // the magnet link the torrent was started from, if any
+	trackers *TrackerManager
+	picker   *Picker    // picks the blocks to request from each peer, while downloading
+	filePrio []Priority // priority of each file, in the order of the file list. nil when all are normal
+
+	streaming bool             // whether pieces are downloaded in order
+	readers   map[*reader]bool // readers of the torrent, which set the deadlines of the pieces they need
+	progress  chan struct{}    // closed as a piece is verified, or the download ends
+	stopped   bool             // whether the last download ended
+	diskSkip  []bool           // the files the last download did not create. readers open the others
+
+	uploaded   atomic.Int64     // bytes of blocks sent to peers
+	downloaded atomic.Int64     // bytes of blocks received from peers
+	verified   int              // bytes of the pieces verified and written
+	have       formats.Bitfield // pieces verified and written
+	complete   chan struct{}    // closed once all pieces are verified
+	started    atomic.Bool      // whether the trackers were sent the started event
 }
 
 func NewTorrent(ctx context.Context, torrPath, fPath string) (*Torrent, error) {
@@ -59,6 +127,12 @@ func NewTorrent(ctx context.Context, torrPath, fPath string) (*Torrent, error) {
 	if err := bDec.Decode(&mInfo); err != nil {
 		return nil, err
 	}
+	if err := mInfo.Info.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid torrent %s: %w", torrPath, err)
+	}
+	if err := checkSignatures(&mInfo); err != nil {
+		return nil, err
+	}
 	t.mInfo = mInfo
 
 	// get infohash
@@ -66,19 +140,144 @@ func NewTorrent(ctx context.Context, torrPath, fPath string) (*Torrent, error) {
 
 	// get torrent size
 	t.size = mInfo.Size()
+	t.name = mInfo.Info.Name
 
-	// get peers using a UDPT client.... UDPT means UDP tracker protocol
-	annResp, err := GetPeers(ctx, &t)
-	if err != nil {
+	// get peers from the tracker and the DHT
+	if err := t.findPeers(ctx); err != nil {
 		return nil, err
 	}
-	t.peers = annResp.socks
 
 	t.fPath = fPath
 
 	return &t, nil
 }
 
+// NewMagnetTorrent starts a torrent from a magnet link. Only the infohash is known, along with the trackers and peers
+// the link names. Peer discovery begins right away, but the info dict has to come from peers before any download
+func NewMagnetTorrent(ctx context.Context, uri, fPath string) (*Torrent, error) {
+	mag, err := formats.ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	t := &Torrent{
+		InfoH:  mag.InfoHash,
+		name:   mag.Name,
+		size:   mag.Length, // zero, unless the link gives it
+		fPath:  fPath,
+		magnet: mag,
+	}
+	// every tracker of a magnet link is a tier of its own
+	for _, tr := range mag.Trackers {
+		t.mInfo.AnounceList = append(t.mInfo.AnounceList, []string{tr})
+	}
+	if len(mag.Trackers) > 0 {
+		t.mInfo.Announce = mag.Trackers[0]
+	}
+
+	// the peers named in the link are tried first
+	for _, p := range mag.Peers {
+		addr, err := resolvePeer(ctx, p)
+		if err != nil {
+			continue
+		}
+		t.addPeers([]PeerAddr{addr})
+	}
+	if t.mInfo.Announce == "" && dhtNode == nil && lsdNode == nil && len(t.peers) == 0 {
+		return nil, fmt.Errorf("Magnet link has no trackers or peers to get the torrent from")
+	}
+	if err := t.findPeers(ctx); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// findPeers gets peers from the tracker, and from the DHT and LSD when they run and the torrent is not private.
+// it fails only if the torrent is left with no peers at all, and none may come from the local network
+func (t *Torrent) findPeers(ctx context.Context) error {
+	var errs []string
+	// get peers from the first tracker that answers, over udp or http
+	if len(t.Trackers().Status()) > 0 {
+		if _, err := t.announce(ctx, EventStarted); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if dhtNode != nil && !t.mInfo.Info.Private {
+		if err := t.dhtPeers(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	// peers on the local network are added as they announce the torrent
+	lsd := lsdNode != nil && !t.mInfo.Info.Private
+	if lsd {
+		lsdNode.Add(t)
+	}
+	t.mu.Lock()
+	n := len(t.peers)
+	t.mu.Unlock()
+	if n == 0 && !lsd {
+		return fmt.Errorf("No peers found for %x: %s", t.InfoH, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// onLSD reports whether peers may still come from the local network, without asking for them.
+// with no other peer, downloads wait for them
+func (t *Torrent) onLSD() bool {
+	return lsdNode != nil && lsdNode.has(t)
+}
+
+// Trackers gives the tracker manager of the torrent, made from its announce list on first use
+func (t *Torrent) Trackers() *TrackerManager {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.trackers == nil {
+		t.trackers = NewTrackerManager(t.mInfo.Announce, t.mInfo.AnounceList)
+	}
+	return t.trackers
+}
+
+// dhtPeers looks up the peers of the torrent in the DHT
+func (t *Torrent) dhtPeers(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	addrs, err := dhtNode.GetPeers(ctx, dht.ID(t.InfoH))
+	if err != nil {
+		return err
+	}
+	peers := make([]PeerAddr, 0, len(addrs))
+	for _, a := range addrs {
+		peers = append(peers, PeerAddr{a.IP, a.Port})
+	}
+	t.addPeers(peers)
+	return nil
+}
+
+// resolvePeer turns the `host:port` of a peer into its address
+func resolvePeer(ctx context.Context, hostPort string) (PeerAddr, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return PeerAddr{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return PeerAddr{}, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return PeerAddr{ip, uint16(port)}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return PeerAddr{}, err
+	}
+	return PeerAddr{ips[0], uint16(port)}, nil
+}
+
+// HasMetaInfo reports whether the info dict of the torrent is known.
+// it isn't for a torrent started from a magnet link, until it is fetched from peers
+func (t *Torrent) HasMetaInfo() bool {
+	return len(t.metadata()) > 0
+}
+
 func (t *Torrent) pieceHashes() []formats.Sha1 {
 	return t.mInfo.Info.PiecesHash
 }
@@ -95,6 +294,30 @@ func (t *Torrent) Connect(ctx context.Context, addr PeerAddr) (*PeerConn, error)
 		if err != nil {
 			return nil, err
 		}
+		cl.torrent = t
+		if err := cl.sendHaves(); err != nil {
+			return nil, err
+		}
+		// peers running a DHT node are told of ours
+		if cl.supports(dhtBit) {
+			if err := formats.NewPort(uint16(dhtNode.Addr().Port)).Marshall(cl.conn); err != nil {
+				return nil, err
+			}
+		}
+		if cl.supports(extBit) {
+			if err := cl.RegisterExt(formats.UT_METADATA, &utMetadata{}); err != nil {
+				return nil, err
+			}
+			// private torrents only get peers from their trackers (BEP 27)
+			if !t.mInfo.Info.Private {
+				if err := cl.RegisterExt(formats.UT_PEX, newUtPex(t)); err != nil {
+					return nil, err
+				}
+			}
+			if err := cl.SendExtHandshake(); err != nil {
+				return nil, err
+			}
+		}
 
 		// get the pieces the peer has
 		if err = cl.ReqBitFields(); err != nil {
@@ -103,15 +326,23 @@ func (t *Torrent) Connect(ctx context.Context, addr PeerAddr) (*PeerConn, error)
 		// comeback to check state. suppose it begins with being choked and interested
 		cl.state.connState = ChkdIntd
 		// now add the client to the client list
+		t.mu.Lock()
 		t.clients = append(t.clients, cl)
+		t.mu.Unlock()
 		return cl, nil
 	}
 }
 
-type PieceReq struct {
-	index int
-	sha   formats.Sha1
-	len   int
+// removeClient takes a closed connection off the client list
+func (t *Torrent) removeClient(cl *PeerConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, c := range t.clients {
+		if c == cl {
+			t.clients = append(t.clients[:i], t.clients[i+1:]...)
+			return
+		}
+	}
 }
 
 type Piece struct {
@@ -119,74 +350,173 @@ type Piece struct {
 	buf   []byte
 }
 
-func (t *Torrent) downloadPiece(ctx context.Context, p PeerAddr, pReqChan chan *PieceReq, pChan chan *Piece, errchan chan error) {
+// downloadFrom is the worker of a peer: it downloads the blocks the picker gives it, and sends the pieces verified on
+// `pChan`. the blocks it was asked for go back to the picker as it ends, with the error that ended it
+func (t *Torrent) downloadFrom(ctx context.Context, p PeerAddr, pk *Picker, pChan chan *Piece, errchan chan error) {
+	fail := func(err error) {
+		select {
+		case errchan <- fmt.Errorf("Peer %s: %w", p, err):
+		case <-ctx.Done():
+		}
+	}
 	cl, err := t.Connect(ctx, p)
-	// comeback send error to errchan, and mayby log the error and close
 	if err != nil {
-		errchan <- err
+		fail(err)
+		return
 	}
+	defer t.removeClient(cl)
 	defer cl.conn.Close()
+	// a read going on ends with the download
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cl.conn.Close()
+		case <-stop:
+		}
+	}()
 
 	// first unchoke and make interest known to peer
 	if err := cl.Unchoke(); err != nil {
-		errchan <- err
+		fail(err)
+		return
 	}
-
 	if err := cl.Interested(); err != nil {
-		errchan <- err
+		fail(err)
+		return
 	}
 
-	for pReq := range pReqChan {
-		if !cl.HasPiece(pReq.index) { // put back in chan
-			pReqChan <- pReq
-			continue
-		}
-
+	pk.addPeer(cl)
+	defer pk.removePeer(cl)
+	if err := cl.download(ctx, pk, pChan); err != nil && ctx.Err() == nil {
+		fail(err)
 	}
+}
 
+// getPicker gives the picker of the download going on, nil if there is none
+func (t *Torrent) getPicker() *Picker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.picker
 }
 
 func (t *Torrent) Start(ctx context.Context) error {
-	// get the number of pieces
-	workersNum := len(t.pieceHashes())
-	reqChan := make(chan *PieceReq, workersNum)
+	// the local network is no longer told of the torrent, nor are its peers taken, once the download ends
+	if lsdNode != nil {
+		defer lsdNode.Remove(t)
+	}
+	t.mu.Lock()
+	t.stopped = false
+	t.mu.Unlock()
+	// a torrent started from a magnet link gets its info dict from peers first. readers waiting for it are told
+	// if it does not come
+	if err := t.FetchMetaInfo(ctx); err != nil {
+		t.mu.Lock()
+		t.stopped = true
+		t.notify()
+		t.mu.Unlock()
+		return err
+	}
+	// the workers end with the download
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if !t.mInfo.Info.Private {
+		go t.runPex(ctx)
+	}
+	// the trackers are told we stop before Start returns
+	actx, stopAnnouncer := context.WithCancel(ctx)
+	announcerDone := make(chan struct{})
+	go func() {
+		t.runAnnouncer(actx)
+		close(announcerDone)
+	}()
+	defer func() {
+		stopAnnouncer()
+		<-announcerDone
+	}()
+
+	t.mu.Lock()
+	pk := NewPicker(t.mInfo)
+	pk.setPriorities(piecePriorities(t.mInfo, t.filePrio))
+	pk.setSequential(t.streaming)
+	pk.setDeadlines(t.deadlines())
+	t.picker = pk
+	skip := t.skipped()
+	t.diskSkip = skip
+	t.mu.Unlock()
+	// readers waiting for pieces that did not come are told the download ended
+	defer func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.picker, t.stopped = nil, true
+		t.notify()
+	}()
+	// the pieces readers need come to be wanted as the download goes
+	got := make(formats.Bitfield, (len(t.pieceHashes())+7)/8)
+	if pk.missing(got) == 0 {
+		return nil
+	}
+
 	pChan := make(chan *Piece)
 	errChan := make(chan error)
-
-	// send all to the workers channel to be distributed among clients
-	for i, sha := range t.pieceHashes() {
-		pLen := t.mInfo.PieceLen(i)
-		reqChan <- &PieceReq{index: i, sha: sha, len: pLen}
-
+	// peers are connected to as they come, from the trackers, PEX and the rest, up to maxConns at once.
+	// with none left, the download waits for those of the local network
+	tried, workers := 0, 0
+	connect := func() chan struct{} {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for ; tried < len(t.peers) && workers < maxConns; tried++ {
+			go t.downloadFrom(ctx, t.peers[tried], pk, pChan, errChan)
+			workers++
+		}
+		return t.addedCh()
 	}
-
-	for _, peer := range t.peers {
-		go t.downloadPiece(ctx, peer, reqChan, pChan, errChan)
+	added := connect()
+	lsd := t.onLSD()
+	if workers == 0 && !lsd {
+		return fmt.Errorf("No peers to download from")
 	}
 
-	f, err := os.OpenFile(t.fPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
-	defer f.Close()
+	// the files (and directories) of the torrent are created under fPath. skipped files are not
+	st, err := NewStorage(t.fPath, t.mInfo, skip)
 	if err != nil {
 		return err
 	}
+	defer st.Close()
 
 	g := new(errgroup.Group)
 
-	for i := 0; i < len(t.pieceHashes()); i++ {
-		p := <-pChan
-		start, _ := t.mInfo.PieceBounds(p.index)
-		if len(p.buf) != t.mInfo.PieceLen(p.index) {
-			return fmt.Errorf("Incomplete piece")
+	for pk.missing(got) > 0 {
+		select {
+		case p := <-pChan:
+			if len(p.buf) != t.mInfo.PieceLen(p.index) {
+				return fmt.Errorf("Incomplete piece")
+			}
+			g.Go(func() error {
+				if err := st.WritePiece(p.index, p.buf); err != nil {
+					return err
+				}
+				t.pieceVerified(p.index)
+				return nil
+			})
+			got.Set(p.index)
+		case <-added:
+			added = connect()
+		case err := <-errChan:
+			// the pieces of a peer that failed are left to the others, and its place to a peer not tried yet
+			workers--
+			if added = connect(); workers == 0 && !lsd {
+				return fmt.Errorf("No peer left to download from. the last failed with: %w", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		g.Go(func() error {
-			_, err := f.WriteAt(p.buf, int64(start))
-			return err
-		})
 	}
 
 	wgErr := g.Wait()
 	if wgErr != nil {
-		return fmt.Errorf("Could not finish downloading because: %u", wgErr)
+		return fmt.Errorf("Could not finish downloading because: %w", wgErr)
 	}
 
 	return nil
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/dht"
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+func TestNewMagnetTorrent(t *testing.T) {
+	ctx := context.Background()
+	uri := "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=build.iso&x.pe=127.0.0.1:6881&x.pe=[::1]:6882"
+	torr, err := NewMagnetTorrent(ctx, uri, t.TempDir())
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if len(torr.peers) != 2 || torr.peers[0].port != 6881 || !torr.peers[1].ipv4.IsLoopback() {
+		t.Errorf("Wrong peers: %v", torr.peers)
+	}
+	if torr.name != "build.iso" || torr.InfoH[0] != 0xc1 {
+		t.Errorf("Wrong torrent: %s % x", torr.name, torr.InfoH)
+	}
+	if torr.HasMetaInfo() {
+		t.Errorf("A magnet link has no info dict")
+	}
+	if err := torr.Start(ctx); err == nil {
+		t.Errorf("Should not start downloading without the info dict")
+	}
+
+	if _, err := NewMagnetTorrent(ctx, "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a", ""); err == nil {
+		t.Errorf("Should error with no trackers or peers")
+	}
+}
+
+func TestFindPeersDHT(t *testing.T) {
+	ctx := context.Background()
+	var nodes []*dht.DHT
+	for i := 0; i < 6; i++ {
+		d, err := dht.New(dht.Config{Addr: "127.0.0.1:0", Timeout: 500 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("Errored: %s", err)
+		}
+		defer d.Close()
+		if i > 0 {
+			if err := d.Bootstrap(ctx, []string{nodes[0].Addr().String()}); err != nil {
+				t.Fatalf("Errored: %s", err)
+			}
+		}
+		nodes = append(nodes, d)
+	}
+	infoH := formats.Sha1{0xc1, 0x2f}
+	if _, err := nodes[2].Announce(ctx, dht.ID(infoH), 7000); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+
+	dhtNode = nodes[5]
+	defer func() { dhtNode = nil }()
+	uri := "magnet:?xt=urn:btih:" + hex.EncodeToString(infoH[:])
+	torr, err := NewMagnetTorrent(ctx, uri, t.TempDir())
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if len(torr.peers) != 1 || torr.peers[0].port != 7000 || !torr.peers[0].ipv4.IsLoopback() {
+		t.Errorf("Wrong peers: %v", torr.peers)
+	}
+}
+
+func TestNewTorrentSignatures(t *testing.T) {
+	dir := t.TempDir()
+	content := filepath.Join(dir, "release.tar")
+	if err := os.WriteFile(content, []byte("release"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pub, key, _ := ed25519.GenerateKey(nil)
+	write := func(name string, signed bool) string {
+		m, err := formats.NewBuilder(content).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signed {
+			if err := m.Sign("releases", key, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		torr, err := formats.Marshall(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, torr, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	signed, unsigned := write("signed.torrent", true), write("unsigned.torrent", false)
+
+	trustStore = &formats.TrustStore{Keys: map[string]ed25519.PublicKey{"releases": pub}}
+	requireSigned = true
+	defer func() { trustStore, requireSigned = nil, false }()
+	ctx := context.Background()
+	// the torrents have no trackers, so even those taken fail on finding peers
+	if _, err := NewTorrent(ctx, unsigned, dir); !errors.Is(err, formats.ErrUnsigned) {
+		t.Errorf("Expected an unsigned torrent to be refused, got %v", err)
+	}
+	if _, err := NewTorrent(ctx, signed, dir); err == nil || strings.HasPrefix(err.Error(), "Refusing") {
+		t.Errorf("Expected a signed torrent to be taken, got %v", err)
+	}
+	requireSigned = false
+	if _, err := NewTorrent(ctx, unsigned, dir); err == nil || strings.HasPrefix(err.Error(), "Refusing") {
+		t.Errorf("Expected an unsigned torrent to be taken with a warning, got %v", err)
+	}
+}
+
+func TestNewTorrentInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, info := range map[string]formats.InfoDict{
+		"nopiecelen.torrent": {Name: "x", Length: 10, PiecesHash: make([]formats.Sha1, 1)},
+		"pieces.torrent":     {Name: "x", PieceLen: formats.BLOCK_LEN, Length: 3 * formats.BLOCK_LEN, PiecesHash: make([]formats.Sha1, 1)},
+	} {
+		b, err := formats.Marshall(formats.MetaInfo{Info: info})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewTorrent(context.Background(), p, dir); err == nil || !strings.HasPrefix(err.Error(), "Invalid torrent") {
+			t.Errorf("%s should be refused, got %v", name, err)
+		}
+	}
+}
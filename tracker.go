@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// Event tells the tracker where the download is at. the values are those of the UDP protocol
+type Event uint32
+
+const (
+	EventNone Event = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	}
+	return ""
+}
+
+// AnnounceReq is what we tell a tracker when announcing, whatever the protocol
+type AnnounceReq struct {
+	InfoHash   formats.Sha1
+	PeerId     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	NumWant    int    // -1 for the tracker's default
+	Key        uint32 // tells us apart from other peers behind the same ip
+}
+
+// trackerKey is the key of our announces, the same for the whole session
+var trackerKey uint32
+
+// TrackerError is the reason a tracker gives for refusing an announce
+type TrackerError struct {
+	Reason string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("Tracker failed: %s", e.Reason)
+}
+
+// Tracker is the client of one announce url
+type Tracker interface {
+	Announce(ctx context.Context, req AnnounceReq) (*AnnounceResp, error)
+}
+
+// NewTracker makes the client of an announce url, http(s) or udp
+func NewTracker(announce string) (Tracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return NewHTTPTClient(announce), nil
+	case "udp":
+		return NewUDPTClient(u.Host), nil
+	}
+	return nil, fmt.Errorf("Unsupported tracker protocol: %s", announce)
+}
+
+// TrackerStatus is what we know of a tracker, for display
+type TrackerStatus struct {
+	URL          string
+	Tier         int
+	LastAnnounce time.Time // when it last answered
+	NextAnnounce time.Time // when it should be announced to again, on its interval or after a failure
+	LastErr      error     // the error of the last announce, nil if it went through
+	Warning      string
+	Seeders      int
+	Leechers     int
+	Peers        int // peers of the last response
+	failures     int // announces failed in a row
+}
+
+func (s TrackerStatus) String() string {
+	state := "ok"
+	if s.LastErr != nil {
+		state = s.LastErr.Error()
+	} else if s.LastAnnounce.IsZero() {
+		state = "not contacted"
+	}
+	return fmt.Sprintf("tier %d %s: %s. seeders: %d, leechers: %d, peers: %d, next announce: %s",
+		s.Tier, s.URL, state, s.Seeders, s.Leechers, s.Peers, s.NextAnnounce.Format(time.Kitchen))
+}
+
+type trackerEntry struct {
+	status TrackerStatus
+	client Tracker // nil if the url is not one we can announce to
+}
+
+// TrackerManager announces to the trackers of a torrent as BEP 12 has it: the tiers are tried in order,
+// and the trackers of a tier in an order shuffled at first. the one that answers goes to the front of its tier
+// https://www.bittorrent.org/beps/bep_0012.html
+type TrackerManager struct {
+	announcing sync.Mutex // an announce goes through the tiers alone
+	mu         sync.Mutex
+	tiers      [][]*trackerEntry
+}
+
+// NewTrackerManager makes the tiers out of the announce list, or of the announce url alone if there is no list
+func NewTrackerManager(announce string, announceList [][]string) *TrackerManager {
+	if len(announceList) == 0 && announce != "" {
+		announceList = [][]string{{announce}}
+	}
+	m := &TrackerManager{}
+	seen := map[string]bool{}
+	for _, urls := range announceList {
+		var tier []*trackerEntry
+		for _, u := range urls {
+			if seen[u] {
+				continue
+			}
+			seen[u] = true
+			e := &trackerEntry{status: TrackerStatus{URL: u, Tier: len(m.tiers)}}
+			var err error
+			if e.client, err = NewTracker(u); err != nil {
+				e.status.LastErr = err
+			}
+			tier = append(tier, e)
+		}
+		if len(tier) == 0 {
+			continue
+		}
+		rand.Shuffle(len(tier), func(i, j int) { tier[i], tier[j] = tier[j], tier[i] })
+		m.tiers = append(m.tiers, tier)
+	}
+	return m
+}
+
+// retryDelay is how long to wait before announcing again to a tracker that failed `failures` times in a row
+func retryDelay(failures int) time.Duration {
+	if failures > maxRetries {
+		failures = maxRetries
+	}
+	return RetryFactor * time.Second << (failures - 1)
+}
+
+// trackerTimeout bounds an announce to one tracker, so a tracker that is down does not keep the next ones from being tried.
+// a udp tracker is sent the request a few times within it
+var trackerTimeout = time.Minute
+
+// Announce announces to the first tracker that answers, going through every tier
+func (m *TrackerManager) Announce(ctx context.Context, req AnnounceReq) (*AnnounceResp, error) {
+	m.announcing.Lock()
+	defer m.announcing.Unlock()
+	var errs []string
+	for i := range m.tiers {
+		m.mu.Lock()
+		tier := append([]*trackerEntry(nil), m.tiers[i]...)
+		m.mu.Unlock()
+		for _, e := range tier {
+			if e.client == nil {
+				errs = append(errs, e.status.LastErr.Error())
+				continue
+			}
+			tctx, cancel := context.WithTimeout(ctx, trackerTimeout)
+			resp, err := e.client.Announce(tctx, req)
+			cancel()
+			m.update(e, resp, err)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				errs = append(errs, fmt.Sprintf("%s: %s", e.status.URL, err))
+				continue
+			}
+			m.promote(i, e)
+			return resp, nil
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("No trackers to announce to")
+	}
+	return nil, fmt.Errorf("No tracker answered: %s", strings.Join(errs, "; "))
+}
+
+// update records the outcome of an announce in the status of the tracker
+func (m *TrackerManager) update(e *trackerEntry, resp *AnnounceResp, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &e.status
+	now := time.Now()
+	s.LastErr = err
+	if err != nil {
+		s.failures++
+		s.NextAnnounce = now.Add(retryDelay(s.failures))
+		return
+	}
+	s.failures = 0
+	s.LastAnnounce = now
+	s.Warning = resp.warning
+	s.Seeders, s.Leechers, s.Peers = int(resp.seeders), int(resp.leechers), len(resp.socks)
+	s.NextAnnounce = now.Add(resp.wait())
+}
+
+// wait gives the time until the tracker that answered last should be announced to again
+func (m *TrackerManager) wait() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var last *TrackerStatus
+	for _, tier := range m.tiers {
+		for _, e := range tier {
+			if e.status.LastErr == nil && e.status.LastAnnounce.After(time.Time{}) &&
+				(last == nil || e.status.LastAnnounce.After(last.LastAnnounce)) {
+				last = &e.status
+			}
+		}
+	}
+	if last == nil {
+		return 0
+	}
+	if w := time.Until(last.NextAnnounce); w > 0 {
+		return w
+	}
+	return 0
+}
+
+// promote moves a tracker that answered to the front of its tier
+func (m *TrackerManager) promote(tier int, e *trackerEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.tiers[tier]
+	for j, o := range t {
+		if o == e {
+			copy(t[1:j+1], t[:j])
+			t[0] = e
+			return
+		}
+	}
+}
+
+// Status gives the status of every tracker, tier by tier, in the order they are tried
+func (m *TrackerManager) Status() []TrackerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var st []TrackerStatus
+	for _, tier := range m.tiers {
+		for _, e := range tier {
+			st = append(st, e.status)
+		}
+	}
+	return st
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTrackerManager(t *testing.T) {
+	var mu sync.Mutex
+	var hits []string
+	handler := func(name, resp string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits = append(hits, name)
+			mu.Unlock()
+			w.Write([]byte(resp))
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL + "/" + name
+	}
+	failing := handler("failing", "d14:failure reason4:downe")
+	failing2 := handler("failing2", "d14:failure reason4:downe")
+	working := handler("working", "d8:completei2e10:incompletei1e8:intervali600e5:peers6:\x7f\x00\x00\x01\x1a\xe1e")
+	working2 := handler("working2", "d8:intervali600e5:peers0:e")
+
+	m := NewTrackerManager(failing, [][]string{{failing, failing2, "wss://unsupported"}, {working, working2}})
+	st := m.Status()
+	if len(st) != 5 || st[0].Tier != 0 || st[4].Tier != 1 {
+		t.Fatalf("Wrong tiers: %v", st)
+	}
+	ctx := context.Background()
+	resp, err := m.Announce(ctx, AnnounceReq{NumWant: -1})
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if len(hits) != 3 || hits[2] != "working" && hits[2] != "working2" {
+		t.Errorf("Expected both failing trackers then one of the next tier to be tried, got %v", hits)
+	}
+	// the tracker that answered is first of its tier now, and is tried first from now on
+	st = m.Status()
+	first := st[3]
+	if first.URL != working && first.URL != working2 || first.LastErr != nil || first.LastAnnounce.IsZero() {
+		t.Errorf("Expected the tracker that answered first in its tier, got %v", st)
+	}
+	if first.URL == working && (first.Seeders != 2 || first.Leechers != 1 || first.Peers != 1 || len(resp.socks) != 1) {
+		t.Errorf("Wrong status: %v", first)
+	}
+	for _, s := range st[:3] {
+		if s.LastErr == nil || strings.HasPrefix(s.URL, "http") && s.NextAnnounce.IsZero() {
+			t.Errorf("Expected a failure: %v", s)
+		}
+	}
+	hits = nil
+	if _, err := m.Announce(ctx, AnnounceReq{NumWant: -1}); err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if len(hits) != 3 || first.URL != m.Status()[3].URL || !strings.HasSuffix(first.URL, "/"+hits[2]) {
+		t.Errorf("Expected the tracker that answered to be tried again, got %v", hits)
+	}
+
+	if _, err := NewTrackerManager("", nil).Announce(ctx, AnnounceReq{}); err == nil {
+		t.Errorf("Should error with no trackers")
+	}
+}
+
+func TestTrackerManagerTimeout(t *testing.T) {
+	silent := udpTracker(t, func(req []byte) []byte { return nil })
+	live := udpTracker(t, func(req []byte) []byte {
+		switch binary.BigEndian.Uint32(req[8:12]) {
+		case actionConnect:
+			return connectResp(req, 1)
+		case actionAnnounce:
+			resp := make([]byte, 20)
+			binary.BigEndian.PutUint32(resp[0:4], actionAnnounce)
+			copy(resp[4:8], req[12:16])
+			binary.BigEndian.PutUint32(resp[8:12], 1800)
+			return resp
+		}
+		return nil
+	})
+	defer func() { trackerTimeout = time.Minute }()
+	trackerTimeout = 200 * time.Millisecond
+
+	// the silent tracker is given up on for the next tier
+	m := NewTrackerManager("", [][]string{{"udp://" + silent}, {"udp://" + live}})
+	start := time.Now()
+	resp, err := m.Announce(context.Background(), AnnounceReq{NumWant: -1})
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if resp.interval != 1800 || time.Since(start) > 5*time.Second {
+		t.Errorf("Wrong response %+v after %s", resp, time.Since(start))
+	}
+	if st := m.Status(); st[0].LastErr == nil || st[1].LastErr != nil {
+		t.Errorf("Expected the silent tracker to fail, got %v", st)
+	}
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"math/rand"
 	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/OLUWAMUYIWA/odor/formats"
@@ -19,21 +19,41 @@ var TimeoutError = errors.New("Udp request Timed out!")
 
 const PORT = 6881
 
-type UDPTClient struct {
-	infoHash formats.Sha1
-	peerId   formats.Sha1
-	announce string
-	conn     *net.UDPConn
-}
-
 const RetryFactor = 15 // 1.e. try every  15 * 2 ^ n seconds
 
-func NewUDPTClient(infoHash formats.Sha1, peerId [20]byte, announce string) *UDPTClient {
+// maxRetries is the number of times a request is sent again before giving up, as BEP 15 has it
+const maxRetries = 8
+
+// udp tracker actions
+const (
+	actionConnect  uint32 = 0
+	actionAnnounce uint32 = 1
+	actionScrape   uint32 = 2
+	actionError    uint32 = 3
+)
+
+const initConnId = uint64(0x41727101980) // the connection id of a connect request
+
+// a connection id can be used for a minute after the tracker gives it
+const connIdLife = time.Minute
+
+// maxScrape is the most infohashes a scrape request can hold
+const maxScrape = 74
+
+type UDPTClient struct {
+	addr  string        // host:port of the tracker
+	retry time.Duration // how long the first try waits for a response. it doubles with each retry
+
+	mu     sync.Mutex // one request at a time, so no response is read by the wrong one
+	conn   *net.UDPConn
+	connId uint64
+	connAt time.Time // when the tracker gave `connId`
+}
 
+func NewUDPTClient(addr string) *UDPTClient {
 	return &UDPTClient{
-		infoHash: infoHash,
-		peerId:   peerId,
-		announce: announce,
+		addr:  addr,
+		retry: RetryFactor * time.Second,
 	}
 }
 
@@ -41,186 +61,219 @@ func NewUDPTClient(infoHash formats.Sha1, peerId [20]byte, announce string) *UDP
 // https://www.bittorrent.org/beps/bep_0015.html
 // https://ops.tips/blog/udp-client-and-server-in-go/
 
-func (client *UDPTClient) Connect(ctx context.Context) (uint64, error) {
-	txId := rand.Int31()
-
-	raddr, err := net.ResolveUDPAddr("udp4", client.announce)
-
+func (client *UDPTClient) dial() error {
+	if client.conn != nil {
+		return nil
+	}
+	raddr, err := net.ResolveUDPAddr("udp", client.addr)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	c, err := net.DialUDP("udp4", nil, raddr)
-	client.conn = c
+	c, err := net.DialUDP("udp", nil, raddr)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	var b *bytes.Buffer
-	initConnId := uint64(0x41727101980) // initial connection id
-	initAction := uint32(0)             // action number for connection request
+	client.conn = c
+	return nil
+}
 
-	//set up connection request
-	binary.Write(b, binary.BigEndian, &initConnId)
-	binary.Write(b, binary.BigEndian, &initAction)
-	binary.Write(b, binary.BigEndian, &txId)
+func (client *UDPTClient) Close() error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.conn == nil {
+		return nil
+	}
+	err := client.conn.Close()
+	client.conn = nil
+	return err
+}
 
-	buff := make([]byte, 16)
-	done := make(chan error, 1)
-	n := 1
-	req := func() {
-		go func() {
-			duration := time.Second * 15 * time.Duration(2^n)
-			n += 1
-			err = c.SetDeadline(time.Now().Add(duration))
-			if err != nil {
-				done <- err
-				return
-			}
-			defer c.SetDeadline(time.Time{}) // disable deadline by setting it to zero, else the deadline will apply to all I/O on this connection
+// roundTrip sends a request until a response with its transaction id comes, waiting 15 * 2 ^ n seconds after the nth try.
+// `req` is written with its transaction id at bytes 12 to 16, and the response must be at least `minLen` bytes.
+// an error response is a *TrackerError. client.mu must be held
+func (client *UDPTClient) roundTrip(ctx context.Context, req []byte, action uint32, minLen int) ([]byte, error) {
+	if err := client.dial(); err != nil {
+		return nil, err
+	}
+	c := client.conn
+	txId := rand.Uint32()
+	binary.BigEndian.PutUint32(req[12:16], txId)
 
-			_, err = io.Copy(c, b)
-			if err != nil {
-				done <- err
-				return
+	// a cancelled context ends the read that is going on
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	resp := make([]byte, 2048)
+	for n := 0; n <= maxRetries; n++ {
+		if _, err := c.Write(req); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(client.retry << n)
+		d, ok := ctx.Deadline()
+		last := ok && d.Before(deadline) // the context ends before the try does
+		if last {
+			deadline = d
+		}
+		if err := c.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		for {
+			l, err := c.Read(resp)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
 			}
-			if err != nil {
-				done <- err
-				return
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if last {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				break // try again
 			}
-			_, _, err = c.ReadFromUDP(buff)
 			if err != nil {
-				done <- err
-				return
+				return nil, err
 			}
-			done <- nil
-		}()
-
-		select {
-		case <-ctx.Done():
-			err = ctx.Err()
-		case err = <-done:
-			{
-				if errors.Is(err, os.ErrDeadlineExceeded) {
-					// do something is deadline exceded
-				}
+			if l < 8 || binary.BigEndian.Uint32(resp[4:8]) != txId {
+				continue // not ours. maybe the response to an earlier try
+			}
+			got := binary.BigEndian.Uint32(resp[:4])
+			if got == actionError {
+				// the connection id may be what it refuses. the next request gets a new one
+				client.connAt = time.Time{}
+				return nil, &TrackerError{Reason: string(resp[8:l])}
+			}
+			if got != action {
+				return nil, fmt.Errorf("Action should be %d, but is %d", action, got)
 			}
+			if l < minLen {
+				return nil, fmt.Errorf("Response should be at least %d bytes, got %d", minLen, l)
+			}
+			return resp[:l], nil
 		}
 	}
-	req() // try it the first time
+	return nil, TimeoutError
+}
 
-	for err != nil { // if it doesn't succeed, keep trying again
-		req()
-		if n > 8 { // break out after 8 trials
-			return 0, TimeoutError
-		}
-	}
+// Connect gets a connection id, which announces and scrapes must carry
+func (client *UDPTClient) Connect(ctx context.Context) (uint64, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.connect(ctx)
+}
 
-	respAction := binary.BigEndian.Uint32(buff[:4])
-	if respAction != 0 {
-		return 0, fmt.Errorf("Action should be zero")
+// connect gives the connection id the tracker gave less than a minute ago, or gets a new one. client.mu must be held
+func (client *UDPTClient) connect(ctx context.Context) (uint64, error) {
+	if !client.connAt.IsZero() && time.Since(client.connAt) < connIdLife {
+		return client.connId, nil
 	}
-	respTx := binary.BigEndian.Uint32(buff[4:8])
-	if int32(respTx) != txId {
-		return 0, fmt.Errorf("Should be same like request's transaction id.")
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], initConnId)
+	binary.BigEndian.PutUint32(req[8:12], actionConnect)
+	resp, err := client.roundTrip(ctx, req, actionConnect, 16)
+	if err != nil {
+		return 0, err
 	}
-	connId := binary.BigEndian.Uint64(buff[8:])
-	return connId, nil
-
+	client.connId, client.connAt = binary.BigEndian.Uint64(resp[8:16]), time.Now()
+	return client.connId, nil
 }
 
-func (client *UDPTClient) Announce(ctx context.Context, connId uint64, size uint64) (*AnnounceResp, error) {
-	var b bytes.Buffer
-	buf := make([]byte, 8) //reusable buffer
-	binary.BigEndian.PutUint64(buf, connId)
-	b.Write(buf) //write connId from server
-	binary.BigEndian.PutUint32(buf[0:4], uint32(1))
-	b.Write(buf[:4]) // write action number forannounce
-	txId := rand.Int31()
-	binary.BigEndian.PutUint32(buf[:4], uint32(txId))
-	b.Write(buf[:4])            // write new transaction ID
-	b.Write(client.infoHash[:]) // write the info_hash of the torrent that is being announced
-	b.Write(client.peerId[:])   // write the peer ID of the client announcing itself
-	empty := make([]byte, 8, 8)
-	b.Write(empty) // write bytes downloaded by client this session
-	binary.BigEndian.PutUint64(buf, size)
-	b.Write(buf)   // write bytes left to complete the download
-	b.Write(empty) // write bytes uploaded this session
-	binary.BigEndian.PutUint32(buf[:4], uint32(0))
-	b.Write(buf[:4]) // event. zero for none
-	b.Write(empty)   // write IP address, default set to 0
-	key := make([]byte, 4)
-	_, err := rand.Read(key)
+// Announce announces, getting a connection id first if the last one is too old
+func (client *UDPTClient) Announce(ctx context.Context, a AnnounceReq) (*AnnounceResp, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	connId, err := client.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
-	b.Write(key)
-	var minus1 int32 = -1
-	binary.BigEndian.PutUint32(buf[:4], uint32(minus1)) // write num-want: -1 by default. number of clients to return
-	b.Write(buf[:4])
-	binary.BigEndian.PutUint16(buf[:2], uint16(PORT))
-	b.Write(buf[:2])
-
-	c := client.conn
-	resp := make([]byte, 1024)
-	done := make(chan error, 1)
-	var a *AnnounceResp
-	n := 1
-	req := func() {
-		go func() {
-			duration := time.Second * 15 * time.Duration(2^n)
-			n += 1
-			err = c.SetDeadline(time.Now().Add(duration))
-			if err != nil {
-				done <- err
-				return
-			}
-			defer c.SetDeadline(time.Time{}) // disable deadline by setting it to zero, else the deadline will apply to all I/O on this connection
-
-			_, err = io.Copy(c, &b)
-			if err != nil {
-				done <- err
-				return
-			}
-
-			if err != nil {
-				done <- err
-				return
-			}
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], connId)
+	binary.BigEndian.PutUint32(req[8:12], actionAnnounce)
+	// 12:16 is the transaction id
+	copy(req[16:36], a.InfoHash[:])
+	copy(req[36:56], a.PeerId[:])
+	binary.BigEndian.PutUint64(req[56:64], uint64(a.Downloaded))
+	binary.BigEndian.PutUint64(req[64:72], uint64(a.Left))
+	binary.BigEndian.PutUint64(req[72:80], uint64(a.Uploaded))
+	binary.BigEndian.PutUint32(req[80:84], uint32(a.Event))
+	// 84:88 is the ip address, zero for the one the request comes from
+	binary.BigEndian.PutUint32(req[88:92], a.Key)
+	binary.BigEndian.PutUint32(req[92:96], uint32(int32(a.NumWant)))
+	binary.BigEndian.PutUint16(req[96:98], a.Port)
+
+	resp, err := client.roundTrip(ctx, req, actionAnnounce, 20)
+	if err != nil {
+		return nil, err
+	}
+	// peers are ipv6 when we talk to the tracker over ipv6
+	ipLen := net.IPv4len
+	if client.conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+	return ParseAnnounceResp(resp, ipLen)
+}
 
-			_, _, err = c.ReadFromUDP(resp)
-			if err != nil {
-				done <- err
-				return
-			}
-		}()
+// ScrapeResult is what a tracker knows of a torrent
+type ScrapeResult struct {
+	Seeders   int
+	Completed int // times the torrent was downloaded
+	Leechers  int
+}
 
-		select {
-		case <-ctx.Done():
-			err = ctx.Err()
-		case err = <-done:
+// Scrape gets what the tracker knows of torrents, in the order of `hashes`.
+// they are asked for `maxScrape` at a time
+func (client *UDPTClient) Scrape(ctx context.Context, hashes []formats.Sha1) ([]ScrapeResult, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	results := make([]ScrapeResult, 0, len(hashes))
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > maxScrape {
+			n = maxScrape
 		}
-	}
-	req()
-	for err != nil {
-		req()
-		if n > 8 {
-			return nil, TimeoutError
+		connId, err := client.connect(ctx)
+		if err != nil {
+			return nil, err
 		}
+		req := make([]byte, 16, 16+20*n)
+		binary.BigEndian.PutUint64(req[0:8], connId)
+		binary.BigEndian.PutUint32(req[8:12], actionScrape)
+		for _, h := range hashes[:n] {
+			req = append(req, h[:]...)
+		}
+		resp, err := client.roundTrip(ctx, req, actionScrape, 8+12*n)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			r := resp[8+12*i:]
+			results = append(results, ScrapeResult{
+				Seeders:   int(binary.BigEndian.Uint32(r[0:4])),
+				Completed: int(binary.BigEndian.Uint32(r[4:8])),
+				Leechers:  int(binary.BigEndian.Uint32(r[8:12])),
+			})
+		}
+		hashes = hashes[n:]
 	}
-
-	a, err = ParseAnnounceResp(resp)
-	if err != nil {
-		return nil, err
-	}
-
-	return a, err
+	return results, nil
 }
 
 type AnnounceResp struct {
-	txId     uint32
-	interval uint32
-	leechers uint32
-	seeders  uint32
-	socks    []PeerAddr
+	txId        uint32
+	interval    uint32 // seconds to wait before announcing again
+	minInterval uint32 // seconds we must wait at least, zero if the tracker gives none
+	leechers    uint32
+	seeders     uint32
+	socks       []PeerAddr
+	warning     string // a warning of the tracker. the announce went through anyway
 }
 
 type PeerAddr struct {
@@ -228,40 +281,36 @@ type PeerAddr struct {
 	port uint16
 }
 
-// comeback add verify code
-func ParseAnnounceResp(b []byte) (*AnnounceResp, error) {
+func (p PeerAddr) String() string {
+	return net.JoinHostPort(p.ipv4.String(), strconv.Itoa(int(p.port)))
+}
+
+// ParseAnnounceResp parses the response to a udp announce. `ipLen` is the length of the ips of the peers
+func ParseAnnounceResp(b []byte, ipLen int) (*AnnounceResp, error) {
 	a := &AnnounceResp{}
-	if len(b) < 2 { // actually unnecessary
+	if len(b) < 20 {
 		return nil, fmt.Errorf("Error parsing announce response: incomplete")
 	}
 	action := binary.BigEndian.Uint32(b[:4])
-	if action != 1 {
-		return nil, fmt.Errorf("Error parsing announce request: Action Should be %d, but is %d ", 1, action)
+	if action != actionAnnounce {
+		return nil, fmt.Errorf("Error parsing announce response: Action Should be %d, but is %d ", actionAnnounce, action)
 	}
 	a.txId = binary.BigEndian.Uint32(b[4:8])
 	a.interval = binary.BigEndian.Uint32(b[8:12])
 	a.leechers = binary.BigEndian.Uint32(b[12:16])
-	socks := []PeerAddr{}
-	b = b[16:]
-	l := len(b)
-	if l%6 != 0 {
-		return nil, fmt.Errorf("Error parsing announce request: remainder should be divisible by 6 to be parseable")
+	a.seeders = binary.BigEndian.Uint32(b[16:20])
+	b = b[20:]
+	l := ipLen + 2
+	if len(b)%l != 0 {
+		return nil, fmt.Errorf("Error parsing announce response: remainder should be divisible by %d to be parseable", l)
 	}
 
-	for i := 0; i < l-6; i += 6 {
-		s := b[i : i+6]
-		ip := net.IP(s[:4])
-		port := binary.BigEndian.Uint16(s[4:])
-		socks = append(socks, PeerAddr{ip, port})
+	for i := 0; i < len(b); i += l {
+		s := b[i : i+l]
+		ip := make(net.IP, ipLen)
+		copy(ip, s[:ipLen])
+		port := binary.BigEndian.Uint16(s[ipLen:])
+		a.socks = append(a.socks, PeerAddr{ip, port})
 	}
 	return a, nil
 }
-
-func GetPeers(ctx context.Context, t *Torrent) (*AnnounceResp, error) {
-	udptc := NewUDPTClient(t.InfoH, peerId, t.mInfo.Announce)
-	connID, err := udptc.Connect(ctx)
-	if err != nil {
-		return nil, err
-	}
-	return udptc.Announce(ctx, connID, uint64(t.size))
-}
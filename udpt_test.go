@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OLUWAMUYIWA/odor/formats"
+)
+
+// udpTracker serves udp tracker requests on loopback with `handle`. a nil response is dropped
+func udpTracker(t *testing.T, handle func(req []byte) []byte) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if resp := handle(append([]byte(nil), buf[:n]...)); resp != nil {
+				conn.WriteToUDP(resp, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// connectResp answers a connect request with the connection id
+func connectResp(req []byte, connId uint64) []byte {
+	resp := make([]byte, 16)
+	copy(resp[4:8], req[12:16])
+	binary.BigEndian.PutUint64(resp[8:], connId)
+	return resp
+}
+
+func TestUDPTracker(t *testing.T) {
+	const connId = 0xc0ffee
+	infoH := formats.Sha1{0xaa, 0xbb}
+	var dropped bool
+	reqs := make(chan []byte, 10)
+	addr := udpTracker(t, func(req []byte) []byte {
+		reqs <- req
+		switch binary.BigEndian.Uint32(req[8:12]) {
+		case actionConnect:
+			// the first try is lost
+			if !dropped {
+				dropped = true
+				return nil
+			}
+			return connectResp(req, connId)
+		case actionAnnounce:
+			resp := make([]byte, 20, 32)
+			binary.BigEndian.PutUint32(resp[0:4], actionAnnounce)
+			copy(resp[4:8], req[12:16])
+			binary.BigEndian.PutUint32(resp[8:12], 1800)
+			binary.BigEndian.PutUint32(resp[12:16], 4)
+			binary.BigEndian.PutUint32(resp[16:20], 9)
+			resp = append(resp, 127, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2)
+			return resp
+		}
+		return nil
+	})
+
+	client := NewUDPTClient(addr)
+	client.retry = 50 * time.Millisecond
+	defer client.Close()
+	req := AnnounceReq{InfoHash: infoH, PeerId: [20]byte{1}, Port: 6881, Downloaded: 10, Left: 90, Uploaded: 5, Event: EventStarted, NumWant: -1, Key: 7}
+	a, err := client.Announce(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if a.interval != 1800 || a.leechers != 4 || a.seeders != 9 {
+		t.Errorf("Wrong response: %+v", a)
+	}
+	if len(a.socks) != 2 || a.socks[0].String() != "127.0.0.1:6881" || a.socks[1].String() != "10.0.0.2:6882" {
+		t.Errorf("Wrong peers: %v", a.socks)
+	}
+
+	<-reqs // the lost connect
+	<-reqs
+	ann := <-reqs
+	if len(ann) != 98 || binary.BigEndian.Uint64(ann[0:8]) != connId || *(*formats.Sha1)(ann[16:36]) != infoH {
+		t.Fatalf("Wrong announce: %x", ann)
+	}
+	fields := []uint64{
+		binary.BigEndian.Uint64(ann[56:64]), binary.BigEndian.Uint64(ann[64:72]), binary.BigEndian.Uint64(ann[72:80]),
+		uint64(binary.BigEndian.Uint32(ann[80:84])), uint64(binary.BigEndian.Uint32(ann[88:92])),
+		uint64(binary.BigEndian.Uint32(ann[92:96])), uint64(binary.BigEndian.Uint16(ann[96:98])),
+	}
+	expected := []uint64{10, 90, 5, uint64(EventStarted), 7, 0xffffffff, 6881}
+	for i := range fields {
+		if fields[i] != expected[i] {
+			t.Errorf("Wrong announce fields: %v, expected %v", fields, expected)
+			break
+		}
+	}
+
+	// a tracker that never answers
+	silent := NewUDPTClient(udpTracker(t, func(req []byte) []byte { return nil }))
+	silent.retry = 10 * time.Microsecond
+	defer silent.Close()
+	if _, err := silent.Connect(context.Background()); err != TimeoutError {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	silent.retry = time.Hour
+	if _, err := silent.Connect(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the context to end the request, got %v", err)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	var mu sync.Mutex
+	var connects, scraped int
+	var connId uint64
+	addr := udpTracker(t, func(req []byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		switch action := binary.BigEndian.Uint32(req[8:12]); {
+		case action == actionConnect:
+			connects++
+			connId++
+			return connectResp(req, connId)
+		case binary.BigEndian.Uint64(req[0:8]) != connId:
+			resp := append(make([]byte, 8), "bad connection id"...)
+			binary.BigEndian.PutUint32(resp[0:4], actionError)
+			copy(resp[4:8], req[12:16])
+			return resp
+		case action == actionScrape:
+			hashes := req[16:]
+			if len(hashes)%20 != 0 || len(hashes)/20 > maxScrape {
+				return nil
+			}
+			resp := make([]byte, 8)
+			binary.BigEndian.PutUint32(resp[0:4], actionScrape)
+			copy(resp[4:8], req[12:16])
+			for i := 0; i < len(hashes); i += 20 {
+				// seeders, completed and leechers all tell the first byte of the hash
+				for j := 0; j < 3; j++ {
+					resp = binary.BigEndian.AppendUint32(resp, uint32(hashes[i]))
+				}
+				scraped++
+			}
+			return resp
+		}
+		return nil
+	})
+	counts := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return connects, scraped
+	}
+	client := NewUDPTClient(addr)
+	client.retry = 50 * time.Millisecond
+	defer client.Close()
+	ctx := context.Background()
+
+	hashes := make([]formats.Sha1, 80)
+	for i := range hashes {
+		hashes[i][0] = byte(i)
+	}
+	res, err := client.Scrape(ctx, hashes)
+	if err != nil {
+		t.Fatalf("Errored: %s", err)
+	}
+	if _, scraped := counts(); len(res) != 80 || scraped != 80 {
+		t.Fatalf("Expected 80 results, got %d", len(res))
+	}
+	for i, r := range res {
+		if r.Seeders != i || r.Completed != i || r.Leechers != i {
+			t.Errorf("Wrong result %d: %+v", i, r)
+		}
+	}
+	// the two requests and the one after share a connection id
+	if _, err := client.Scrape(ctx, hashes[:1]); err != nil {
+		t.Errorf("Errored: %s", err)
+	}
+	if connects, _ := counts(); connects != 1 {
+		t.Errorf("Expected one connect, got %d", connects)
+	}
+
+	// an old connection id is not used
+	client.connAt = time.Now().Add(-connIdLife)
+	if _, err := client.Scrape(ctx, hashes[:1]); err != nil {
+		t.Errorf("Errored: %s", err)
+	}
+	if connects, _ := counts(); connects != 2 {
+		t.Errorf("Expected a new connect, got %d", connects)
+	}
+
+	// the tracker forgot the connection id
+	mu.Lock()
+	connId++
+	mu.Unlock()
+	_, err = client.Scrape(ctx, hashes[:1])
+	var terr *TrackerError
+	if !errors.As(err, &terr) || terr.Reason != "bad connection id" {
+		t.Fatalf("Expected a tracker error, got %v", err)
+	}
+	if _, err := client.Scrape(ctx, hashes[:1]); err != nil {
+		t.Errorf("Errored: %s", err)
+	}
+	if connects, _ := counts(); connects != 3 {
+		t.Errorf("Expected a new connect after the error, got %d", connects)
+	}
+}